@@ -23,27 +23,39 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/alitto/pond"
 	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/queue"
 	"github.com/estahn/k8s-image-swapper/pkg/registry"
 	"github.com/estahn/k8s-image-swapper/pkg/secrets"
 	"github.com/estahn/k8s-image-swapper/pkg/types"
 	"github.com/estahn/k8s-image-swapper/pkg/webhook"
 	homedir "github.com/mitchellh/go-homedir"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	kwhhttp "github.com/slok/kubewebhook/v2/pkg/http"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
 )
 
 var cfgFile string
@@ -81,6 +93,28 @@ A mutating webhook for Kubernetes, pointing the images to a new location.`,
 			os.Exit(1)
 		}
 
+		// Create a registry client per additional target registry and replica
+		targetRegistryClients := []registry.Client{targetRegistryClient}
+		replicas := setupReplicas(cfg.Target.Replicas, &targetRegistryClients)
+		targets := []webhook.Target{}
+		for _, target := range cfg.Targets {
+			client, err := registry.NewClient(target.Registry)
+			if err != nil {
+				log.Err(err).Msgf("error connecting to target registry at %s", target.Domain())
+				os.Exit(1)
+			}
+			targets = append(targets, webhook.Target{
+				JMESPath:      target.JMESPath,
+				Client:        client,
+				Platforms:     target.Platforms,
+				CopyArtifacts: target.CopyArtifacts,
+				Rewrites:      target.Rewrites,
+				Region:        target.Region(),
+				Replicas:      setupReplicas(target.Replicas, &targetRegistryClients),
+			})
+			targetRegistryClients = append(targetRegistryClients, client)
+		}
+
 		imageSwapPolicy, err := types.ParseImageSwapPolicy(cfg.ImageSwapPolicy)
 		if err != nil {
 			log.Err(err).Str("policy", cfg.ImageSwapPolicy).Msg("parsing image swap policy failed")
@@ -96,24 +130,92 @@ A mutating webhook for Kubernetes, pointing the images to a new location.`,
 			imageCopyDeadline = cfg.ImageCopyDeadline
 		}
 
+		imageCopyQueueFullPolicy := types.ImageCopyQueueFullPolicy(types.ImageCopyQueueFullPolicyBlock)
+		if cfg.ImageCopyQueue.FullPolicy != "" {
+			imageCopyQueueFullPolicy, err = types.ParseImageCopyQueueFullPolicy(cfg.ImageCopyQueue.FullPolicy)
+			if err != nil {
+				log.Err(err).Str("policy", cfg.ImageCopyQueue.FullPolicy).Msg("parsing image copy queue full policy failed")
+			}
+		}
+
+		vulnerabilityAction := types.VulnerabilityAction(types.VulnerabilityActionSkip)
+		if cfg.VulnerabilityPolicy.Action != "" {
+			vulnerabilityAction, err = types.ParseVulnerabilityAction(cfg.VulnerabilityPolicy.Action)
+			if err != nil {
+				log.Err(err).Str("action", cfg.VulnerabilityPolicy.Action).Msg("parsing vulnerability action failed")
+			}
+		}
+		for _, client := range targetRegistryClients {
+			if _, ok := client.(registry.VulnerabilityScanner); cfg.VulnerabilityPolicy.Enabled && !ok {
+				log.Warn().Str("registry", client.Endpoint()).Msg("target registry does not provide scan findings, vulnerability policy is not applied")
+			}
+		}
+
+		if len(cfg.Source.Platforms) > 0 && (cfg.Target.CopyArtifacts || slices.ContainsFunc(cfg.Targets, func(target config.TargetRegistry) bool { return target.CopyArtifacts })) {
+			log.Warn().Msg("signatures and attestations are not copied for images limited to the platforms of source.platforms")
+		}
+
+		copier := setupCopier(cfg.ImageCopyQueue)
+		if err := webhook.RegisterCopierMetrics(prometheus.DefaultRegisterer, copier); err != nil {
+			log.Err(err).Msg("error registering copier metrics")
+		}
+
 		imagePullSecretProvider := setupImagePullSecretsProvider()
 
 		// Inform secret provider about managed private source registries
 		imagePullSecretProvider.SetAuthenticatedRegistries(sourceRegistryClients)
 
-		wh, err := webhook.NewImageSwapperWebhookWithOpts(
-			targetRegistryClient,
+		copyJobStore := setupCopyJobStore(cfg.ImageCopyQueue.Store)
+
+		swapperOptions := []webhook.Option{
 			webhook.Filters(cfg.Source.Filters),
+			webhook.SourceRateLimits(cfg.Source.RateLimits),
+			webhook.SourcePlatforms(cfg.Source.Platforms),
+			webhook.Platforms(cfg.Target.Platforms),
+			webhook.CopyArtifacts(cfg.Target.CopyArtifacts),
+			webhook.RepositoryRewrites(cfg.Target.Rewrites),
+			webhook.Targets(targets),
+			webhook.Replicas(cfg.Target.Region(), replicas),
+			webhook.ClusterRegion(cfg.Region),
 			webhook.ImagePullSecretsProvider(imagePullSecretProvider),
 			webhook.ImageSwapPolicy(imageSwapPolicy),
 			webhook.ImageCopyPolicy(imageCopyPolicy),
 			webhook.ImageCopyDeadline(imageCopyDeadline),
-		)
+			webhook.DryRun(cfg.DryRun),
+			webhook.MutateWorkloads(cfg.MutateWorkloads),
+			webhook.DigestPinning(cfg.DigestPinning),
+			webhook.Copier(copier),
+			webhook.CopyQueueFullPolicy(imageCopyQueueFullPolicy),
+			webhook.CopyPriorities(cfg.ImageCopyQueue.Priorities),
+			webhook.NamespaceLister(setupNamespaceLister(cfg.ImageCopyQueue.Priorities)),
+			webhook.CopyJobStore(copyJobStore),
+			webhook.CopyRetryPolicy(copyRetryPolicy(cfg.ImageCopyQueue.Retry)),
+			webhook.VulnerabilityPolicy(cfg.VulnerabilityPolicy, vulnerabilityAction),
+			webhook.RecordOriginalImages(cfg.Fallback.Enabled),
+		}
+
+		if len(cfg.Source.SignatureVerification) > 0 {
+			signatureVerifier, err := registry.NewSignatureVerifier(cfg.Source.SignatureVerification)
+			if err != nil {
+				log.Err(err).Msg("error setting up signature verification")
+				os.Exit(1)
+			}
+			defer func() {
+				_ = signatureVerifier.Close()
+			}()
+
+			swapperOptions = append(swapperOptions, webhook.VerifySignatures(signatureVerifier))
+		}
+
+		imageSwapper := webhook.NewImageSwapperWithOpts(targetRegistryClient, swapperOptions...).(*webhook.ImageSwapper)
+		wh, err := webhook.NewImageSwapperWebhookFor(imageSwapper)
 		if err != nil {
 			log.Err(err).Msg("error creating webhook")
 			os.Exit(1)
 		}
 
+		stopFallbackController := setupFallbackController(cfg.Fallback, imageSwapper)
+
 		// Get the handler for our webhook.
 		whHandler, err := kwhhttp.HandlerFor(kwhhttp.HandlerConfig{Webhook: wh})
 		if err != nil {
@@ -151,18 +253,23 @@ A mutating webhook for Kubernetes, pointing the images to a new location.`,
 			log.Info().Msgf("Listening on %v", cfg.ListenAddress)
 			//err = http.ListenAndServeTLS(":8080", cfg.certFile, cfg.keyFile, whHandler)
 			if cfg.TLSCertFile != "" && cfg.TLSKeyFile != "" {
-				if err := srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+				if err := srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil && !errors.Is(err, http.ErrServerClosed) {
 					log.Err(err).Msg("error serving webhook")
 					os.Exit(1)
 				}
 			} else {
-				if err := srv.ListenAndServe(); err != nil {
+				if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 					log.Err(err).Msg("error serving webhook")
 					os.Exit(1)
 				}
 			}
 		}()
 
+		servers := []*http.Server{srv}
+		if adminSrv := setupAdminServer(cfg.AdminListenAddress, copyJobStore); adminSrv != nil {
+			servers = append(servers, adminSrv)
+		}
+
 		c := make(chan os.Signal, 1)
 		// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C) or SIGTERM
 		// SIGKILL, SIGQUIT will not be caught.
@@ -171,21 +278,185 @@ A mutating webhook for Kubernetes, pointing the images to a new location.`,
 		// Block until we receive our signal.
 		<-c
 
-		// Create a deadline to wait for.
-		var wait time.Duration
-		ctx, cancel := context.WithTimeout(context.Background(), wait)
-		defer cancel()
-		// Doesn't block if no connections, but will otherwise wait
-		// until the timeout deadline.
+		shutdownTimeout := config.DefaultShutdownTimeout
+		if cfg.ShutdownTimeout != 0 {
+			shutdownTimeout = cfg.ShutdownTimeout
+		}
+
+		log.Info().Dur("timeout", shutdownTimeout).Msg("Shutting down")
+		stopFallbackController()
+		shutdown(servers, copier, imageSwapper, copyJobStore, append(sourceRegistryClients, targetRegistryClients...), shutdownTimeout)
+		log.Info().Msg("Shutdown complete")
+	},
+}
+
+// setupReplicas creates a registry client per replica of a target registry, the clients are added to the list of
+// clients stopped on shutdown
+func setupReplicas(registries []config.Registry, clients *[]registry.Client) []webhook.Replica {
+	replicas := make([]webhook.Replica, 0, len(registries))
+	for _, reg := range registries {
+		client, err := registry.NewClient(reg)
+		if err != nil {
+			log.Err(err).Msgf("error connecting to replica registry at %s", reg.Domain())
+			os.Exit(1)
+		}
+		replicas = append(replicas, webhook.Replica{Region: reg.Region(), Client: client, CopyArtifacts: reg.CopyArtifacts})
+		*clients = append(*clients, client)
+	}
+	return replicas
+}
+
+// fallbackLeaseName is the lease electing the replica running the fallback controller
+const fallbackLeaseName = "k8s-image-swapper-fallback"
+
+// setupFallbackController starts the controller restoring the original images of pods failing to pull swapped
+// images on the replica holding the lease, the returned function stops it
+func setupFallbackController(fallbackCfg config.Fallback, imageSwapper *webhook.ImageSwapper) context.CancelFunc {
+	if !fallbackCfg.Enabled {
+		return func() {}
+	}
+
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to configure Kubernetes client, will continue without fallback controller")
+		return func() {}
+	}
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to configure Kubernetes client, will continue without fallback controller")
+		return func() {}
+	}
+
+	gracePeriod := config.DefaultFallbackGracePeriod
+	if fallbackCfg.GracePeriod != 0 {
+		gracePeriod = fallbackCfg.GracePeriod
+	}
+
+	identity, err := os.Hostname()
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to determine leader election identity, will continue without fallback controller")
+		return func() {}
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: fallbackLeaseName, Namespace: podNamespace()},
+		Client:     clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	controller := webhook.NewFallbackController(clientset, imageSwapper, gracePeriod)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		// only the leader restores images, the other replicas take over once the lease expires
+		for ctx.Err() == nil {
+			// the lease is released if the controller stops, e.g. on errors
+			electionCtx, stop := context.WithCancel(ctx)
+			leaderelection.RunOrDie(electionCtx, leaderelection.LeaderElectionConfig{
+				Lock:            lock,
+				Name:            fallbackLeaseName,
+				LeaseDuration:   15 * time.Second,
+				RenewDeadline:   10 * time.Second,
+				RetryPeriod:     2 * time.Second,
+				ReleaseOnCancel: true,
+				Callbacks: leaderelection.LeaderCallbacks{
+					OnStartedLeading: func(leaderCtx context.Context) {
+						defer stop()
+						if err := controller.Run(leaderCtx); err != nil && !errors.Is(err, context.Canceled) {
+							log.Err(err).Msg("error running fallback controller")
+						}
+					},
+					OnStoppedLeading: func() {
+						log.Info().Str("identity", identity).Msg("fallback controller stopped leading")
+					},
+				},
+			})
+			stop()
+		}
+	}()
+
+	// the lease is released before the shutdown completes
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// setupAdminServer serves the copy job API on a separate listener, it is kept off the webhook port as it is not
+// authenticated. No server is started if the address is empty.
+func setupAdminServer(address string, copyJobStore queue.Store) *http.Server {
+	if address == "" {
+		return nil
+	}
+
+	copyJobsHandler := queue.NewHandler(copyJobStore)
+	handler := http.NewServeMux()
+	handler.Handle("/copy-jobs", copyJobsHandler)
+	handler.Handle("/copy-jobs/", copyJobsHandler)
+
+	srv := &http.Server{
+		Addr:         address,
+		WriteTimeout: time.Second * 15,
+		ReadTimeout:  time.Second * 15,
+		IdleTimeout:  time.Second * 60,
+		Handler:      handler,
+	}
+
+	go func() {
+		log.Info().Msgf("Admin API listening on %v", address)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Err(err).Msg("error serving admin API")
+			os.Exit(1)
+		}
+	}()
+
+	return srv
+}
+
+// shutdown stops accepting admissions, drains the copy queue and stops the registry clients within the timeout.
+// Copies which did not finish in time are kept in the copy job store and resumed on the next start.
+func shutdown(servers []*http.Server, copier *pond.WorkerPool, imageSwapper *webhook.ImageSwapper, copyJobStore queue.Store, registryClients []registry.Client, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Doesn't block if no connections, but will otherwise wait until the admissions are processed or the deadline
+	for _, srv := range servers {
 		if err := srv.Shutdown(ctx); err != nil {
 			log.Err(err).Msg("Error during shutdown")
 		}
-		// Optionally, you could run srv.Shutdown in a goroutine and block on
-		// <-ctx.Done() if your application should wait for other services
-		// to finalize based on context cancellation.
-		log.Info().Msg("Shutting down")
-		os.Exit(0)
-	},
+	}
+
+	// wait for running and queued copies in the remaining time
+	if deadline, ok := ctx.Deadline(); ok {
+		copier.StopAndWaitFor(time.Until(deadline))
+	}
+	imageSwapper.PersistQueuedCopies(ctx)
+
+	if jobs, err := copyJobStore.List(context.Background()); err != nil {
+		log.Err(err).Msg("failed listing unfinished copy jobs")
+	} else if pending := countPendingJobs(jobs); pending > 0 {
+		log.Warn().Int("jobs", pending).Msg("copy jobs did not finish before shutdown")
+	}
+
+	for _, registryClient := range registryClients {
+		if err := registryClient.Close(); err != nil {
+			log.Err(err).Str("registry", registryClient.Endpoint()).Msg("error closing registry client")
+		}
+	}
+}
+
+// countPendingJobs returns the number of jobs which are not dead-lettered
+func countPendingJobs(jobs []queue.Job) int {
+	pending := 0
+	for _, job := range jobs {
+		if !job.DeadLetter {
+			pending++
+		}
+	}
+	return pending
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -212,6 +483,7 @@ func init() {
 	// when this action is called directly.
 	//rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 	rootCmd.Flags().StringVar(&cfg.ListenAddress, "listen-address", ":8443", "Address on which to expose the webhook")
+	rootCmd.Flags().StringVar(&cfg.AdminListenAddress, "admin-listen-address", "127.0.0.1:8081", "Address on which to expose the copy job API, disabled if empty")
 	rootCmd.Flags().StringVar(&cfg.TLSCertFile, "tls-cert-file", "", "File containing the TLS certificate")
 	rootCmd.Flags().StringVar(&cfg.TLSKeyFile, "tls-key-file", "", "File containing the TLS private key")
 	rootCmd.Flags().BoolVar(&cfg.DryRun, "dry-run", true, "If true, print the action taken without taking it")
@@ -250,6 +522,7 @@ func initConfig() {
 	if err := viper.Unmarshal(&cfg); err != nil {
 		log.Err(err).Msg("failed to unmarshal the config file")
 	}
+	config.SetTargetDefaults(viper.GetViper(), cfg)
 
 	//validate := validator.New()
 	//if err := validate.Struct(cfg); err != nil {
@@ -294,3 +567,139 @@ func setupImagePullSecretsProvider() secrets.ImagePullSecretsProvider {
 
 	return secrets.NewKubernetesImagePullSecretsProvider(clientset)
 }
+
+// setupCopier configures the worker pool copying images, unset values use the defaults
+func setupCopier(queueCfg config.ImageCopyQueue) *pond.WorkerPool {
+	workers := config.DefaultImageCopyWorkers
+	if queueCfg.Workers > 0 {
+		workers = queueCfg.Workers
+	}
+
+	capacity := config.DefaultImageCopyQueueCapacity
+	if queueCfg.Capacity > 0 {
+		capacity = queueCfg.Capacity
+	}
+
+	var options []pond.Option
+	if queueCfg.IdleTimeout > 0 {
+		options = append(options, pond.IdleTimeout(queueCfg.IdleTimeout))
+	}
+
+	return pond.New(workers, capacity, options...)
+}
+
+// setupNamespaceLister watches namespaces if a copy priority selects namespaces by their labels,
+// nil is returned otherwise
+func setupNamespaceLister(priorities []config.CopyPriority) corelisters.NamespaceLister {
+	selectors := false
+	for _, priority := range priorities {
+		if priority.NamespaceSelector == nil {
+			continue
+		}
+		if _, err := metav1.LabelSelectorAsSelector(priority.NamespaceSelector); err != nil {
+			log.Err(err).Int("priority", priority.Priority).Msg("invalid namespace selector of copy priority")
+			os.Exit(1)
+		}
+		selectors = true
+	}
+	if !selectors {
+		return nil
+	}
+
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to configure Kubernetes client, namespace selectors of copy priorities do not match")
+		return nil
+	}
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to configure Kubernetes client, namespace selectors of copy priorities do not match")
+		return nil
+	}
+
+	// the informer runs for the lifetime of the process
+	factory := informers.NewSharedInformerFactory(clientset, 10*time.Minute)
+	lister := factory.Core().V1().Namespaces().Lister()
+	factory.Start(wait.NeverStop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for informer, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			log.Warn().Str("informer", informer.String()).Msg("namespaces not synced yet, copy priorities may not match")
+		}
+	}
+
+	return lister
+}
+
+// setupCopyJobStore configures the store persisting copy jobs
+func setupCopyJobStore(storeCfg config.CopyJobStore) queue.Store {
+	switch storeCfg.Type {
+	case "file":
+		store, err := queue.NewFileStore(storeCfg.Path)
+		if err != nil {
+			log.Err(err).Str("path", storeCfg.Path).Msg("failed to set up copy job store")
+			os.Exit(1)
+		}
+		return store
+	case "configmap":
+		restConfig, err := rest.InClusterConfig()
+		if err != nil {
+			log.Err(err).Msg("failed to configure Kubernetes client for copy job store")
+			os.Exit(1)
+		}
+
+		clientset, err := kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			log.Err(err).Msg("failed to configure Kubernetes client for copy job store")
+			os.Exit(1)
+		}
+
+		namespace := storeCfg.ConfigMap.Namespace
+		if namespace == "" {
+			namespace = podNamespace()
+		}
+
+		name := storeCfg.ConfigMap.Name
+		if name == "" {
+			name = "k8s-image-swapper-copy-jobs"
+		}
+
+		return queue.NewConfigMapStore(clientset, namespace, name)
+	case "", "memory":
+		return queue.NewMemoryStore()
+	default:
+		log.Error().Str("type", storeCfg.Type).Msg("unknown copy job store type, expected memory, file or configmap")
+		os.Exit(1)
+		return nil
+	}
+}
+
+// copyRetryPolicy returns the retry policy for failed image copies, unset values use the defaults
+func copyRetryPolicy(retryCfg config.CopyRetry) queue.RetryPolicy {
+	policy := queue.DefaultRetryPolicy
+	if retryCfg.MaxAttempts > 0 {
+		policy.MaxAttempts = retryCfg.MaxAttempts
+	}
+	if retryCfg.InitialBackoff > 0 {
+		policy.InitialBackoff = retryCfg.InitialBackoff
+	}
+	if retryCfg.MaxBackoff > 0 {
+		policy.MaxBackoff = retryCfg.MaxBackoff
+	}
+	if retryCfg.Jitter > 0 {
+		policy.Jitter = retryCfg.Jitter
+	}
+	return policy
+}
+
+// podNamespace returns the namespace k8s-image-swapper is running in
+func podNamespace() string {
+	namespace, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err != nil {
+		return "default"
+	}
+	return strings.TrimSpace(string(namespace))
+}
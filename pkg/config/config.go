@@ -23,47 +23,218 @@ package config
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/estahn/k8s-image-swapper/pkg/types"
 )
 
 const DefaultImageCopyDeadline = 8 * time.Second
 
+// DefaultShutdownTimeout fits into the default termination grace period of 30s
+const DefaultShutdownTimeout = 25 * time.Second
+
+const (
+	DefaultImageCopyWorkers       = 100
+	DefaultImageCopyQueueCapacity = 1000
+)
+
+// DefaultFallbackGracePeriod leaves time for a retriggered copy to finish before the original image is restored
+const DefaultFallbackGracePeriod = 5 * time.Minute
+
 type Config struct {
 	LogLevel  string `yaml:"logLevel" validate:"oneof=trace debug info warn error fatal"`
 	LogFormat string `yaml:"logFormat" validate:"oneof=json console"`
 
 	ListenAddress string
+	// AdminListenAddress exposes the copy job API without authentication, it is not served if empty
+	AdminListenAddress string
+	// ShutdownTimeout defines how long to wait for admissions and queued copies to finish on shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
 
 	DryRun            bool          `yaml:"dryRun"`
 	ImageSwapPolicy   string        `yaml:"imageSwapPolicy" validate:"oneof=always exists"`
 	ImageCopyPolicy   string        `yaml:"imageCopyPolicy" validate:"oneof=delayed immediate force none"`
 	ImageCopyDeadline time.Duration `yaml:"imageCopyDeadline"`
+	MutateWorkloads   bool          `yaml:"mutateWorkloads"`
+	DigestPinning     bool          `yaml:"digestPinning"`
+
+	ImageCopyQueue ImageCopyQueue `yaml:"imageCopyQueue"`
+
+	VulnerabilityPolicy VulnerabilityPolicy `yaml:"vulnerabilityPolicy"`
+
+	Fallback Fallback `yaml:"fallback"`
 
 	Source Source   `yaml:"source"`
 	Target Registry `yaml:"target"`
+	// Targets are additional target registries selected per image, images not selected by any of them are copied
+	// to Target
+	Targets []TargetRegistry `yaml:"targets"`
+	// Region of the cluster, pods are swapped to the replica of the target registry in this region
+	Region string `yaml:"region"`
 
 	TLSCertFile string
 	TLSKeyFile  string
 }
 
+// ImageCopyQueue configures the handling of image copy jobs
+type ImageCopyQueue struct {
+	// Workers is the maximum number of concurrent image copies
+	Workers int `yaml:"workers"`
+	// Capacity is the maximum number of image copies waiting for a worker
+	Capacity   int    `yaml:"capacity"`
+	FullPolicy string `yaml:"fullPolicy" validate:"oneof=block drop reject"`
+	// IdleTimeout defines after which duration idle workers are stopped
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+
+	Store CopyJobStore `yaml:"store"`
+	Retry CopyRetry    `yaml:"retry"`
+
+	// Priorities are evaluated in order, the first matching rule defines the priority of a copy
+	Priorities []CopyPriority `yaml:"priorities"`
+}
+
+// VulnerabilityPolicy skips or denies swapping to images whose scan findings in the target registry exceed the thresholds
+type VulnerabilityPolicy struct {
+	Enabled bool   `yaml:"enabled"`
+	Action  string `yaml:"action" validate:"oneof=skip deny"`
+	// Thresholds are the maximum number of findings accepted per severity, e.g. {"CRITICAL": 0, "HIGH": 5}
+	Thresholds map[string]int `yaml:"thresholds"`
+	// AllowList contains vulnerability IDs which are not counted, e.g. "CVE-2023-4863"
+	AllowList []string `yaml:"allowList"`
+	// RequireScan treats images without scan results as exceeding the thresholds
+	RequireScan bool `yaml:"requireScan"`
+}
+
+// Fallback restores the original image of containers failing to pull the swapped image
+type Fallback struct {
+	Enabled bool `yaml:"enabled"`
+	// GracePeriod defines how long a retriggered copy may take before the original image is restored
+	GracePeriod time.Duration `yaml:"gracePeriod"`
+}
+
+// CopyPriority assigns a priority to copies matching all given conditions, higher priorities are copied first
+type CopyPriority struct {
+	Priority   int               `yaml:"priority"`
+	Namespaces []string          `yaml:"namespaces"`
+	Labels     map[string]string `yaml:"labels"`
+	// NamespaceSelector matches the labels of the namespace of the object, e.g. {"matchLabels": {"tier": "critical"}}
+	NamespaceSelector *metav1.LabelSelector `yaml:"namespaceSelector"`
+	// JMESPath is evaluated over the filter context and has to return true
+	JMESPath string `yaml:"jmespath"`
+}
+
+// CopyRetry configures the exponential backoff of failed image copies, unset values use the defaults
+type CopyRetry struct {
+	MaxAttempts    int           `yaml:"maxAttempts"`
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff"`
+	Jitter         float64       `yaml:"jitter"`
+}
+
+// CopyJobStore configures where copy jobs are persisted to survive restarts
+type CopyJobStore struct {
+	Type string `yaml:"type" validate:"oneof=memory file configmap"`
+	// Path is the directory used by the file store, e.g. a mounted persistent volume
+	Path      string                `yaml:"path"`
+	ConfigMap CopyJobStoreConfigMap `yaml:"configMap"`
+}
+
+// CopyJobStoreConfigMap describes the ConfigMap used by the configmap store, the namespace defaults to the pod namespace
+type CopyJobStoreConfigMap struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+}
+
 type JMESPathFilter struct {
 	JMESPath string `yaml:"jmespath"`
 }
 
 type Source struct {
-	Registries []Registry       `yaml:"registries"`
-	Filters    []JMESPathFilter `yaml:"filters"`
+	Registries []Registry        `yaml:"registries"`
+	Filters    []JMESPathFilter  `yaml:"filters"`
+	RateLimits []SourceRateLimit `yaml:"rateLimits"`
+	// Platforms are evaluated in order, the first matching rule overrides the platforms of the target registry
+	Platforms []SourcePlatforms `yaml:"platforms"`
+	// SignatureVerification requires images to be signed before they are copied and swapped
+	SignatureVerification []SignatureVerification `yaml:"signatureVerification"`
+}
+
+// SignatureVerification requires sigstore (cosign) signatures for images within the scope
+type SignatureVerification struct {
+	// Scope is a registry, e.g. "docker.io", a repository namespace, e.g. "ghcr.io/org", or a wildcard domain,
+	// e.g. "*.example.com". "*" applies to all images. Only the rule with the most specific scope applies:
+	// the longest matching namespace, then the longest matching wildcard domain and finally "*".
+	Scope string `yaml:"scope"`
+	// Keys are paths to public keys, signatures of any of the keys are accepted
+	Keys    []string             `yaml:"keys"`
+	Keyless *KeylessVerification `yaml:"keyless"`
+	// RekorPublicKey is the path to the public key of the Rekor transparency log, required for keyless signatures
+	RekorPublicKey string `yaml:"rekorPublicKey"`
+}
+
+// KeylessVerification describes the identity of keyless signatures issued by Fulcio
+type KeylessVerification struct {
+	// FulcioCA is the path to the certificates of the Fulcio CA
+	FulcioCA     string `yaml:"fulcioCA"`
+	OIDCIssuer   string `yaml:"oidcIssuer"`
+	SubjectEmail string `yaml:"subjectEmail"`
+}
+
+// SourcePlatforms selects the platforms copied for images matching the JMESPath filter
+type SourcePlatforms struct {
+	JMESPath  string   `yaml:"jmespath"`
+	Platforms []string `yaml:"platforms"`
+}
+
+// SourceRateLimit limits the image copies from a source registry, e.g. to stay within the Docker Hub pull limits
+type SourceRateLimit struct {
+	// Domain of the source registry, e.g. "docker.io", "*" applies to all registries without a dedicated limit
+	Domain string `yaml:"domain"`
+	// Concurrency is the maximum number of concurrent copies, unlimited if not set
+	Concurrency int `yaml:"concurrency"`
+	// CopiesPerMinute is the sustained rate of copies, unlimited if not set
+	CopiesPerMinute float64 `yaml:"copiesPerMinute"`
+	// Burst is the number of copies which may exceed the rate at once, defaults to 1
+	Burst int `yaml:"burst"`
 }
 
 type Registry struct {
-	Type string `yaml:"type"`
-	AWS  AWS    `yaml:"aws"`
-	GCP  GCP    `yaml:"gcp"`
+	Type    string  `yaml:"type"`
+	AWS     AWS     `yaml:"aws"`
+	GCP     GCP     `yaml:"gcp"`
+	Azure   Azure   `yaml:"azure"`
+	Generic Generic `yaml:"generic"`
+	Harbor  Harbor  `yaml:"harbor"`
+	// Platforms limits the platforms copied from manifest lists, e.g. "linux/amd64", or "system" for the platform of
+	// k8s-image-swapper. All platforms are copied if empty.
+	Platforms []string `yaml:"platforms"`
+	// CopyArtifacts copies cosign signatures, attestations and OCI referrers (e.g. SBOMs) along with the images
+	CopyArtifacts bool `yaml:"copyArtifacts"`
+	// Rewrites map source repositories to repositories in the target registry, the first matching rule applies.
+	// The full source repository is used if no rule matches, e.g. "docker.io/library/nginx".
+	Rewrites []RepositoryRewrite `yaml:"rewrites"`
+	// Replicas receive the images copied to the target registry, e.g. registries in other regions
+	Replicas []Registry `yaml:"replicas"`
+}
+
+// TargetRegistry is an additional target registry for the images matching the JMESPath expression, e.g. per tenant
+type TargetRegistry struct {
+	// JMESPath is evaluated over the filter context, the first matching target registry is used
+	JMESPath string `yaml:"jmespath"`
+	Registry `yaml:",inline" mapstructure:",squash"`
+}
+
+// RepositoryRewrite maps the source repositories matching a regular expression to a repository in the target registry
+type RepositoryRewrite struct {
+	// Match is matched against the source repository including the domain, e.g. "^docker\.io/library/(.+)$"
+	Match string `yaml:"match"`
+	// Replace is the repository relative to the target registry, capture groups are referenced via $1 or ${name}
+	Replace string `yaml:"replace"`
 }
 
 type AWS struct {
@@ -80,6 +251,52 @@ type GCP struct {
 	RepositoryID string `yaml:"repositoryId"`
 }
 
+type Azure struct {
+	Registry string `yaml:"registry"`
+	TenantID string `yaml:"tenantId"`
+}
+
+// Generic describes a registry implementing the OCI Distribution specification, e.g. registry:2 or Zot
+type Generic struct {
+	Repository string `yaml:"repository"`
+	Prefix     string `yaml:"prefix"`
+	Username   string `yaml:"username"`
+	Password   string `yaml:"password"`
+	Token      string `yaml:"token"`
+	// CertDir is a directory containing certificates (*.crt for CAs, *.cert/*.key for client certificates)
+	CertDir  string `yaml:"certDir"`
+	Insecure bool   `yaml:"insecure"`
+}
+
+// Harbor describes a Harbor registry, projects are created on demand
+type Harbor struct {
+	Repository string `yaml:"repository"`
+	// Project is used for all images if set, otherwise the first path segment of the image (e.g. "docker.io") is used
+	Project  string `yaml:"project"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	CertDir  string `yaml:"certDir"`
+	Insecure bool   `yaml:"insecure"`
+	// PlainHTTP allows calling the Harbor API via plain HTTP if TLS fails, the credentials are sent in cleartext
+	PlainHTTP      bool                 `yaml:"plainHTTP"`
+	ProjectOptions HarborProjectOptions `yaml:"projectOptions"`
+}
+
+// harborProjectName matches valid Harbor project names, e.g. "docker.io" but not "localhost:5000"
+var harborProjectName = regexp.MustCompile(`^[a-z0-9]+(?:[._-][a-z0-9]+)*$`)
+
+// ValidHarborProject returns true if the name is accepted as project name by Harbor
+func ValidHarborProject(name string) bool {
+	return len(name) <= 255 && harborProjectName.MatchString(name)
+}
+
+type HarborProjectOptions struct {
+	Public bool `yaml:"public"`
+	// StorageLimit is the project quota in bytes, values below 1 mean unlimited
+	StorageLimit    int64  `yaml:"storageLimit"`
+	RetentionPolicy string `yaml:"retentionPolicy"`
+}
+
 type ECROptions struct {
 	AccessPolicy               string                     `yaml:"accessPolicy"`
 	LifecyclePolicy            string                     `yaml:"lifecyclePolicy"`
@@ -115,6 +332,26 @@ func (g *GCP) GarDomain() string {
 	return fmt.Sprintf("%s-docker.pkg.dev/%s/%s", g.Location, g.ProjectID, g.RepositoryID)
 }
 
+func (a *Azure) AcrDomain() string {
+	return fmt.Sprintf("%s.azurecr.io", a.Registry)
+}
+
+func (g *Generic) GenericDomain() string {
+	domain := strings.TrimSuffix(g.Repository, "/")
+	if prefix := strings.Trim(g.Prefix, "/"); prefix != "" {
+		domain = domain + "/" + prefix
+	}
+	return domain
+}
+
+func (h *Harbor) HarborDomain() string {
+	domain := strings.TrimSuffix(h.Repository, "/")
+	if h.Project != "" {
+		domain = domain + "/" + h.Project
+	}
+	return domain
+}
+
 func (r Registry) Domain() string {
 	registry, _ := types.ParseRegistry(r.Type)
 	switch registry {
@@ -122,6 +359,25 @@ func (r Registry) Domain() string {
 		return r.AWS.EcrDomain()
 	case types.RegistryGCP:
 		return r.GCP.GarDomain()
+	case types.RegistryAzure:
+		return r.Azure.AcrDomain()
+	case types.RegistryGeneric:
+		return r.Generic.GenericDomain()
+	case types.RegistryHarbor:
+		return r.Harbor.HarborDomain()
+	default:
+		return ""
+	}
+}
+
+// Region returns the region of AWS and GCP registries, e.g. "ap-southeast-2" or "us-central1"
+func (r Registry) Region() string {
+	registry, _ := types.ParseRegistry(r.Type)
+	switch registry {
+	case types.RegistryAWS:
+		return r.AWS.Region
+	case types.RegistryGCP:
+		return r.GCP.Location
 	default:
 		return ""
 	}
@@ -137,6 +393,27 @@ func CheckRegistryConfiguration(r Registry) error {
 		return fmt.Errorf(`registry of type "%s" %s`, r.Type, info)
 	}
 
+	// artifacts refer to the digest of the source manifest, which changes if only some platforms are copied
+	if r.CopyArtifacts && len(r.Platforms) > 0 {
+		return errorWithType(`cannot combine "copyArtifacts" with "platforms", signatures and attestations would not match the copied images`)
+	}
+
+	for _, rewrite := range r.Rewrites {
+		if _, err := regexp.Compile(rewrite.Match); err != nil {
+			return errorWithType(fmt.Sprintf("has an invalid rewrite %q: %v", rewrite.Match, err))
+		}
+		if rewrite.Replace == "" {
+			return errorWithType(fmt.Sprintf(`requires a field "replace" for the rewrite %q`, rewrite.Match))
+		}
+	}
+
+	// pods are swapped to the replica in their region, only AWS and GCP registries are located in a region
+	for _, replica := range r.Replicas {
+		if replica.Region() == "" {
+			return errorWithType(fmt.Sprintf(`has a replica of type "%s" without a region, replicas must be of type "aws" or "gcp"`, replica.Type))
+		}
+	}
+
 	registry, _ := types.ParseRegistry(r.Type)
 	switch registry {
 	case types.RegistryAWS:
@@ -159,11 +436,69 @@ func CheckRegistryConfiguration(r Registry) error {
 		if r.GCP.RepositoryID == "" {
 			return errorWithType(`requires a field "repositoryId"`)
 		}
+	case types.RegistryAzure:
+		if r.Azure.Registry == "" {
+			return errorWithType(`requires a field "registry"`)
+		}
+	case types.RegistryGeneric:
+		if r.Generic.Repository == "" {
+			return errorWithType(`requires a field "repository"`)
+		}
+		if r.Generic.Username != "" && r.Generic.Password == "" {
+			return errorWithType(`requires a field "password" if "username" is set`)
+		}
+		if r.Generic.Token != "" && r.Generic.Username != "" {
+			return errorWithType(`accepts either "username" or "token", not both`)
+		}
+	case types.RegistryHarbor:
+		if r.Harbor.Repository == "" {
+			return errorWithType(`requires a field "repository"`)
+		}
+		if r.Harbor.Username == "" || r.Harbor.Password == "" {
+			return errorWithType(`requires the fields "username" and "password" to create projects`)
+		}
+		if r.Harbor.Project != "" && !ValidHarborProject(r.Harbor.Project) {
+			return errorWithType(fmt.Sprintf(`has an invalid project %q, projects consist of lowercase letters, digits, ".", "_" and "-"`, r.Harbor.Project))
+		}
 	}
 
 	return nil
 }
 
+// SetTargetDefaults applies the defaults of the target registry to the additional target registries and replicas,
+// viper only provides defaults for the target registry. Settings given in the configuration are kept.
+func SetTargetDefaults(v *viper.Viper, cfg *Config) {
+	setReplicaDefaults(v, "target", cfg.Target.Replicas)
+	for i := range cfg.Targets {
+		key := fmt.Sprintf("targets.%d", i)
+		setRegistryDefaults(v, key, &cfg.Targets[i].Registry)
+		setReplicaDefaults(v, key, cfg.Targets[i].Replicas)
+	}
+}
+
+func setReplicaDefaults(v *viper.Viper, key string, replicas []Registry) {
+	for i := range replicas {
+		setRegistryDefaults(v, fmt.Sprintf("%s.replicas.%d", key, i), &replicas[i])
+	}
+}
+
+// setRegistryDefaults applies the defaults to the registry configured at the given key
+func setRegistryDefaults(v *viper.Viper, key string, r *Registry) {
+	if r.Type == "" {
+		r.Type = "aws"
+	}
+	// an explicit false cannot be told apart from an unset field after unmarshalling
+	if !v.IsSet(key + ".aws.ecrOptions.imageScanningConfiguration.imageScanOnPush") {
+		r.AWS.ECROptions.ImageScanningConfiguration.ImageScanOnPush = true
+	}
+	if r.AWS.ECROptions.ImageTagMutability == "" {
+		r.AWS.ECROptions.ImageTagMutability = "MUTABLE"
+	}
+	if r.AWS.ECROptions.EncryptionConfiguration.EncryptionType == "" {
+		r.AWS.ECROptions.EncryptionConfiguration.EncryptionType = "AES256"
+	}
+}
+
 // SetViperDefaults configures default values for config items that are not set.
 func SetViperDefaults(v *viper.Viper) {
 	v.SetDefault("Target.Type", "aws")
@@ -7,6 +7,7 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // TestConfigParses validates if yaml annotation do not overlap
@@ -161,6 +162,176 @@ source:
 				},
 			},
 		},
+		{
+			name: "should render additional targets",
+			cfg: `
+targets:
+  - jmespath: "obj.metadata.namespace == 'team-a'"
+    aws:
+      accountId: 123456789
+      region: ap-southeast-2
+  - jmespath: "obj.metadata.namespace == 'team-b'"
+    type: generic
+    generic:
+      repository: registry.example.com
+    platforms:
+      - linux/amd64
+    aws:
+      ecrOptions:
+        imageScanningConfiguration:
+          imageScanOnPush: false
+`,
+			expCfg: Config{
+				Target: Registry{
+					Type: "aws",
+					AWS: AWS{
+						ECROptions: ECROptions{
+							ImageTagMutability: "MUTABLE",
+							ImageScanningConfiguration: ImageScanningConfiguration{
+								ImageScanOnPush: true,
+							},
+							EncryptionConfiguration: EncryptionConfiguration{
+								EncryptionType: "AES256",
+							},
+						},
+					},
+				},
+				Targets: []TargetRegistry{
+					{
+						JMESPath: "obj.metadata.namespace == 'team-a'",
+						Registry: Registry{
+							Type: "aws",
+							AWS: AWS{
+								AccountID: "123456789",
+								Region:    "ap-southeast-2",
+								ECROptions: ECROptions{
+									ImageTagMutability: "MUTABLE",
+									ImageScanningConfiguration: ImageScanningConfiguration{
+										ImageScanOnPush: true,
+									},
+									EncryptionConfiguration: EncryptionConfiguration{
+										EncryptionType: "AES256",
+									},
+								},
+							},
+						},
+					},
+					{
+						JMESPath: "obj.metadata.namespace == 'team-b'",
+						Registry: Registry{
+							Type: "generic",
+							Generic: Generic{
+								Repository: "registry.example.com",
+							},
+							AWS: AWS{
+								ECROptions: ECROptions{
+									ImageTagMutability: "MUTABLE",
+									EncryptionConfiguration: EncryptionConfiguration{
+										EncryptionType: "AES256",
+									},
+								},
+							},
+							Platforms: []string{"linux/amd64"},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "should render replicas",
+			cfg: `
+region: us-east-1
+target:
+  aws:
+    accountId: 123456789
+    region: ap-southeast-2
+  replicas:
+    - aws:
+        accountId: 123456789
+        region: us-east-1
+`,
+			expCfg: Config{
+				Region: "us-east-1",
+				Target: Registry{
+					Type: "aws",
+					AWS: AWS{
+						AccountID: "123456789",
+						Region:    "ap-southeast-2",
+						ECROptions: ECROptions{
+							ImageTagMutability: "MUTABLE",
+							ImageScanningConfiguration: ImageScanningConfiguration{
+								ImageScanOnPush: true,
+							},
+							EncryptionConfiguration: EncryptionConfiguration{
+								EncryptionType: "AES256",
+							},
+						},
+					},
+					Replicas: []Registry{
+						{
+							Type: "aws",
+							AWS: AWS{
+								AccountID: "123456789",
+								Region:    "us-east-1",
+								ECROptions: ECROptions{
+									ImageTagMutability: "MUTABLE",
+									ImageScanningConfiguration: ImageScanningConfiguration{
+										ImageScanOnPush: true,
+									},
+									EncryptionConfiguration: EncryptionConfiguration{
+										EncryptionType: "AES256",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "should render copy priorities",
+			cfg: `
+imageCopyQueue:
+  priorities:
+    - priority: 100
+      namespaceSelector:
+        matchLabels:
+          tier: critical
+        matchExpressions:
+          - key: env
+            operator: In
+            values: [prod]
+`,
+			expCfg: Config{
+				ImageCopyQueue: ImageCopyQueue{
+					Priorities: []CopyPriority{
+						{
+							Priority: 100,
+							NamespaceSelector: &metav1.LabelSelector{
+								MatchLabels: map[string]string{"tier": "critical"},
+								MatchExpressions: []metav1.LabelSelectorRequirement{
+									{Key: "env", Operator: metav1.LabelSelectorOpIn, Values: []string{"prod"}},
+								},
+							},
+						},
+					},
+				},
+				Target: Registry{
+					Type: "aws",
+					AWS: AWS{
+						ECROptions: ECROptions{
+							ImageTagMutability: "MUTABLE",
+							ImageScanningConfiguration: ImageScanningConfiguration{
+								ImageScanOnPush: true,
+							},
+							EncryptionConfiguration: EncryptionConfiguration{
+								EncryptionType: "AES256",
+							},
+						},
+					},
+				},
+			},
+		},
 		{
 			name: "should use previous defaults",
 			cfg: `
@@ -222,6 +393,7 @@ target:
 
 			gotCfg := Config{}
 			err := v.Unmarshal(&gotCfg)
+			SetTargetDefaults(v, &gotCfg)
 
 			if test.expErr {
 				assert.Error(err)
@@ -286,3 +458,150 @@ func TestEcrDomain(t *testing.T) {
 		})
 	}
 }
+
+func TestAcrDomain(t *testing.T) {
+	assert.Equal(t, "myregistry.azurecr.io", (&Azure{Registry: "myregistry"}).AcrDomain())
+}
+
+func TestGenericDomain(t *testing.T) {
+	tests := []struct {
+		name    string
+		generic Generic
+		domain  string
+	}{
+		{
+			name:    "without prefix",
+			generic: Generic{Repository: "registry.example.com:5000"},
+			domain:  "registry.example.com:5000",
+		},
+		{
+			name:    "with prefix",
+			generic: Generic{Repository: "registry.example.com", Prefix: "mirror"},
+			domain:  "registry.example.com/mirror",
+		},
+		{
+			name:    "with slashes",
+			generic: Generic{Repository: "registry.example.com/", Prefix: "/mirror/"},
+			domain:  "registry.example.com/mirror",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			assert.Equal(test.domain, test.generic.GenericDomain())
+		})
+	}
+}
+
+func TestHarborDomain(t *testing.T) {
+	assert.Equal(t, "harbor.example.com", (&Harbor{Repository: "harbor.example.com/"}).HarborDomain())
+	assert.Equal(t, "harbor.example.com/mirror", (&Harbor{Repository: "harbor.example.com", Project: "mirror"}).HarborDomain())
+}
+
+func TestCheckRegistryConfiguration(t *testing.T) {
+	tests := []struct {
+		name     string
+		registry Registry
+		expErr   bool
+	}{
+		{
+			name:     "missing type",
+			registry: Registry{},
+			expErr:   true,
+		},
+		{
+			name:     "artifacts with platforms",
+			registry: Registry{Type: "azure", Azure: Azure{Registry: "myregistry"}, CopyArtifacts: true, Platforms: []string{"linux/amd64"}},
+			expErr:   true,
+		},
+		{
+			name:     "azure without registry",
+			registry: Registry{Type: "azure"},
+			expErr:   true,
+		},
+		{
+			name:     "azure with registry",
+			registry: Registry{Type: "azure", Azure: Azure{Registry: "myregistry"}},
+		},
+		{
+			name:     "generic without repository",
+			registry: Registry{Type: "generic"},
+			expErr:   true,
+		},
+		{
+			name:     "generic with username but without password",
+			registry: Registry{Type: "generic", Generic: Generic{Repository: "registry.example.com", Username: "user"}},
+			expErr:   true,
+		},
+		{
+			name:     "generic with username and token",
+			registry: Registry{Type: "generic", Generic: Generic{Repository: "registry.example.com", Username: "user", Password: "pass", Token: "token"}},
+			expErr:   true,
+		},
+		{
+			name:     "generic with basic auth",
+			registry: Registry{Type: "generic", Generic: Generic{Repository: "registry.example.com", Username: "user", Password: "pass"}},
+		},
+		{
+			name:     "generic with token",
+			registry: Registry{Type: "generic", Generic: Generic{Repository: "registry.example.com", Token: "token"}},
+		},
+		{
+			name:     "harbor without credentials",
+			registry: Registry{Type: "harbor", Harbor: Harbor{Repository: "harbor.example.com"}},
+			expErr:   true,
+		},
+		{
+			name:     "harbor with credentials",
+			registry: Registry{Type: "harbor", Harbor: Harbor{Repository: "harbor.example.com", Username: "admin", Password: "Harbor12345"}},
+		},
+		{
+			name:     "harbor with invalid project",
+			registry: Registry{Type: "harbor", Harbor: Harbor{Repository: "harbor.example.com", Project: "Mirror", Username: "admin", Password: "Harbor12345"}},
+			expErr:   true,
+		},
+		{
+			name:     "harbor with project",
+			registry: Registry{Type: "harbor", Harbor: Harbor{Repository: "harbor.example.com", Project: "docker.io", Username: "admin", Password: "Harbor12345"}},
+		},
+		{
+			name:     "rewrite with invalid match",
+			registry: Registry{Type: "azure", Azure: Azure{Registry: "myregistry"}, Rewrites: []RepositoryRewrite{{Match: "^docker.io/(.+", Replace: "mirror/$1"}}},
+			expErr:   true,
+		},
+		{
+			name:     "rewrite without replace",
+			registry: Registry{Type: "azure", Azure: Azure{Registry: "myregistry"}, Rewrites: []RepositoryRewrite{{Match: "^docker.io/(.+)$"}}},
+			expErr:   true,
+		},
+		{
+			name:     "rewrite",
+			registry: Registry{Type: "azure", Azure: Azure{Registry: "myregistry"}, Rewrites: []RepositoryRewrite{{Match: "^docker.io/(.+)$", Replace: "mirror/$1"}}},
+		},
+		{
+			name:     "replica without region",
+			registry: Registry{Type: "azure", Azure: Azure{Registry: "myregistry"}, Replicas: []Registry{{Type: "harbor", Harbor: Harbor{Repository: "harbor.example.com"}}}},
+			expErr:   true,
+		},
+		{
+			name:     "replicas with region",
+			registry: Registry{Type: "azure", Azure: Azure{Registry: "myregistry"}, Replicas: []Registry{{Type: "aws", AWS: AWS{Region: "us-east-1"}}, {Type: "gcp", GCP: GCP{Location: "us-central1"}}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := CheckRegistryConfiguration(test.registry)
+			if test.expErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestRegistryRegion(t *testing.T) {
+	assert.Equal(t, "ap-southeast-2", Registry{Type: "aws", AWS: AWS{Region: "ap-southeast-2"}}.Region())
+	assert.Equal(t, "us-central1", Registry{Type: "gcp", GCP: GCP{Location: "us-central1"}}.Region())
+	assert.Equal(t, "", Registry{Type: "generic", Generic: Generic{Repository: "registry.example.com"}}.Region())
+}
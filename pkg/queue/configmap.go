@@ -0,0 +1,114 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// ConfigMapStore persists jobs in a Kubernetes ConfigMap, one key per job.
+// The ConfigMap is created on demand and is limited to 1MiB, i.e. a few thousand pending jobs.
+type ConfigMapStore struct {
+	kubernetesClient kubernetes.Interface
+	namespace        string
+	name             string
+}
+
+// NewConfigMapStore initialises a job store backed by the ConfigMap with the given name and namespace
+func NewConfigMapStore(kubernetesClient kubernetes.Interface, namespace string, name string) *ConfigMapStore {
+	return &ConfigMapStore{
+		kubernetesClient: kubernetesClient,
+		namespace:        namespace,
+		name:             name,
+	}
+}
+
+func (s *ConfigMapStore) Save(ctx context.Context, job Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	return s.update(ctx, func(configMap *v1.ConfigMap) bool {
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		configMap.Data[job.ID] = string(data)
+		return true
+	})
+}
+
+func (s *ConfigMapStore) Delete(ctx context.Context, id string) error {
+	return s.update(ctx, func(configMap *v1.ConfigMap) bool {
+		if _, exists := configMap.Data[id]; !exists {
+			return false
+		}
+		delete(configMap.Data, id)
+		return true
+	})
+}
+
+func (s *ConfigMapStore) List(ctx context.Context) ([]Job, error) {
+	configMap, err := s.kubernetesClient.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return []Job{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]Job, 0, len(configMap.Data))
+	for key, value := range configMap.Data {
+		var job Job
+		if err := json.Unmarshal([]byte(value), &job); err != nil {
+			log.Warn().Err(err).Str("key", key).Msg("skipping invalid copy job")
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+
+	sortJobs(jobs)
+	return jobs, nil
+}
+
+// update applies a change to the ConfigMap, creating it if necessary and retrying on conflicting updates
+func (s *ConfigMapStore) update(ctx context.Context, change func(configMap *v1.ConfigMap) bool) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMaps := s.kubernetesClient.CoreV1().ConfigMaps(s.namespace)
+
+		configMap, err := configMaps.Get(ctx, s.name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			configMap = &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      s.name,
+					Namespace: s.namespace,
+					Labels:    map[string]string{"app.kubernetes.io/managed-by": "k8s-image-swapper"},
+				},
+			}
+			if !change(configMap) {
+				return nil
+			}
+			_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+			if k8serrors.IsAlreadyExists(err) {
+				// created concurrently, retry as an update
+				return k8serrors.NewConflict(v1.Resource("configmaps"), s.name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if !change(configMap) {
+			return nil
+		}
+		_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+		return err
+	})
+}
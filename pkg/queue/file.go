@@ -0,0 +1,110 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// FileStore persists every job as a JSON file in a directory, e.g. on a persistent volume
+type FileStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileStore initialises a job store in the given directory, the directory is created if necessary
+func NewFileStore(path string) (*FileStore, error) {
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return nil, err
+	}
+
+	return &FileStore{path: path}, nil
+}
+
+func (s *FileStore) Save(ctx context.Context, job Job) error {
+	if !ValidJobID(job.ID) {
+		return ErrInvalidJobID
+	}
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// write to a temporary file first to never leave a partially written job behind
+	tmpFile, err := os.CreateTemp(s.path, ".job-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), s.filename(job.ID))
+}
+
+func (s *FileStore) Delete(ctx context.Context, id string) error {
+	if !ValidJobID(id) {
+		return ErrInvalidJobID
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(s.filename(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) List(ctx context.Context) ([]Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []Job{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(s.path, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var job Job
+		if err := json.Unmarshal(data, &job); err != nil {
+			log.Warn().Err(err).Str("file", entry.Name()).Msg("skipping invalid copy job")
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+
+	sortJobs(jobs)
+	return jobs, nil
+}
+
+// filename returns the file of a job, the id has to be validated to not escape the directory
+func (s *FileStore) filename(id string) string {
+	return filepath.Join(s.path, id+".json")
+}
@@ -0,0 +1,57 @@
+package queue
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// NewHandler returns an HTTP API to inspect copy jobs and remove dead-lettered jobs:
+//
+//	GET    /copy-jobs              lists all jobs
+//	GET    /copy-jobs?deadLetter=1 lists dead-lettered jobs only
+//	DELETE /copy-jobs/{id}         removes a job
+func NewHandler(store Store) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /copy-jobs", func(w http.ResponseWriter, r *http.Request) {
+		jobs, err := store.List(r.Context())
+		if err != nil {
+			log.Err(err).Msg("failed listing copy jobs")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		deadLetterOnly := r.URL.Query().Get("deadLetter") != ""
+		result := make([]Job, 0, len(jobs))
+		for _, job := range jobs {
+			if !deadLetterOnly || job.DeadLetter {
+				result = append(result, job)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			log.Err(err).Msg("failed writing copy jobs")
+		}
+	})
+
+	mux.HandleFunc("DELETE /copy-jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if !ValidJobID(id) {
+			http.Error(w, ErrInvalidJobID.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := store.Delete(r.Context(), id); err != nil {
+			log.Err(err).Msg("failed removing copy job")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return mux
+}
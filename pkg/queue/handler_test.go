@@ -0,0 +1,66 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	pending := Job{ID: JobID("registry.example.com/docker.io/library/nginx:latest"), TargetImage: "registry.example.com/docker.io/library/nginx:latest", CreatedAt: time.Now()}
+	dead := Job{ID: JobID("registry.example.com/docker.io/library/busybox:latest"), TargetImage: "registry.example.com/docker.io/library/busybox:latest", Attempts: 5, DeadLetter: true, CreatedAt: time.Now()}
+	require.NoError(t, store.Save(ctx, pending))
+	require.NoError(t, store.Save(ctx, dead))
+
+	handler := NewHandler(store)
+
+	list := func(url string) []Job {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var jobs []Job
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &jobs))
+		return jobs
+	}
+
+	assert.Len(t, list("/copy-jobs"), 2)
+
+	deadLetter := list("/copy-jobs?deadLetter=1")
+	require.Len(t, deadLetter, 1)
+	assert.Equal(t, dead.ID, deadLetter[0].ID)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/copy-jobs/"+dead.ID, nil))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Empty(t, list("/copy-jobs?deadLetter=1"))
+}
+
+func TestHandlerInvalidID(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(filepath.Join(dir, "jobs"))
+	require.NoError(t, err)
+
+	victim := filepath.Join(dir, "victim.json")
+	require.NoError(t, os.WriteFile(victim, []byte("{}"), 0o600))
+
+	rec := httptest.NewRecorder()
+	NewHandler(store).ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/copy-jobs/..%2Fvictim", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.FileExists(t, victim, "files outside the store are not removed")
+
+	assert.ErrorIs(t, store.Delete(context.Background(), "../victim"), ErrInvalidJobID)
+	assert.ErrorIs(t, store.Save(context.Background(), Job{ID: "../victim"}), ErrInvalidJobID)
+	assert.FileExists(t, victim)
+}
@@ -0,0 +1,59 @@
+package queue
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// ErrInvalidJobID is returned for identifiers which were not created by JobID
+var ErrInvalidJobID = errors.New("invalid copy job id")
+
+// Job describes an image copy to the target registry.
+// It holds everything needed to resume the copy after a restart, including the pod details required to look up
+// image pull secrets.
+type Job struct {
+	ID          string `json:"id"`
+	SourceImage string `json:"sourceImage"`
+	TargetImage string `json:"targetImage"`
+
+	Namespace          string   `json:"namespace,omitempty"`
+	ServiceAccountName string   `json:"serviceAccountName,omitempty"`
+	ImagePullSecrets   []string `json:"imagePullSecrets,omitempty"`
+	ImagePullPolicy    string   `json:"imagePullPolicy,omitempty"`
+
+	// Platforms limits the platforms copied from a manifest list, all platforms are copied if empty
+	Platforms []string `json:"platforms,omitempty"`
+
+	// Priority orders jobs waiting for a copy worker, higher priorities are copied first
+	Priority int `json:"priority,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	Attempts  int       `json:"attempts,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+
+	// NextAttemptAt is the earliest time the failed job is retried
+	NextAttemptAt time.Time `json:"nextAttemptAt,omitempty"`
+	// DeadLetter is set once the job exhausted all attempts, dead-lettered jobs are not retried
+	DeadLetter bool `json:"deadLetter,omitempty"`
+}
+
+// JobID returns the identifier of the job copying to the target image, jobs for the same target image share an ID
+func JobID(targetImage string) string {
+	sum := sha256.Sum256([]byte(targetImage))
+	return hex.EncodeToString(sum[:])
+}
+
+// ValidJobID returns true if the identifier has the format created by JobID, a hex encoded SHA-256 sum
+func ValidJobID(id string) bool {
+	if len(id) != hex.EncodedLen(sha256.Size) {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package queue
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// MemoryStore keeps jobs in memory only, jobs are lost on restart
+type MemoryStore struct {
+	mu   sync.Mutex
+	jobs map[string]Job
+}
+
+// NewMemoryStore initialises an empty in-memory job store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{jobs: map[string]Job{}}
+}
+
+func (s *MemoryStore) Save(ctx context.Context, job Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs[job.ID] = job
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.jobs, id)
+	return nil
+}
+
+func (s *MemoryStore) List(ctx context.Context) ([]Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := make([]Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	sortJobs(jobs)
+	return jobs, nil
+}
+
+// sortJobs orders jobs by creation time, oldest first
+func sortJobs(jobs []Job) {
+	sort.SliceStable(jobs, func(i, j int) bool {
+		if jobs[i].CreatedAt.Equal(jobs[j].CreatedAt) {
+			return jobs[i].ID < jobs[j].ID
+		}
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+}
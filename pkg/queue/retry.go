@@ -0,0 +1,48 @@
+package queue
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy defines how often and when failed jobs are retried
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts after which a job is dead-lettered
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry, doubled for every subsequent retry
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between retries
+	MaxBackoff time.Duration
+	// Jitter randomises the delay by the given fraction, e.g. 0.2 for ±20%, to spread retries of many jobs
+	Jitter float64
+}
+
+// DefaultRetryPolicy retries a job up to 5 times within roughly 7.5 minutes (30s, 1m, 2m and 4m between attempts)
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 30 * time.Second,
+	MaxBackoff:     10 * time.Minute,
+	Jitter:         0.2,
+}
+
+// Exhausted returns true if the job must not be retried anymore
+func (r RetryPolicy) Exhausted(attempts int) bool {
+	return attempts >= r.MaxAttempts
+}
+
+// Backoff returns the delay before the next attempt after the given number of failed attempts
+func (r RetryPolicy) Backoff(attempts int) time.Duration {
+	backoff := r.InitialBackoff
+	for i := 1; i < attempts && backoff < r.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if r.MaxBackoff > 0 && backoff > r.MaxBackoff {
+		backoff = r.MaxBackoff
+	}
+
+	if r.Jitter > 0 {
+		backoff += time.Duration((rand.Float64()*2 - 1) * r.Jitter * float64(backoff))
+	}
+
+	return backoff
+}
@@ -0,0 +1,39 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Second,
+	}
+
+	assert.Equal(t, time.Second, policy.Backoff(1))
+	assert.Equal(t, 2*time.Second, policy.Backoff(2))
+	assert.Equal(t, 4*time.Second, policy.Backoff(3))
+	assert.Equal(t, 5*time.Second, policy.Backoff(4), "capped at the maximum backoff")
+	assert.Equal(t, 5*time.Second, policy.Backoff(100))
+
+	assert.False(t, policy.Exhausted(4))
+	assert.True(t, policy.Exhausted(5))
+}
+
+func TestRetryPolicyBackoffJitter(t *testing.T) {
+	policy := RetryPolicy{
+		InitialBackoff: 10 * time.Second,
+		MaxBackoff:     time.Minute,
+		Jitter:         0.2,
+	}
+
+	for i := 0; i < 100; i++ {
+		backoff := policy.Backoff(1)
+		assert.GreaterOrEqual(t, backoff, 8*time.Second)
+		assert.LessOrEqual(t, backoff, 12*time.Second)
+	}
+}
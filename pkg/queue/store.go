@@ -0,0 +1,15 @@
+package queue
+
+import (
+	"context"
+)
+
+// Store persists copy jobs so pending and failed copies survive restarts
+type Store interface {
+	// Save creates or replaces the job with the same ID
+	Save(ctx context.Context, job Job) error
+	// Delete removes a job, deleting a missing job is not an error
+	Delete(ctx context.Context, id string) error
+	// List returns all stored jobs ordered by creation time
+	List(ctx context.Context) ([]Job, error)
+}
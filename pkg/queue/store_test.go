@@ -0,0 +1,95 @@
+package queue
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) Store{
+		"memory": func(t *testing.T) Store {
+			return NewMemoryStore()
+		},
+		"file": func(t *testing.T) Store {
+			store, err := NewFileStore(filepath.Join(t.TempDir(), "queue"))
+			require.NoError(t, err)
+			return store
+		},
+		"configmap": func(t *testing.T) Store {
+			return NewConfigMapStore(fake.NewSimpleClientset(), "k8s-image-swapper", "k8s-image-swapper-queue")
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+
+			jobs, err := store.List(ctx)
+			require.NoError(t, err)
+			assert.Empty(t, jobs)
+
+			now := time.Now().UTC().Truncate(time.Second)
+			nginx := Job{
+				ID:                 JobID("registry.example.com/docker.io/library/nginx:latest"),
+				SourceImage:        "docker.io/library/nginx:latest",
+				TargetImage:        "registry.example.com/docker.io/library/nginx:latest",
+				Namespace:          "default",
+				ServiceAccountName: "default",
+				ImagePullSecrets:   []string{"my-secret"},
+				CreatedAt:          now.Add(time.Minute),
+			}
+			busybox := Job{
+				ID:          JobID("registry.example.com/docker.io/library/busybox:latest"),
+				SourceImage: "docker.io/library/busybox:latest",
+				TargetImage: "registry.example.com/docker.io/library/busybox:latest",
+				CreatedAt:   now,
+			}
+
+			require.NoError(t, store.Save(ctx, nginx))
+			require.NoError(t, store.Save(ctx, busybox))
+
+			// saving a job again replaces it
+			nginx.Attempts = 1
+			nginx.LastError = "timeout"
+			require.NoError(t, store.Save(ctx, nginx))
+
+			jobs, err = store.List(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, []Job{busybox, nginx}, jobs)
+
+			require.NoError(t, store.Delete(ctx, busybox.ID))
+			require.NoError(t, store.Delete(ctx, JobID("missing")))
+
+			jobs, err = store.List(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, []Job{nginx}, jobs)
+		})
+	}
+}
+
+func TestFileStoreSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	path := t.TempDir()
+
+	store, err := NewFileStore(path)
+	require.NoError(t, err)
+	job := Job{ID: JobID("registry.example.com/docker.io/library/nginx:latest"), TargetImage: "registry.example.com/docker.io/library/nginx:latest"}
+	require.NoError(t, store.Save(ctx, job))
+
+	// invalid files are skipped
+	require.NoError(t, os.WriteFile(filepath.Join(path, "invalid.json"), []byte("{"), 0o600))
+
+	restarted, err := NewFileStore(path)
+	require.NoError(t, err)
+	jobs, err := restarted.List(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []Job{job}, jobs)
+}
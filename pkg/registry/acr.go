@@ -0,0 +1,149 @@
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+// acrTokenUsername is the username ACR expects in combination with a refresh token
+const acrTokenUsername = "00000000-0000-0000-0000-000000000000"
+
+// acrScope is the audience of the Azure AD token exchanged for an ACR refresh token
+const acrScope = "https://containerregistry.azure.net/.default"
+
+// ACRClient is a client for Azure Container Registry.
+// Images are copied like for any OCI Distribution registry using an ACR refresh token obtained via the AAD token exchange.
+type ACRClient struct {
+	*baseClient
+
+	credential  azcore.TokenCredential
+	httpClient  *http.Client
+	exchangeURL string
+	tenantID    string
+}
+
+func NewACRClient(clientConfig config.Azure) (*ACRClient, error) {
+	credential, err := azidentity.NewDefaultAzureCredential(&azidentity.DefaultAzureCredentialOptions{
+		TenantID: clientConfig.TenantID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := newBaseClient(clientConfig.AcrDomain())
+	if err != nil {
+		return nil, err
+	}
+
+	client := &ACRClient{
+		baseClient:  base,
+		credential:  credential,
+		httpClient:  &http.Client{Timeout: 10 * time.Second},
+		exchangeURL: fmt.Sprintf("https://%s/oauth2/exchange", clientConfig.AcrDomain()),
+		tenantID:    clientConfig.TenantID,
+	}
+
+	if err := client.startTokenRenewal(client); err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// requestAuthToken exchanges an Azure AD access token for an ACR refresh token and returns the credentials with their expiration date
+func (a *ACRClient) requestAuthToken() ([]byte, time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	aadToken, err := a.credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{acrScope}})
+	if err != nil {
+		log.Err(err).Msg("requesting azure ad token")
+		return []byte(""), time.Time{}, err
+	}
+
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {a.Endpoint()},
+		"access_token": {aadToken.Token},
+	}
+	if a.tenantID != "" {
+		form.Set("tenant", a.tenantID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.exchangeURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return []byte(""), time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		log.Err(err).Msg("exchanging azure ad token")
+		return []byte(""), time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return []byte(""), time.Time{}, fmt.Errorf("acr token exchange returned status %d", resp.StatusCode)
+	}
+
+	var exchange struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&exchange); err != nil {
+		return []byte(""), time.Time{}, err
+	}
+	if exchange.RefreshToken == "" {
+		return []byte(""), time.Time{}, fmt.Errorf("acr token exchange returned an empty refresh token")
+	}
+
+	expiryAt, err := jwtExpiry(exchange.RefreshToken)
+	if err != nil {
+		log.Debug().Err(err).Msg("unable to read refresh token expiry, falling back to azure ad token expiry")
+		expiryAt = aadToken.ExpiresOn
+	}
+
+	return []byte(acrTokenUsername + ":" + exchange.RefreshToken), expiryAt, nil
+}
+
+// CreateRepository is empty since ACR creates repositories on push
+func (a *ACRClient) CreateRepository(ctx context.Context, name string) error {
+	return nil
+}
+
+// jwtExpiry returns the expiration date of a JWT without verifying its signature
+func jwtExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("token is not a JWT")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, err
+	}
+	if claims.Exp == 0 {
+		return time.Time{}, fmt.Errorf("token has no expiry")
+	}
+
+	return time.Unix(claims.Exp, 0), nil
+}
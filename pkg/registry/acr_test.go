@@ -0,0 +1,110 @@
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeTokenCredential struct {
+	token  string
+	scopes []string
+}
+
+func (f *fakeTokenCredential) GetToken(ctx context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	f.scopes = options.Scopes
+	return azcore.AccessToken{Token: f.token, ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+func fakeJWT(exp time.Time) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, exp.Unix())))
+	return header + "." + payload + ".signature"
+}
+
+func newTestACRClient(t *testing.T, exchangeURL string, credential azcore.TokenCredential) *ACRClient {
+	base, err := newBaseClient("myregistry.azurecr.io")
+	require.NoError(t, err)
+
+	return &ACRClient{
+		baseClient:  base,
+		credential:  credential,
+		httpClient:  http.DefaultClient,
+		exchangeURL: exchangeURL,
+		tenantID:    "my-tenant",
+	}
+}
+
+func TestACRTokenExchange(t *testing.T) {
+	refreshToken := fakeJWT(time.Now().Add(3 * time.Hour))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/oauth2/exchange", r.URL.Path)
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "access_token", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "myregistry.azurecr.io", r.PostForm.Get("service"))
+		assert.Equal(t, "my-tenant", r.PostForm.Get("tenant"))
+		assert.Equal(t, "aad-token", r.PostForm.Get("access_token"))
+		_, _ = fmt.Fprintf(w, `{"refresh_token":"%s"}`, refreshToken)
+	}))
+	defer server.Close()
+
+	credential := &fakeTokenCredential{token: "aad-token"}
+	client := newTestACRClient(t, server.URL+"/oauth2/exchange", credential)
+
+	assert.NoError(t, client.startTokenRenewal(client))
+	t.Cleanup(client.scheduler.Stop)
+	assert.Equal(t, []string{acrScope}, credential.scopes)
+	assert.Equal(t, acrTokenUsername+":"+refreshToken, client.Credentials())
+
+	_, nextRun := client.scheduler.NextRun()
+	assert.WithinDuration(t, time.Now().Add(3*time.Hour-2*time.Minute), nextRun, 5*time.Second)
+}
+
+func TestACRTokenExchangeError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	client := newTestACRClient(t, server.URL+"/oauth2/exchange", &fakeTokenCredential{token: "aad-token"})
+
+	assert.Error(t, client.startTokenRenewal(client))
+	t.Cleanup(client.scheduler.Stop)
+	assert.Equal(t, "", client.Credentials())
+}
+
+func TestACRIsOrigin(t *testing.T) {
+	client := newTestACRClient(t, "", &fakeTokenCredential{})
+
+	assert.Equal(t, "myregistry.azurecr.io", client.Endpoint())
+
+	imageRef, err := alltransports.ParseImageName("docker://myregistry.azurecr.io/docker.io/library/nginx:latest")
+	require.NoError(t, err)
+	assert.True(t, client.IsOrigin(imageRef))
+
+	imageRef, err = alltransports.ParseImageName("docker://docker.io/library/nginx:latest")
+	require.NoError(t, err)
+	assert.False(t, client.IsOrigin(imageRef))
+}
+
+func TestJWTExpiry(t *testing.T) {
+	exp := time.Unix(time.Now().Add(time.Hour).Unix(), 0)
+
+	got, err := jwtExpiry(fakeJWT(exp))
+	assert.NoError(t, err)
+	assert.Equal(t, exp, got)
+
+	_, err = jwtExpiry("not-a-jwt")
+	assert.Error(t, err)
+}
@@ -0,0 +1,189 @@
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/pkg/docker/config"
+	"github.com/containers/image/v5/pkg/tlsclientconfig"
+	ctypes "github.com/containers/image/v5/types"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+// cosignTagSuffixes are the suffixes of the tags cosign attaches to an image, e.g. "sha256-<digest>.sig"
+var cosignTagSuffixes = []string{".sig", ".att", ".sbom"}
+
+var skippedArtifactCopies = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "k8s_image_swapper",
+	Name:      "artifact_copies_skipped_total",
+	Help:      "Number of images copied without their signatures and attestations because the copied manifest differs from the source.",
+})
+
+// copyArtifacts copies the cosign signatures, attestations and OCI referrers (e.g. SBOMs, provenance) of the source
+// image to the destination repository. Artifacts are only copied if the copied manifest is identical to the source,
+// as they refer to the digest of the source manifest.
+func copyArtifacts(ctx context.Context, srcRef ctypes.ImageReference, srcCtx *ctypes.SystemContext, destRef ctypes.ImageReference, destCtx *ctypes.SystemContext, imageDigest digest.Digest) error {
+	if srcRef.Transport().Name() != docker.Transport.Name() || destRef.Transport().Name() != docker.Transport.Name() {
+		return nil
+	}
+
+	srcDigest, err := docker.GetDigest(ctx, srcCtx, srcRef)
+	if err != nil {
+		return err
+	}
+	if srcDigest != imageDigest {
+		skippedArtifactCopies.Inc()
+		log.Ctx(ctx).Warn().Str("digest", srcDigest.String()).Str("copied-digest", imageDigest.String()).
+			Msg("copied manifest differs from source, e.g. due to selected platforms, skipping signatures and attestations")
+		return nil
+	}
+
+	srcRepo := reference.TrimNamed(srcRef.DockerReference())
+	destRepo := reference.TrimNamed(destRef.DockerReference())
+
+	nameOptions, srcOptions, err := remoteOptions(ctx, srcRepo, srcCtx)
+	if err != nil {
+		return err
+	}
+
+	artifacts, err := cosignArtifacts(srcRepo, srcDigest, nameOptions, srcOptions)
+	if err != nil {
+		return err
+	}
+
+	referrers, err := referrerArtifacts(srcRepo, srcDigest, nameOptions, srcOptions)
+	if err != nil {
+		return err
+	}
+	artifacts = append(artifacts, referrers...)
+
+	for _, artifact := range artifacts {
+		artifactSrcRef, err := artifactReference(srcRepo, artifact)
+		if err != nil {
+			return err
+		}
+		artifactDestRef, err := artifactReference(destRepo, artifact)
+		if err != nil {
+			return err
+		}
+
+		log.Ctx(ctx).Debug().Str("artifact", artifact).Msg("copy image artifact")
+
+		if _, err := copyImage(ctx, artifactSrcRef, srcCtx, artifactDestRef, destCtx, copyOptions{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cosignArtifacts returns the cosign tags present for the image digest
+func cosignArtifacts(repo reference.Named, imageDigest digest.Digest, nameOptions []name.Option, options []remote.Option) ([]string, error) {
+	var tags []string
+	for _, suffix := range cosignTagSuffixes {
+		tag := fmt.Sprintf("%s-%s%s", imageDigest.Algorithm(), imageDigest.Encoded(), suffix)
+
+		ref, err := name.NewTag(repo.Name()+":"+tag, nameOptions...)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := remote.Head(ref, options...); err != nil {
+			var transportErr *transport.Error
+			if errors.As(err, &transportErr) && transportErr.StatusCode == http.StatusNotFound {
+				continue
+			}
+			return nil, err
+		}
+
+		tags = append(tags, ":"+tag)
+	}
+
+	return tags, nil
+}
+
+// referrerArtifacts returns the digests of the manifests referring to the image digest, the referrers tag schema is
+// used for registries without support for the OCI referrers API
+func referrerArtifacts(repo reference.Named, imageDigest digest.Digest, nameOptions []name.Option, options []remote.Option) ([]string, error) {
+	ref, err := name.NewDigest(repo.Name()+"@"+imageDigest.String(), nameOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := remote.Referrers(ref, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	digests := make([]string, 0, len(indexManifest.Manifests))
+	for _, descriptor := range indexManifest.Manifests {
+		digests = append(digests, "@"+descriptor.Digest.String())
+	}
+
+	return digests, nil
+}
+
+// artifactReference returns the reference of an artifact in the repository, the artifact is either ":tag" or "@digest"
+func artifactReference(repo reference.Named, artifact string) (ctypes.ImageReference, error) {
+	ref, err := reference.ParseNormalizedNamed(repo.Name() + artifact)
+	if err != nil {
+		return nil, err
+	}
+	return docker.NewReference(ref)
+}
+
+// remoteOptions returns the options to access a repository with the settings of the system context,
+// insecure registries may be accessed via plain HTTP like containers/image does
+func remoteOptions(ctx context.Context, repo reference.Named, sysCtx *ctypes.SystemContext) ([]name.Option, []remote.Option, error) {
+	insecure := sysCtx.DockerInsecureSkipTLSVerify == ctypes.OptionalBoolTrue
+
+	var nameOptions []name.Option
+	if insecure {
+		nameOptions = append(nameOptions, name.Insecure)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecure, //nolint:gosec
+	}
+	if sysCtx.DockerCertPath != "" {
+		if err := tlsclientconfig.SetupCertificates(sysCtx.DockerCertPath, tlsConfig); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	httpTransport := remote.DefaultTransport.(*http.Transport).Clone()
+	httpTransport.TLSClientConfig = tlsConfig
+
+	var auth authn.Authenticator = authn.Anonymous
+	if sysCtx.DockerBearerRegistryToken != "" {
+		auth = &authn.Bearer{Token: sysCtx.DockerBearerRegistryToken}
+	} else {
+		creds, err := config.GetCredentials(sysCtx, reference.Domain(repo))
+		if err != nil {
+			return nil, nil, err
+		}
+		if creds.Username != "" || creds.IdentityToken != "" {
+			auth = authn.FromConfig(authn.AuthConfig{Username: creds.Username, Password: creds.Password, IdentityToken: creds.IdentityToken})
+		}
+	}
+
+	return nameOptions, []remote.Option{remote.WithContext(ctx), remote.WithAuth(auth), remote.WithTransport(httpTransport)}, nil
+}
@@ -0,0 +1,89 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/containers/image/v5/transports/alltransports"
+	ctypes "github.com/containers/image/v5/types"
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenericCopyImageArtifacts(t *testing.T) {
+	server := httptest.NewServer(withBasicAuth(ggcrregistry.New(ggcrregistry.WithReferrersSupport(true), ggcrregistry.Logger(log.New(io.Discard, "", 0))), "user", "pass"))
+	defer server.Close()
+
+	auth := remote.WithAuth(&authn.Basic{Username: "user", Password: "pass"})
+	repo, err := name.NewRepository(serverHost(server) + "/upstream/nginx")
+	require.NoError(t, err)
+
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(repo.Tag("latest"), img, auth))
+
+	imgDigest, err := img.Digest()
+	require.NoError(t, err)
+
+	// cosign signature attached via tag
+	signature, err := random.Image(128, 1)
+	require.NoError(t, err)
+	signatureTag := "sha256-" + imgDigest.Hex + ".sig"
+	require.NoError(t, remote.Write(repo.Tag(signatureTag), signature, auth))
+
+	// SBOM attached via the referrers API
+	sbom, err := random.Image(128, 1)
+	require.NoError(t, err)
+	sbomDigest, err := sbom.Digest()
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(repo.Digest(sbomDigest.String()), sbom, auth))
+
+	subject, err := partial.Descriptor(img)
+	require.NoError(t, err)
+	referrer := mutate.Subject(sbom, *subject)
+	referrerManifest, err := referrer.RawManifest()
+	require.NoError(t, err)
+	referrerDigest, _, err := v1.SHA256(bytes.NewReader(referrerManifest))
+	require.NoError(t, err)
+	require.NoError(t, remote.Put(repo.Digest(referrerDigest.String()), referrer, auth))
+
+	client, err := NewGenericClient(config.Generic{Repository: serverHost(server), Username: "user", Password: "pass", Insecure: true})
+	require.NoError(t, err)
+
+	srcRef, err := alltransports.ParseImageName("docker://" + repo.Name() + ":latest")
+	require.NoError(t, err)
+	destRef, err := alltransports.ParseImageName("docker://" + client.Endpoint() + "/mirror/nginx:latest")
+	require.NoError(t, err)
+
+	srcCtx := &ctypes.SystemContext{
+		DockerAuthConfig:            &ctypes.DockerAuthConfig{Username: "user", Password: "pass"},
+		DockerInsecureSkipTLSVerify: ctypes.OptionalBoolTrue,
+	}
+	require.NoError(t, client.copyImage(context.Background(), srcRef, srcCtx, destRef, client.Credentials(), WithArtifacts(true)))
+
+	destRepo, err := name.NewRepository(client.Endpoint() + "/mirror/nginx")
+	require.NoError(t, err)
+
+	_, err = remote.Head(destRepo.Tag(signatureTag), auth)
+	assert.NoError(t, err, "the cosign signature is copied")
+
+	referrers, err := remote.Referrers(destRepo.Digest(imgDigest.String()), auth)
+	require.NoError(t, err)
+	referrersManifest, err := referrers.IndexManifest()
+	require.NoError(t, err)
+	require.Len(t, referrersManifest.Manifests, 1)
+	assert.Equal(t, referrerDigest, referrersManifest.Manifests[0].Digest, "the SBOM is copied")
+}
@@ -0,0 +1,220 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/transports"
+	ctypes "github.com/containers/image/v5/types"
+	"github.com/dgraph-io/ristretto"
+	"github.com/go-co-op/gocron"
+	"github.com/opencontainers/go-digest"
+	"github.com/rs/zerolog/log"
+)
+
+// tokenSource is implemented by registries authenticating with short-lived tokens
+type tokenSource interface {
+	// requestAuthToken returns credentials in the form "username:password" with their expiration date
+	requestAuthToken() ([]byte, time.Time, error)
+}
+
+// baseClient implements the behavior shared by all registries: copying images, checking for existing images and
+// keeping credentials up-to-date. Providers embed it and only implement authentication and repository management.
+type baseClient struct {
+	domain string
+
+	// credentialsMu guards credentials which may be renewed in the background
+	credentialsMu sync.RWMutex
+	credentials   string
+
+	token    string
+	certDir  string
+	insecure bool
+
+	cache       *ristretto.Cache
+	scheduler   *gocron.Scheduler
+	tokenSource tokenSource
+}
+
+func newBaseClient(domain string) (*baseClient, error) {
+	cache, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters: 1e7,     // number of keys to track frequency of (10M).
+		MaxCost:     1 << 30, // maximum cost of cache (1GB).
+		BufferItems: 64,      // number of keys per Get buffer.
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &baseClient{
+		domain: domain,
+		cache:  cache,
+	}, nil
+}
+
+func (b *baseClient) RepositoryExists() bool {
+	panic("implement me")
+}
+
+// CopyImage copies an image using the source auth file and the destination credentials in the form "username:password"
+func (b *baseClient) CopyImage(ctx context.Context, srcRef ctypes.ImageReference, srcCreds string, destRef ctypes.ImageReference, destCreds string, opts ...CopyOption) error {
+	return b.copyImage(ctx, srcRef, sourceSystemContext(srcCreds), destRef, destCreds, opts...)
+}
+
+// copyImage copies an image and remembers the digest of the copied manifest
+func (b *baseClient) copyImage(ctx context.Context, srcRef ctypes.ImageReference, srcCtx *ctypes.SystemContext, destRef ctypes.ImageReference, destCreds string, opts ...CopyOption) error {
+	destCtx := b.systemContext()
+	if len(destCreds) > 0 && len(b.token) == 0 {
+		destCtx.DockerAuthConfig = credentialsSystemContext(destCreds).DockerAuthConfig
+	}
+
+	options := newCopyOptions(opts)
+	imageDigest, err := copyImage(ctx, srcRef, srcCtx, destRef, destCtx, options)
+	if err != nil {
+		return err
+	}
+
+	if options.artifacts {
+		// the artifacts are looked up for the copied source image
+		artifactsRef, err := pinnedReference(srcRef, options.sourceDigest)
+		if err != nil {
+			return err
+		}
+		if err := copyArtifacts(ctx, artifactsRef, srcCtx, destRef, destCtx, imageDigest); err != nil {
+			return &CopyError{Source: transports.ImageName(srcRef), Destination: transports.ImageName(destRef), Err: fmt.Errorf("copying signatures and attestations: %w", err)}
+		}
+	}
+
+	b.cacheImageDigest(destRef, imageDigest)
+
+	return nil
+}
+
+func (b *baseClient) PullImage() error {
+	panic("implement me")
+}
+
+func (b *baseClient) PutImage() error {
+	panic("implement me")
+}
+
+func (b *baseClient) ImageExists(ctx context.Context, imageRef ctypes.ImageReference) bool {
+	ref := imageRef.DockerReference().String()
+	if _, found := b.cache.Get(ref); found {
+		log.Ctx(ctx).Trace().Str("ref", ref).Msg("found in cache")
+		return true
+	}
+
+	if _, err := b.ImageDigest(ctx, imageRef); err != nil {
+		log.Ctx(ctx).Trace().Err(err).Str("ref", ref).Msg("not found in target repository")
+		return false
+	}
+
+	log.Ctx(ctx).Trace().Str("ref", ref).Msg("found in target repository")
+
+	return true
+}
+
+// ImageDigest returns the manifest digest of an image, digests of existing images are cached
+func (b *baseClient) ImageDigest(ctx context.Context, imageRef ctypes.ImageReference) (digest.Digest, error) {
+	if value, found := b.cache.Get(imageRef.DockerReference().String()); found {
+		if imageDigest, ok := value.(digest.Digest); ok {
+			return imageDigest, nil
+		}
+	}
+
+	imageDigest, err := imageDigest(ctx, imageRef, b.systemContext())
+	if err != nil {
+		return "", err
+	}
+
+	b.cacheImageDigest(imageRef, imageDigest)
+
+	return imageDigest, nil
+}
+
+// cacheImageDigest remembers an image to exist in the registry with the given digest
+func (b *baseClient) cacheImageDigest(imageRef ctypes.ImageReference, imageDigest digest.Digest) {
+	b.cache.SetWithTTL(imageRef.DockerReference().String(), imageDigest, 1, 24*time.Hour+time.Duration(rand.Intn(180))*time.Minute)
+}
+
+func (b *baseClient) Endpoint() string {
+	return b.domain
+}
+
+// IsOrigin returns true if the references origin is from this registry
+func (b *baseClient) IsOrigin(imageRef ctypes.ImageReference) bool {
+	return strings.HasPrefix(imageRef.DockerReference().String(), b.Endpoint()+"/")
+}
+
+// Credentials returns the credentials in the form "username:password", bearer tokens are not exposed
+func (b *baseClient) Credentials() string {
+	b.credentialsMu.RLock()
+	defer b.credentialsMu.RUnlock()
+
+	return b.credentials
+}
+
+// setCredentials replaces the credentials, e.g. after a token renewal
+func (b *baseClient) setCredentials(credentials string) {
+	b.credentialsMu.Lock()
+	defer b.credentialsMu.Unlock()
+
+	b.credentials = credentials
+}
+
+// systemContext returns the settings used to connect to the registry
+func (b *baseClient) systemContext() *ctypes.SystemContext {
+	sysCtx := credentialsSystemContext(b.Credentials())
+	sysCtx.DockerCertPath = b.certDir
+
+	if b.insecure {
+		sysCtx.DockerInsecureSkipTLSVerify = ctypes.OptionalBoolTrue
+	}
+
+	if b.token != "" {
+		sysCtx.DockerAuthConfig = nil
+		sysCtx.DockerBearerRegistryToken = b.token
+	}
+
+	return sysCtx
+}
+
+// Close stops the token renewal
+func (b *baseClient) Close() error {
+	if b.scheduler != nil {
+		b.scheduler.Stop()
+	}
+	return nil
+}
+
+// startTokenRenewal requests the initial credentials from the token source and keeps renewing them before they expire
+func (b *baseClient) startTokenRenewal(source tokenSource) error {
+	b.tokenSource = source
+	b.scheduler = gocron.NewScheduler(time.UTC)
+	b.scheduler.StartAsync()
+
+	return b.scheduleTokenRenewal()
+}
+
+// scheduleTokenRenewal sets a scheduler to execute token renewal before the token expires
+func (b *baseClient) scheduleTokenRenewal() error {
+	token, expiryAt, err := b.tokenSource.requestAuthToken()
+	if err != nil {
+		return err
+	}
+
+	renewalAt := expiryAt.Add(-2 * time.Minute)
+	b.setCredentials(string(token))
+
+	log.Debug().Time("expiryAt", expiryAt).Time("renewalAt", renewalAt).Msg("auth token set, schedule next token renewal")
+
+	j, _ := b.scheduler.Every(1).StartAt(renewalAt).Do(b.scheduleTokenRenewal)
+	j.LimitRunsTo(1)
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package registry
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	ctypes "github.com/containers/image/v5/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeTokenSource struct {
+	token    string
+	expiryAt time.Time
+	err      error
+	calls    int
+}
+
+func (f *fakeTokenSource) requestAuthToken() ([]byte, time.Time, error) {
+	f.calls++
+	return []byte(f.token), f.expiryAt, f.err
+}
+
+func TestBaseClientTokenRenewal(t *testing.T) {
+	client, err := newBaseClient("registry.example.com")
+	require.NoError(t, err)
+
+	source := &fakeTokenSource{token: "user:token", expiryAt: time.Now().Add(time.Hour)}
+	require.NoError(t, client.startTokenRenewal(source))
+	t.Cleanup(client.scheduler.Stop)
+
+	assert.Equal(t, 1, source.calls)
+	assert.Equal(t, "user:token", client.Credentials())
+
+	_, nextRun := client.scheduler.NextRun()
+	assert.WithinDuration(t, time.Now().Add(time.Hour-2*time.Minute), nextRun, 5*time.Second)
+
+	require.NoError(t, client.Close())
+	assert.False(t, client.scheduler.IsRunning(), "token renewal stops on close")
+}
+
+func TestBaseClientTokenRenewalError(t *testing.T) {
+	client, err := newBaseClient("registry.example.com")
+	require.NoError(t, err)
+
+	require.Error(t, client.startTokenRenewal(&fakeTokenSource{err: errors.New("denied")}))
+	t.Cleanup(client.scheduler.Stop)
+
+	assert.Equal(t, "", client.Credentials())
+}
+
+func TestBaseClientCloseWithoutTokenRenewal(t *testing.T) {
+	client, err := newBaseClient("registry.example.com")
+	require.NoError(t, err)
+
+	assert.NoError(t, client.Close())
+}
+
+func TestBaseClientSystemContext(t *testing.T) {
+	client := &baseClient{domain: "registry.example.com", credentials: "user:pass", certDir: "/certs", insecure: true}
+
+	sysCtx := client.systemContext()
+	assert.Equal(t, &ctypes.DockerAuthConfig{Username: "user", Password: "pass"}, sysCtx.DockerAuthConfig)
+	assert.Equal(t, "/certs", sysCtx.DockerCertPath)
+	assert.Equal(t, ctypes.OptionalBoolTrue, sysCtx.DockerInsecureSkipTLSVerify)
+
+	client.token = "token"
+	sysCtx = client.systemContext()
+	assert.Nil(t, sysCtx.DockerAuthConfig)
+	assert.Equal(t, "token", sysCtx.DockerBearerRegistryToken)
+}
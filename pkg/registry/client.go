@@ -10,23 +10,30 @@ import (
 	"github.com/estahn/k8s-image-swapper/pkg/types"
 
 	ctypes "github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
 )
 
 // Client provides methods required to be implemented by the various target registry clients, e.g. ECR, Docker, Quay.
 type Client interface {
 	CreateRepository(ctx context.Context, name string) error
 	RepositoryExists() bool
-	CopyImage(ctx context.Context, src ctypes.ImageReference, srcCreds string, dest ctypes.ImageReference, destCreds string) error
+	CopyImage(ctx context.Context, src ctypes.ImageReference, srcCreds string, dest ctypes.ImageReference, destCreds string, opts ...CopyOption) error
 	PullImage() error
 	PutImage() error
 	ImageExists(ctx context.Context, ref ctypes.ImageReference) bool
 
+	// ImageDigest returns the manifest digest of an image in the registry
+	ImageDigest(ctx context.Context, ref ctypes.ImageReference) (digest.Digest, error)
+
 	// Endpoint returns the domain of the registry
 	Endpoint() string
 	Credentials() string
 
 	// IsOrigin returns true if the imageRef originates from this registry
 	IsOrigin(imageRef ctypes.ImageReference) bool
+
+	// Close stops background tasks, e.g. the renewal of auth tokens
+	Close() error
 }
 
 type DockerConfig struct {
@@ -53,6 +60,12 @@ func NewClient(r config.Registry) (Client, error) {
 		return NewECRClient(r.AWS)
 	case types.RegistryGCP:
 		return NewGARClient(r.GCP)
+	case types.RegistryAzure:
+		return NewACRClient(r.Azure)
+	case types.RegistryGeneric:
+		return NewGenericClient(r.Generic)
+	case types.RegistryHarbor:
+		return NewHarborClient(r.Harbor)
 	default:
 		return nil, fmt.Errorf(`registry of type "%s" is not supported`, r.Type)
 	}
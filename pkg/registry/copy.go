@@ -0,0 +1,199 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/transports"
+	ctypes "github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// copyRetryTimes is the number of retries for transient errors, matching the former skopeo "--retry-times 3"
+	copyRetryTimes = 3
+	// copyRetryDelay is the initial delay between retries, doubled after every attempt
+	copyRetryDelay = time.Second
+	// copyProgressInterval defines how often the copy progress is reported
+	copyProgressInterval = 5 * time.Second
+)
+
+// CopyError is returned if an image could not be copied from the source to the destination
+type CopyError struct {
+	Source      string
+	Destination string
+	Err         error
+}
+
+func (e *CopyError) Error() string {
+	return fmt.Sprintf("copying image %s to %s: %s", e.Source, e.Destination, e.Err.Error())
+}
+
+func (e *CopyError) Unwrap() error {
+	return e.Err
+}
+
+// sourceSystemContext returns the settings to read from a source registry using the given docker auth file
+func sourceSystemContext(authFile string) *ctypes.SystemContext {
+	sysCtx := &ctypes.SystemContext{OSChoice: "linux"}
+	if len(authFile) > 0 {
+		sysCtx.AuthFilePath = authFile
+	} else {
+		sysCtx.DockerAuthConfig = &ctypes.DockerAuthConfig{}
+	}
+	return sysCtx
+}
+
+// credentialsSystemContext returns the settings to connect to a registry using credentials in the form "username:password"
+func credentialsSystemContext(creds string) *ctypes.SystemContext {
+	username, password, _ := strings.Cut(creds, ":")
+	return &ctypes.SystemContext{
+		DockerAuthConfig: &ctypes.DockerAuthConfig{Username: username, Password: password},
+	}
+}
+
+// copyImage copies an image in-process, retries transient errors and returns the digest of the copied manifest.
+// All platforms are copied unless selected via the options.
+func copyImage(ctx context.Context, srcRef ctypes.ImageReference, srcCtx *ctypes.SystemContext, destRef ctypes.ImageReference, destCtx *ctypes.SystemContext, options copyOptions) (digest.Digest, error) {
+	policyContext, err := signature.NewPolicyContext(&signature.Policy{
+		Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = policyContext.Destroy()
+	}()
+
+	src := transports.ImageName(srcRef)
+	dest := transports.ImageName(destRef)
+
+	srcRef, selection, err := platformSource(ctx, srcRef, srcCtx, options)
+	if err != nil {
+		return "", &CopyError{Source: src, Destination: dest, Err: err}
+	}
+
+	log.Ctx(ctx).
+		Trace().
+		Str("src", src).
+		Str("dest", dest).
+		Msg("copy image")
+
+	progress := make(chan ctypes.ProgressProperties)
+	progressDone := make(chan struct{})
+	go func() {
+		defer close(progressDone)
+		logCopyProgress(ctx, progress)
+	}()
+	defer func() {
+		close(progress)
+		<-progressDone
+	}()
+
+	delay := copyRetryDelay
+	for attempt := 0; ; attempt++ {
+		copiedManifest, err := copy.Image(ctx, policyContext, destRef, srcRef, &copy.Options{
+			SourceCtx:          srcCtx,
+			DestinationCtx:     destCtx,
+			ImageListSelection: selection,
+			Progress:           progress,
+			ProgressInterval:   copyProgressInterval,
+		})
+
+		// check if the copy timed out during execution for proper logging
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return "", ctxErr
+		}
+
+		if err == nil {
+			return manifest.Digest(copiedManifest)
+		}
+
+		if attempt >= copyRetryTimes || !isRetryable(err) {
+			return "", &CopyError{Source: src, Destination: dest, Err: err}
+		}
+
+		log.Ctx(ctx).Debug().Err(err).Int("attempt", attempt+1).Dur("delay", delay).Msg("retrying image copy")
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// logCopyProgress logs the progress reported by containers/image until the channel is closed
+func logCopyProgress(ctx context.Context, progress <-chan ctypes.ProgressProperties) {
+	for p := range progress {
+		event := log.Ctx(ctx).Trace().
+			Str("artifact", p.Artifact.Digest.String()).
+			Int64("size", p.Artifact.Size).
+			Uint64("offset", p.Offset)
+
+		switch p.Event {
+		case ctypes.ProgressEventNewArtifact:
+			event.Msg("copy artifact started")
+		case ctypes.ProgressEventRead:
+			event.Msg("copy artifact in progress")
+		case ctypes.ProgressEventDone:
+			event.Msg("copy artifact done")
+		case ctypes.ProgressEventSkipped:
+			event.Msg("copy artifact skipped, already present")
+		default:
+			event.Discard().Send()
+		}
+	}
+}
+
+// imageDigest returns the manifest digest of an image in a registry
+func imageDigest(ctx context.Context, ref ctypes.ImageReference, sysCtx *ctypes.SystemContext) (digest.Digest, error) {
+	return docker.GetDigest(ctx, sysCtx, ref)
+}
+
+// pinnedReference returns the docker reference of the image by digest,
+// the reference is returned as is if the digest is empty or it is not a docker reference
+func pinnedReference(ref ctypes.ImageReference, imageDigest digest.Digest) (ctypes.ImageReference, error) {
+	if imageDigest == "" || ref.DockerReference() == nil {
+		return ref, nil
+	}
+
+	named, err := reference.WithDigest(reference.TrimNamed(ref.DockerReference()), imageDigest)
+	if err != nil {
+		return nil, err
+	}
+	return docker.NewReference(named)
+}
+
+// isRetryable returns true for errors which are likely to be resolved by trying again
+func isRetryable(err error) bool {
+	if errors.Is(err, docker.ErrTooManyRequests) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+
+	var statusErr docker.UnexpectedHTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= http.StatusInternalServerError
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Timeout()
+	}
+
+	return false
+}
@@ -0,0 +1,95 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/transports/alltransports"
+	ctypes "github.com/containers/image/v5/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "too many requests", err: fmt.Errorf("reading manifest: %w", docker.ErrTooManyRequests), want: true},
+		{name: "server error", err: docker.UnexpectedHTTPStatusError{StatusCode: http.StatusBadGateway}, want: true},
+		{name: "client error", err: docker.UnexpectedHTTPStatusError{StatusCode: http.StatusNotFound}, want: false},
+		{name: "unexpected eof", err: fmt.Errorf("reading blob: %w", io.ErrUnexpectedEOF), want: true},
+		{name: "unauthorized", err: docker.ErrUnauthorizedForCredentials{Err: errors.New("denied")}, want: false},
+		{name: "other", err: errors.New("manifest unknown"), want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, isRetryable(test.err))
+		})
+	}
+}
+
+func TestCredentialsSystemContext(t *testing.T) {
+	sysCtx := credentialsSystemContext("AWS:secret:with:colons")
+	assert.Equal(t, "AWS", sysCtx.DockerAuthConfig.Username)
+	assert.Equal(t, "secret:with:colons", sysCtx.DockerAuthConfig.Password)
+
+	sysCtx = credentialsSystemContext("")
+	assert.Equal(t, "", sysCtx.DockerAuthConfig.Username)
+	assert.Equal(t, "", sysCtx.DockerAuthConfig.Password)
+}
+
+func TestCopyImageError(t *testing.T) {
+	registry := newTestRegistry()
+	server := httptest.NewServer(withBasicAuth(registry, "user", "pass"))
+	defer server.Close()
+	pushTestImage(t, registry, "library/nginx:latest")
+
+	srcRef, err := alltransports.ParseImageName("docker://" + serverHost(server) + "/library/nginx:latest")
+	require.NoError(t, err)
+	destRef, err := alltransports.ParseImageName("docker://" + serverHost(server) + "/mirror/nginx:latest")
+	require.NoError(t, err)
+
+	srcCtx := credentialsSystemContext("user:wrong")
+	srcCtx.DockerInsecureSkipTLSVerify = ctypes.OptionalBoolTrue
+	destCtx := credentialsSystemContext("user:pass")
+
+	_, err = copyImage(context.Background(), srcRef, srcCtx, destRef, destCtx, copyOptions{})
+
+	var copyErr *CopyError
+	require.ErrorAs(t, err, &copyErr)
+	assert.Equal(t, "docker://"+serverHost(server)+"/library/nginx:latest", copyErr.Source)
+	assert.Equal(t, "docker://"+serverHost(server)+"/mirror/nginx:latest", copyErr.Destination)
+	assert.False(t, isRetryable(copyErr.Err), "authentication errors are not retried")
+}
+
+func TestCopyImageSourceDigest(t *testing.T) {
+	registry := newTestRegistry()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	pushTestImage(t, registry, "library/nginx:latest")
+
+	srcRef, err := alltransports.ParseImageName("docker://" + serverHost(server) + "/library/nginx:latest")
+	require.NoError(t, err)
+	destRef, err := alltransports.ParseImageName("docker://" + serverHost(server) + "/mirror/nginx:latest")
+	require.NoError(t, err)
+
+	sysCtx := &ctypes.SystemContext{DockerInsecureSkipTLSVerify: ctypes.OptionalBoolTrue}
+	verifiedDigest, err := imageDigest(context.Background(), srcRef, sysCtx)
+	require.NoError(t, err)
+
+	// the tag is moved after the digest was resolved
+	pushTestImage(t, registry, "library/nginx:latest")
+
+	copiedDigest, err := copyImage(context.Background(), srcRef, sysCtx, destRef, sysCtx, copyOptions{sourceDigest: verifiedDigest})
+	require.NoError(t, err)
+	assert.Equal(t, verifiedDigest, copiedDigest, "the image is copied by the given digest")
+}
@@ -3,33 +3,27 @@ package registry
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"math/rand"
 	"net/http"
-	"os/exec"
 	"time"
 
-	"github.com/containers/image/v5/docker/reference"
-
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/containers/image/v5/docker/reference"
 	ctypes "github.com/containers/image/v5/types"
-	"github.com/dgraph-io/ristretto"
 	"github.com/estahn/k8s-image-swapper/pkg/config"
-	"github.com/go-co-op/gocron"
 	"github.com/rs/zerolog/log"
 )
 
 type ECRClient struct {
+	*baseClient
+
 	client        ecriface.ECRAPI
-	ecrDomain     string
-	authToken     []byte
-	cache         *ristretto.Cache
-	scheduler     *gocron.Scheduler
 	targetAccount string
 	options       config.ECROptions
 }
@@ -65,38 +59,25 @@ func NewECRClient(clientConfig config.AWS) (*ECRClient, error) {
 	}))
 	ecrClient := ecr.New(sess, cfg)
 
-	cache, err := ristretto.NewCache(&ristretto.Config{
-		NumCounters: 1e7,     // number of keys to track frequency of (10M).
-		MaxCost:     1 << 30, // maximum cost of cache (1GB).
-		BufferItems: 64,      // number of keys per Get buffer.
-	})
+	base, err := newBaseClient(ecrDomain)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	scheduler := gocron.NewScheduler(time.UTC)
-	scheduler.StartAsync()
-
 	client := &ECRClient{
+		baseClient:    base,
 		client:        ecrClient,
-		ecrDomain:     ecrDomain,
-		cache:         cache,
-		scheduler:     scheduler,
 		targetAccount: clientConfig.AccountID,
 		options:       clientConfig.ECROptions,
 	}
 
-	if err := client.scheduleTokenRenewal(); err != nil {
+	if err := client.startTokenRenewal(client); err != nil {
 		return nil, err
 	}
 
 	return client, nil
 }
 
-func (e *ECRClient) Credentials() string {
-	return string(e.authToken)
-}
-
 func (e *ECRClient) CreateRepository(ctx context.Context, name string) error {
 	if _, found := e.cache.Get(name); found {
 		return nil
@@ -171,111 +152,71 @@ func (e *ECRClient) CreateRepository(ctx context.Context, name string) error {
 	return nil
 }
 
-func (e *ECRClient) buildEcrTags() []*ecr.Tag {
-	ecrTags := []*ecr.Tag{}
-
-	for _, t := range e.options.Tags {
-		tag := ecr.Tag{Key: aws.String(t.Key), Value: aws.String(t.Value)}
-		ecrTags = append(ecrTags, &tag)
-	}
-
-	return ecrTags
-}
+// ImageVulnerabilities returns the findings of the basic or enhanced scan of an image
+func (e *ECRClient) ImageVulnerabilities(ctx context.Context, ref ctypes.ImageReference) ([]Vulnerability, error) {
+	return e.cachedVulnerabilities(ref, func() ([]Vulnerability, error) {
+		named := ref.DockerReference()
 
-func (e *ECRClient) RepositoryExists() bool {
-	panic("implement me")
-}
-
-func (e *ECRClient) CopyImage(ctx context.Context, srcRef ctypes.ImageReference, srcCreds string, destRef ctypes.ImageReference, destCreds string) error {
-	src := srcRef.DockerReference().String()
-	dest := destRef.DockerReference().String()
-	app := "skopeo"
-	args := []string{
-		"--override-os", "linux",
-		"copy",
-		"--multi-arch", "all",
-		"--retry-times", "3",
-		"docker://" + src,
-		"docker://" + dest,
-	}
-
-	if len(srcCreds) > 0 {
-		args = append(args, "--src-authfile", srcCreds)
-	} else {
-		args = append(args, "--src-no-creds")
-	}
-
-	if len(destCreds) > 0 {
-		args = append(args, "--dest-creds", destCreds)
-	} else {
-		args = append(args, "--dest-no-creds")
-	}
-
-	log.Ctx(ctx).
-		Trace().
-		Str("app", app).
-		Strs("args", args).
-		Msg("execute command to copy image")
-
-	output, cmdErr := exec.CommandContext(ctx, app, args...).CombinedOutput()
+		imageID := &ecr.ImageIdentifier{}
+		if canonical, ok := named.(reference.Canonical); ok {
+			imageID.ImageDigest = aws.String(canonical.Digest().String())
+		} else if tagged, ok := named.(reference.Tagged); ok {
+			imageID.ImageTag = aws.String(tagged.Tag())
+		}
 
-	// check if the command timed out during execution for proper logging
-	if err := ctx.Err(); err != nil {
-		return err
-	}
+		var vulnerabilities []Vulnerability
+		scanComplete := true
+		err := e.client.DescribeImageScanFindingsPagesWithContext(ctx, &ecr.DescribeImageScanFindingsInput{
+			RegistryId:     &e.targetAccount,
+			RepositoryName: aws.String(reference.Path(named)),
+			ImageId:        imageID,
+		}, func(output *ecr.DescribeImageScanFindingsOutput, lastPage bool) bool {
+			if output.ImageScanStatus == nil || aws.StringValue(output.ImageScanStatus.Status) != ecr.ScanStatusComplete {
+				scanComplete = false
+				return false
+			}
 
-	// enrich error with output from the command which may contain the actual reason
-	if cmdErr != nil {
-		return fmt.Errorf("command error, stderr: %s, stdout: %s", cmdErr.Error(), string(output))
-	}
+			if output.ImageScanFindings == nil {
+				return true
+			}
+			for _, finding := range output.ImageScanFindings.Findings {
+				vulnerabilities = append(vulnerabilities, Vulnerability{ID: aws.StringValue(finding.Name), Severity: aws.StringValue(finding.Severity)})
+			}
+			for _, finding := range output.ImageScanFindings.EnhancedFindings {
+				vulnerability := Vulnerability{Severity: aws.StringValue(finding.Severity)}
+				if finding.PackageVulnerabilityDetails != nil {
+					vulnerability.ID = aws.StringValue(finding.PackageVulnerabilityDetails.VulnerabilityId)
+				}
+				vulnerabilities = append(vulnerabilities, vulnerability)
+			}
+			return true
+		})
 
-	return nil
-}
+		if err != nil {
+			var aerr awserr.Error
+			if errors.As(err, &aerr) && (aerr.Code() == ecr.ErrCodeScanNotFoundException || aerr.Code() == ecr.ErrCodeImageNotFoundException) {
+				return nil, ErrScanNotAvailable
+			}
+			return nil, err
+		}
 
-func (e *ECRClient) PullImage() error {
-	panic("implement me")
-}
+		if !scanComplete {
+			return nil, ErrScanNotAvailable
+		}
 
-func (e *ECRClient) PutImage() error {
-	panic("implement me")
+		return vulnerabilities, nil
+	})
 }
 
-func (e *ECRClient) ImageExists(ctx context.Context, imageRef ctypes.ImageReference) bool {
-	ref := imageRef.DockerReference().String()
-	if _, found := e.cache.Get(ref); found {
-		log.Ctx(ctx).Trace().Str("ref", ref).Msg("found in cache")
-		return true
-	}
-
-	app := "skopeo"
-	args := []string{
-		"inspect",
-		"--retry-times", "3",
-		"docker://" + ref,
-		"--creds", e.Credentials(),
-	}
+func (e *ECRClient) buildEcrTags() []*ecr.Tag {
+	ecrTags := []*ecr.Tag{}
 
-	log.Ctx(ctx).Trace().Str("app", app).Strs("args", args).Msg("executing command to inspect image")
-	if err := exec.CommandContext(ctx, app, args...).Run(); err != nil {
-		log.Ctx(ctx).Trace().Str("ref", ref).Msg("not found in target repository")
-		return false
+	for _, t := range e.options.Tags {
+		tag := ecr.Tag{Key: aws.String(t.Key), Value: aws.String(t.Value)}
+		ecrTags = append(ecrTags, &tag)
 	}
 
-	log.Ctx(ctx).Trace().Str("ref", ref).Msg("found in target repository")
-
-	e.cache.SetWithTTL(ref, "", 1, 24*time.Hour+time.Duration(rand.Intn(180))*time.Minute)
-
-	return true
-}
-
-func (e *ECRClient) Endpoint() string {
-	return e.ecrDomain
-}
-
-// IsOrigin returns true if the references origin is from this registry
-func (e *ECRClient) IsOrigin(imageRef ctypes.ImageReference) bool {
-	domain := reference.Domain(imageRef.DockerReference())
-	return domain == e.Endpoint()
+	return ecrTags
 }
 
 // requestAuthToken requests and returns an authentication token from ECR with its expiration date
@@ -296,42 +237,26 @@ func (e *ECRClient) requestAuthToken() ([]byte, time.Time, error) {
 	return authToken, *getAuthTokenOutput.AuthorizationData[0].ExpiresAt, nil
 }
 
-// scheduleTokenRenewal sets a scheduler to execute token renewal before the token expires
-func (e *ECRClient) scheduleTokenRenewal() error {
-	token, expiryAt, err := e.requestAuthToken()
-	if err != nil {
-		return err
-	}
-
-	renewalAt := expiryAt.Add(-2 * time.Minute)
-	e.authToken = token
-
-	log.Debug().Time("expiryAt", expiryAt).Time("renewalAt", renewalAt).Msg("auth token set, schedule next token renewal")
-
-	j, _ := e.scheduler.Every(1).StartAt(renewalAt).Do(e.scheduleTokenRenewal)
-	j.LimitRunsTo(1)
-
-	return nil
-}
-
 // For testing purposes
 func NewDummyECRClient(region string, targetAccount string, role string, options config.ECROptions, authToken []byte) *ECRClient {
 	return &ECRClient{
+		baseClient: &baseClient{
+			domain:      fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com", targetAccount, region),
+			credentials: string(authToken),
+		},
 		targetAccount: targetAccount,
 		options:       options,
-		ecrDomain:     fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com", targetAccount, region),
-		authToken:     authToken,
 	}
 }
 
 func NewMockECRClient(ecrClient ecriface.ECRAPI, region string, ecrDomain string, targetAccount, role string) (*ECRClient, error) {
 	client := &ECRClient{
+		baseClient: &baseClient{
+			domain:      ecrDomain,
+			credentials: "mock-ecr-client-fake-auth-token",
+		},
 		client:        ecrClient,
-		ecrDomain:     ecrDomain,
-		cache:         nil,
-		scheduler:     nil,
 		targetAccount: targetAccount,
-		authToken:     []byte("mock-ecr-client-fake-auth-token"),
 		options: config.ECROptions{
 			ImageTagMutability:         "MUTABLE",
 			ImageScanningConfiguration: config.ImageScanningConfiguration{ImageScanOnPush: true},
@@ -1,9 +1,15 @@
 package registry
 
 import (
+	"context"
 	"encoding/base64"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
 	"github.com/containers/image/v5/transports/alltransports"
 
 	"github.com/estahn/k8s-image-swapper/pkg/config"
@@ -51,3 +57,70 @@ func TestECRIsOrigin(t *testing.T) {
 		assert.Equal(t, testcase.expected, result)
 	}
 }
+
+type scanFindingsECRClient struct {
+	ecriface.ECRAPI
+
+	input  *ecr.DescribeImageScanFindingsInput
+	output *ecr.DescribeImageScanFindingsOutput
+	err    error
+}
+
+func (m *scanFindingsECRClient) DescribeImageScanFindingsPagesWithContext(ctx aws.Context, input *ecr.DescribeImageScanFindingsInput, fn func(*ecr.DescribeImageScanFindingsOutput, bool) bool, opts ...request.Option) error {
+	m.input = input
+	if m.err != nil {
+		return m.err
+	}
+	fn(m.output, true)
+	return nil
+}
+
+func TestECRImageVulnerabilities(t *testing.T) {
+	imageRef, err := alltransports.ParseImageName("docker://12345678912.dkr.ecr.us-east-1.amazonaws.com/docker.io/library/nginx:latest")
+	assert.NoError(t, err)
+
+	t.Run("complete", func(t *testing.T) {
+		ecrClient := &scanFindingsECRClient{output: &ecr.DescribeImageScanFindingsOutput{
+			ImageScanStatus: &ecr.ImageScanStatus{Status: aws.String(ecr.ScanStatusComplete)},
+			ImageScanFindings: &ecr.ImageScanFindings{
+				Findings: []*ecr.ImageScanFinding{
+					{Name: aws.String("CVE-2023-4863"), Severity: aws.String(ecr.FindingSeverityCritical)},
+				},
+				EnhancedFindings: []*ecr.EnhancedImageScanFinding{
+					{PackageVulnerabilityDetails: &ecr.PackageVulnerabilityDetails{VulnerabilityId: aws.String("CVE-2023-38545")}, Severity: aws.String(ecr.FindingSeverityHigh)},
+				},
+			},
+		}}
+		fakeRegistry, _ := NewMockECRClient(ecrClient, "us-east-1", "12345678912.dkr.ecr.us-east-1.amazonaws.com", "12345678912", "")
+
+		vulnerabilities, err := fakeRegistry.ImageVulnerabilities(context.Background(), imageRef)
+
+		assert.NoError(t, err)
+		assert.Equal(t, []Vulnerability{
+			{ID: "CVE-2023-4863", Severity: "CRITICAL"},
+			{ID: "CVE-2023-38545", Severity: "HIGH"},
+		}, vulnerabilities)
+		assert.Equal(t, "docker.io/library/nginx", aws.StringValue(ecrClient.input.RepositoryName))
+		assert.Equal(t, "latest", aws.StringValue(ecrClient.input.ImageId.ImageTag))
+	})
+
+	t.Run("in progress", func(t *testing.T) {
+		ecrClient := &scanFindingsECRClient{output: &ecr.DescribeImageScanFindingsOutput{
+			ImageScanStatus: &ecr.ImageScanStatus{Status: aws.String(ecr.ScanStatusInProgress)},
+		}}
+		fakeRegistry, _ := NewMockECRClient(ecrClient, "us-east-1", "12345678912.dkr.ecr.us-east-1.amazonaws.com", "12345678912", "")
+
+		_, err := fakeRegistry.ImageVulnerabilities(context.Background(), imageRef)
+
+		assert.ErrorIs(t, err, ErrScanNotAvailable)
+	})
+
+	t.Run("not scanned", func(t *testing.T) {
+		ecrClient := &scanFindingsECRClient{err: awserr.New(ecr.ErrCodeScanNotFoundException, "scan not found", nil)}
+		fakeRegistry, _ := NewMockECRClient(ecrClient, "us-east-1", "12345678912.dkr.ecr.us-east-1.amazonaws.com", "12345678912", "")
+
+		_, err := fakeRegistry.ImageVulnerabilities(context.Background(), imageRef)
+
+		assert.ErrorIs(t, err, ErrScanNotAvailable)
+	})
+}
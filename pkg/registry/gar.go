@@ -5,17 +5,16 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"math/rand"
-	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
 	artifactregistry "cloud.google.com/go/artifactregistry/apiv1"
 	"github.com/containers/image/v5/docker/reference"
 	ctypes "github.com/containers/image/v5/types"
-	"github.com/dgraph-io/ristretto"
 	"github.com/estahn/k8s-image-swapper/pkg/config"
-	"github.com/go-co-op/gocron"
+	"github.com/opencontainers/go-digest"
+	containeranalysis "google.golang.org/api/containeranalysis/v1"
 	"google.golang.org/api/option"
 	"google.golang.org/api/transport"
 
@@ -25,34 +24,31 @@ import (
 type GARAPI interface{}
 
 type GARClient struct {
-	client    GARAPI
-	garDomain string
-	cache     *ristretto.Cache
-	scheduler *gocron.Scheduler
-	authToken []byte
+	*baseClient
+
+	client  GARAPI
+	project string
+
+	// analysisOptions configure the Container Analysis client providing the scan findings
+	analysisOptions []option.ClientOption
+	// analysis is the Container Analysis client, created on first use
+	analysis   *containeranalysis.Service
+	analysisMu sync.Mutex
 }
 
 func NewGARClient(clientConfig config.GCP) (*GARClient, error) {
-	cache, err := ristretto.NewCache(&ristretto.Config{
-		NumCounters: 1e7,     // number of keys to track frequency of (10M).
-		MaxCost:     1 << 30, // maximum cost of cache (1GB).
-		BufferItems: 64,      // number of keys per Get buffer.
-	})
+	base, err := newBaseClient(clientConfig.GarDomain())
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	scheduler := gocron.NewScheduler(time.UTC)
-	scheduler.StartAsync()
-
 	client := &GARClient{
-		client:    nil,
-		garDomain: clientConfig.GarDomain(),
-		cache:     cache,
-		scheduler: scheduler,
+		baseClient: base,
+		client:     nil,
+		project:    clientConfig.ProjectID,
 	}
 
-	if err := client.scheduleTokenRenewal(); err != nil {
+	if err := client.startTokenRenewal(client); err != nil {
 		return nil, err
 	}
 
@@ -64,107 +60,95 @@ func (e *GARClient) CreateRepository(ctx context.Context, name string) error {
 	return nil
 }
 
-func (e *GARClient) RepositoryExists() bool {
-	panic("implement me")
-}
-
-func (e *GARClient) CopyImage(ctx context.Context, srcRef ctypes.ImageReference, srcCreds string, destRef ctypes.ImageReference, destCreds string) error {
-	src := srcRef.DockerReference().String()
-	dest := destRef.DockerReference().String()
-
-	creds := []string{"--src-authfile", srcCreds}
+func (e *GARClient) CopyImage(ctx context.Context, srcRef ctypes.ImageReference, srcCreds string, destRef ctypes.ImageReference, destCreds string, opts ...CopyOption) error {
+	srcCtx := sourceSystemContext(srcCreds)
 
 	// use client credentials for any source GAR repositories
 	if strings.HasSuffix(reference.Domain(srcRef.DockerReference()), "-docker.pkg.dev") {
-		creds = []string{"--src-creds", e.Credentials()}
-	}
-
-	app := "skopeo"
-	args := []string{
-		"--override-os", "linux",
-		"copy",
-		"--multi-arch", "all",
-		"--retry-times", "3",
-		"docker://" + src,
-		"docker://" + dest,
-	}
-
-	if len(creds[1]) > 0 {
-		args = append(args, creds...)
-	} else {
-		args = append(args, "--src-no-creds")
-	}
-
-	if len(destCreds) > 0 {
-		args = append(args, "--dest-creds", destCreds)
-	} else {
-		args = append(args, "--dest-no-creds")
+		srcCtx = credentialsSystemContext(e.Credentials())
+		srcCtx.OSChoice = "linux"
 	}
 
-	log.Ctx(ctx).
-		Trace().
-		Str("app", app).
-		Strs("args", args).
-		Msg("execute command to copy image")
-
-	output, cmdErr := exec.CommandContext(ctx, app, args...).CombinedOutput()
-
-	// check if the command timed out during execution for proper logging
-	if err := ctx.Err(); err != nil {
-		return err
-	}
-
-	// enrich error with output from the command which may contain the actual reason
-	if cmdErr != nil {
-		return fmt.Errorf("command error, stderr: %s, stdout: %s", cmdErr.Error(), string(output))
-	}
-
-	return nil
+	return e.copyImage(ctx, srcRef, srcCtx, destRef, destCreds, opts...)
 }
 
-func (e *GARClient) PullImage() error {
-	panic("implement me")
+// ImageVulnerabilities returns the vulnerability occurrences of an image reported by Container Analysis
+func (e *GARClient) ImageVulnerabilities(ctx context.Context, ref ctypes.ImageReference) ([]Vulnerability, error) {
+	return e.cachedVulnerabilities(ref, func() ([]Vulnerability, error) {
+		var imageDigest digest.Digest
+		if canonical, ok := ref.DockerReference().(reference.Canonical); ok {
+			imageDigest = canonical.Digest()
+		} else {
+			var err error
+			if imageDigest, err = e.ImageDigest(ctx, ref); err != nil {
+				return nil, err
+			}
+		}
+
+		service, err := e.analysisService()
+		if err != nil {
+			return nil, err
+		}
+
+		resourceURL := fmt.Sprintf("https://%s@%s", ref.DockerReference().Name(), imageDigest)
+
+		var vulnerabilities []Vulnerability
+		scanned := false
+		err = service.Projects.Occurrences.List("projects/"+e.project).
+			Filter(fmt.Sprintf("resourceUrl=%q", resourceURL)).
+			Pages(ctx, func(response *containeranalysis.ListOccurrencesResponse) error {
+				for _, occurrence := range response.Occurrences {
+					switch {
+					case occurrence.Kind == "DISCOVERY" && occurrence.Discovery != nil:
+						scanned = occurrence.Discovery.AnalysisStatus == "FINISHED_SUCCESS"
+					case occurrence.Kind == "VULNERABILITY" && occurrence.Vulnerability != nil:
+						vulnerabilities = append(vulnerabilities, garVulnerability(occurrence))
+					}
+				}
+				return nil
+			})
+		if err != nil {
+			return nil, err
+		}
+
+		if !scanned {
+			return nil, ErrScanNotAvailable
+		}
+
+		return vulnerabilities, nil
+	})
 }
 
-func (e *GARClient) PutImage() error {
-	panic("implement me")
-}
+// analysisService returns the Container Analysis client, it is shared by all lookups of scan findings
+func (e *GARClient) analysisService() (*containeranalysis.Service, error) {
+	e.analysisMu.Lock()
+	defer e.analysisMu.Unlock()
 
-func (e *GARClient) ImageExists(ctx context.Context, imageRef ctypes.ImageReference) bool {
-	ref := imageRef.DockerReference().String()
-	if _, found := e.cache.Get(ref); found {
-		log.Ctx(ctx).Trace().Str("ref", ref).Msg("found in cache")
-		return true
+	if e.analysis == nil {
+		// the context is kept by the client to renew its credentials
+		service, err := containeranalysis.NewService(context.Background(), e.analysisOptions...)
+		if err != nil {
+			return nil, err
+		}
+		e.analysis = service
 	}
 
-	app := "skopeo"
-	args := []string{
-		"inspect",
-		"--retry-times", "3",
-		"docker://" + ref,
-		"--creds", e.Credentials(),
-	}
+	return e.analysis, nil
+}
 
-	log.Ctx(ctx).Trace().Str("app", app).Strs("args", args).Msg("executing command to inspect image")
-	if err := exec.CommandContext(ctx, app, args...).Run(); err != nil {
-		log.Trace().Str("ref", ref).Msg("not found in target repository")
-		return false
+// garVulnerability converts a vulnerability occurrence, the ID is taken from the note, e.g. "projects/goog-vulnz/notes/CVE-2023-4863"
+func garVulnerability(occurrence *containeranalysis.Occurrence) Vulnerability {
+	severity := occurrence.Vulnerability.EffectiveSeverity
+	if severity == "" || severity == "SEVERITY_UNSPECIFIED" {
+		severity = occurrence.Vulnerability.Severity
 	}
 
-	log.Ctx(ctx).Trace().Str("ref", ref).Msg("found in target repository")
-
-	e.cache.SetWithTTL(ref, "", 1, 24*time.Hour+time.Duration(rand.Intn(180))*time.Minute)
-
-	return true
-}
-
-func (e *GARClient) Endpoint() string {
-	return e.garDomain
-}
+	id := occurrence.NoteName[strings.LastIndex(occurrence.NoteName, "/")+1:]
+	if id == "" {
+		id = occurrence.Vulnerability.ShortDescription
+	}
 
-// IsOrigin returns true if the references origin is from this registry
-func (e *GARClient) IsOrigin(imageRef ctypes.ImageReference) bool {
-	return strings.HasPrefix(imageRef.DockerReference().String(), e.Endpoint())
+	return Vulnerability{ID: id, Severity: severity}
 }
 
 // requestAuthToken requests and returns an authentication token from GAR with its expiration date
@@ -184,33 +168,11 @@ func (e *GARClient) requestAuthToken() ([]byte, time.Time, error) {
 	return []byte(fmt.Sprintf("oauth2accesstoken:%v", token.AccessToken)), token.Expiry, nil
 }
 
-// scheduleTokenRenewal sets a scheduler to execute token renewal before the token expires
-func (e *GARClient) scheduleTokenRenewal() error {
-	token, expiryAt, err := e.requestAuthToken()
-	if err != nil {
-		return err
-	}
-
-	renewalAt := expiryAt.Add(-2 * time.Minute)
-	e.authToken = token
-
-	log.Debug().Time("expiryAt", expiryAt).Time("renewalAt", renewalAt).Msg("auth token set, schedule next token renewal")
-
-	j, _ := e.scheduler.Every(1).StartAt(renewalAt).Do(e.scheduleTokenRenewal)
-	j.LimitRunsTo(1)
-
-	return nil
-}
-
-func (e *GARClient) Credentials() string {
-	return string(e.authToken)
-}
-
 func (e *GARClient) DockerConfig() ([]byte, error) {
 	dockerConfig := DockerConfig{
 		AuthConfigs: map[string]AuthConfig{
-			e.garDomain: {
-				Auth: base64.StdEncoding.EncodeToString(e.authToken),
+			e.Endpoint(): {
+				Auth: base64.StdEncoding.EncodeToString([]byte(e.Credentials())),
 			},
 		},
 	}
@@ -225,11 +187,11 @@ func (e *GARClient) DockerConfig() ([]byte, error) {
 
 func NewMockGARClient(garClient GARAPI, garDomain string) (*GARClient, error) {
 	client := &GARClient{
-		client:    garClient,
-		garDomain: garDomain,
-		cache:     nil,
-		scheduler: nil,
-		authToken: []byte("oauth2accesstoken:mock-gar-client-fake-auth-token"),
+		baseClient: &baseClient{
+			domain:      garDomain,
+			credentials: "oauth2accesstoken:mock-gar-client-fake-auth-token",
+		},
+		client: garClient,
 	}
 
 	return client, nil
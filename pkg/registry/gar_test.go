@@ -1,9 +1,15 @@
 package registry
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/containers/image/v5/transports/alltransports"
+	containeranalysis "google.golang.org/api/containeranalysis/v1"
+	"google.golang.org/api/option"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -36,3 +42,63 @@ func TestGARIsOrigin(t *testing.T) {
 		assert.Equal(t, testcase.expected, result)
 	}
 }
+
+func TestGARImageVulnerabilities(t *testing.T) {
+	const image = "us-central1-docker.pkg.dev/gcp-project-123/main/docker.io/library/nginx@sha256:9bba603b99bf25f6d117cf1235b6598c16033ad027b143c90fa5b3cc583c5713"
+
+	testcases := []struct {
+		name                    string
+		occurrences             []*containeranalysis.Occurrence
+		expectedVulnerabilities []Vulnerability
+		expectedErr             error
+	}{
+		{
+			name: "finished",
+			occurrences: []*containeranalysis.Occurrence{
+				{Kind: "DISCOVERY", Discovery: &containeranalysis.DiscoveryOccurrence{AnalysisStatus: "FINISHED_SUCCESS"}},
+				{Kind: "VULNERABILITY", NoteName: "projects/goog-vulnz/notes/CVE-2023-4863", Vulnerability: &containeranalysis.VulnerabilityOccurrence{EffectiveSeverity: "CRITICAL", Severity: "HIGH"}},
+				{Kind: "VULNERABILITY", NoteName: "projects/goog-vulnz/notes/CVE-2023-38545", Vulnerability: &containeranalysis.VulnerabilityOccurrence{Severity: "HIGH"}},
+			},
+			expectedVulnerabilities: []Vulnerability{
+				{ID: "CVE-2023-4863", Severity: "CRITICAL"},
+				{ID: "CVE-2023-38545", Severity: "HIGH"},
+			},
+		},
+		{
+			name: "scanning",
+			occurrences: []*containeranalysis.Occurrence{
+				{Kind: "DISCOVERY", Discovery: &containeranalysis.DiscoveryOccurrence{AnalysisStatus: "SCANNING"}},
+			},
+			expectedErr: ErrScanNotAvailable,
+		},
+		{
+			name:        "not scanned",
+			expectedErr: ErrScanNotAvailable,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			var filter string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/v1/projects/gcp-project-123/occurrences", r.URL.Path)
+				filter = r.URL.Query().Get("filter")
+				_ = json.NewEncoder(w).Encode(&containeranalysis.ListOccurrencesResponse{Occurrences: testcase.occurrences})
+			}))
+			defer server.Close()
+
+			fakeRegistry, _ := NewMockGARClient(nil, "us-central1-docker.pkg.dev/gcp-project-123/main")
+			fakeRegistry.project = "gcp-project-123"
+			fakeRegistry.analysisOptions = []option.ClientOption{option.WithEndpoint(server.URL), option.WithoutAuthentication()}
+
+			imageRef, err := alltransports.ParseImageName("docker://" + image)
+			assert.NoError(t, err)
+
+			vulnerabilities, err := fakeRegistry.ImageVulnerabilities(context.Background(), imageRef)
+
+			assert.ErrorIs(t, err, testcase.expectedErr)
+			assert.Equal(t, testcase.expectedVulnerabilities, vulnerabilities)
+			assert.Equal(t, `resourceUrl="https://`+image+`"`, filter)
+		})
+	}
+}
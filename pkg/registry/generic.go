@@ -0,0 +1,34 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+)
+
+// GenericClient is a client for registries implementing the OCI Distribution specification, e.g. registry:2 or Zot.
+type GenericClient struct {
+	*baseClient
+}
+
+func NewGenericClient(clientConfig config.Generic) (*GenericClient, error) {
+	base, err := newBaseClient(clientConfig.GenericDomain())
+	if err != nil {
+		return nil, err
+	}
+
+	if clientConfig.Username != "" {
+		base.credentials = fmt.Sprintf("%s:%s", clientConfig.Username, clientConfig.Password)
+	}
+	base.token = clientConfig.Token
+	base.certDir = clientConfig.CertDir
+	base.insecure = clientConfig.Insecure
+
+	return &GenericClient{baseClient: base}, nil
+}
+
+// CreateRepository is empty since OCI Distribution registries create repositories on push
+func (g *GenericClient) CreateRepository(ctx context.Context, name string) error {
+	return nil
+}
@@ -0,0 +1,215 @@
+package registry
+
+import (
+	"context"
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRegistry returns an in-process OCI Distribution registry handler
+func newTestRegistry() http.Handler {
+	return ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0)))
+}
+
+// pushTestImage pushes a random image through an unauthenticated server sharing the registry handler
+func pushTestImage(t *testing.T, handler http.Handler, repository string) {
+	seed := httptest.NewServer(handler)
+	defer seed.Close()
+
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+
+	ref, err := name.ParseReference(strings.TrimPrefix(seed.URL, "http://") + "/" + repository)
+	require.NoError(t, err)
+
+	require.NoError(t, remote.Write(ref, img))
+}
+
+func withBasicAuth(handler http.Handler, username, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != username || p != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func withBearerAuth(handler http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="http://`+r.Host+`/token",service="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func serverHost(server *httptest.Server) string {
+	return strings.TrimPrefix(strings.TrimPrefix(server.URL, "https://"), "http://")
+}
+
+func TestGenericIsOrigin(t *testing.T) {
+	type testCase struct {
+		input    string
+		expected bool
+	}
+	testcases := []testCase{
+		{
+			input:    "k8s.gcr.io/ingress-nginx/controller@sha256:9bba603b99bf25f6d117cf1235b6598c16033ad027b143c90fa5b3cc583c5713",
+			expected: false,
+		},
+		{
+			input:    "registry.example.com/mirror/k8s.gcr.io/ingress-nginx/controller@sha256:9bba603b99bf25f6d117cf1235b6598c16033ad027b143c90fa5b3cc583c5713",
+			expected: true,
+		},
+		{
+			input:    "registry.example.com/other/nginx:latest",
+			expected: false,
+		},
+	}
+
+	fakeRegistry, err := NewGenericClient(config.Generic{Repository: "registry.example.com", Prefix: "mirror"})
+	require.NoError(t, err)
+
+	for _, testcase := range testcases {
+		imageRef, err := alltransports.ParseImageName("docker://" + testcase.input)
+
+		assert.NoError(t, err)
+
+		result := fakeRegistry.IsOrigin(imageRef)
+
+		assert.Equal(t, testcase.expected, result)
+	}
+}
+
+func TestGenericCredentials(t *testing.T) {
+	basic, _ := NewGenericClient(config.Generic{Repository: "registry.example.com", Username: "user", Password: "pass"})
+	assert.Equal(t, "user:pass", basic.Credentials())
+
+	bearer, _ := NewGenericClient(config.Generic{Repository: "registry.example.com", Token: "token"})
+	assert.Equal(t, "", bearer.Credentials())
+}
+
+func TestGenericImageExists(t *testing.T) {
+	handler := newTestRegistry()
+	pushTestImage(t, handler, "docker.io/library/nginx:latest")
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client, err := NewGenericClient(config.Generic{Repository: serverHost(server), Insecure: true})
+	require.NoError(t, err)
+
+	existingRef, _ := alltransports.ParseImageName("docker://" + serverHost(server) + "/docker.io/library/nginx:latest")
+	missingRef, _ := alltransports.ParseImageName("docker://" + serverHost(server) + "/docker.io/library/nginx:missing")
+
+	assert.True(t, client.ImageExists(context.Background(), existingRef))
+	assert.False(t, client.ImageExists(context.Background(), missingRef))
+}
+
+func TestGenericImageExistsWithCustomCA(t *testing.T) {
+	handler := newTestRegistry()
+	pushTestImage(t, handler, "docker.io/library/nginx:latest")
+
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+
+	certDir := t.TempDir()
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(filepath.Join(certDir, "ca.crt"), caCert, 0o600))
+
+	imageRef, _ := alltransports.ParseImageName("docker://" + serverHost(server) + "/docker.io/library/nginx:latest")
+
+	trusted, err := NewGenericClient(config.Generic{Repository: serverHost(server), CertDir: certDir})
+	require.NoError(t, err)
+	assert.True(t, trusted.ImageExists(context.Background(), imageRef))
+
+	untrusted, err := NewGenericClient(config.Generic{Repository: serverHost(server)})
+	require.NoError(t, err)
+	assert.False(t, untrusted.ImageExists(context.Background(), imageRef))
+
+	insecure, err := NewGenericClient(config.Generic{Repository: serverHost(server), Insecure: true})
+	require.NoError(t, err)
+	assert.True(t, insecure.ImageExists(context.Background(), imageRef))
+}
+
+func TestGenericImageExistsWithBearerToken(t *testing.T) {
+	handler := newTestRegistry()
+	pushTestImage(t, handler, "docker.io/library/nginx:latest")
+
+	server := httptest.NewServer(withBearerAuth(handler, "secret-token"))
+	defer server.Close()
+
+	imageRef, _ := alltransports.ParseImageName("docker://" + serverHost(server) + "/docker.io/library/nginx:latest")
+
+	authorized, err := NewGenericClient(config.Generic{Repository: serverHost(server), Token: "secret-token", Insecure: true})
+	require.NoError(t, err)
+	assert.True(t, authorized.ImageExists(context.Background(), imageRef))
+
+	unauthorized, err := NewGenericClient(config.Generic{Repository: serverHost(server), Token: "wrong-token", Insecure: true})
+	require.NoError(t, err)
+	assert.False(t, unauthorized.ImageExists(context.Background(), imageRef))
+}
+
+func TestGenericCopyImage(t *testing.T) {
+	// the source is an OCI layout to avoid requiring TLS settings for the source registry
+	img, err := random.Image(1024, 2)
+	require.NoError(t, err)
+	layoutPath, err := layout.Write(t.TempDir(), empty.Index)
+	require.NoError(t, err)
+	require.NoError(t, layoutPath.AppendImage(img, layout.WithAnnotations(map[string]string{
+		"org.opencontainers.image.ref.name": "latest",
+	})))
+
+	server := httptest.NewServer(withBasicAuth(newTestRegistry(), "user", "pass"))
+	defer server.Close()
+
+	client, err := NewGenericClient(config.Generic{Repository: serverHost(server), Prefix: "mirror", Username: "user", Password: "pass", Insecure: true})
+	require.NoError(t, err)
+
+	srcRef, err := alltransports.ParseImageName("oci:" + string(layoutPath) + ":latest")
+	require.NoError(t, err)
+	destRef, err := alltransports.ParseImageName("docker://" + client.Endpoint() + "/docker.io/library/nginx:latest")
+	require.NoError(t, err)
+
+	assert.False(t, client.ImageExists(context.Background(), destRef))
+	assert.NoError(t, client.CopyImage(context.Background(), srcRef, "", destRef, client.Credentials()))
+	assert.True(t, client.ImageExists(context.Background(), destRef))
+
+	// the digest of the copied manifest is cached and matches the one in the registry
+	expectedDigest, err := img.Digest()
+	require.NoError(t, err)
+	client.cache.Wait()
+	imageDigest, err := client.ImageDigest(context.Background(), destRef)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedDigest.String(), imageDigest.String())
+
+	uncached, err := NewGenericClient(config.Generic{Repository: serverHost(server), Prefix: "mirror", Username: "user", Password: "pass", Insecure: true})
+	require.NoError(t, err)
+	imageDigest, err = uncached.ImageDigest(context.Background(), destRef)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedDigest.String(), imageDigest.String())
+
+	assert.Error(t, client.CopyImage(context.Background(), srcRef, "", destRef, "user:wrong"))
+}
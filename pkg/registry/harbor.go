@@ -0,0 +1,247 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/pkg/tlsclientconfig"
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+// HarborClient is a client for Harbor registries.
+// Images are copied like for any OCI Distribution registry, but projects are created before pushing.
+type HarborClient struct {
+	*GenericClient
+
+	// apiURLs are tried in order, the plain HTTP URL is only tried if TLS fails and plainHTTP is set
+	apiURLs    []string
+	httpClient *http.Client
+	project    string
+	options    config.HarborProjectOptions
+}
+
+type harborProject struct {
+	ProjectID int               `json:"project_id"`
+	Metadata  map[string]string `json:"metadata"`
+}
+
+func NewHarborClient(clientConfig config.Harbor) (*HarborClient, error) {
+	genericClient, err := NewGenericClient(config.Generic{
+		Repository: clientConfig.Repository,
+		Prefix:     clientConfig.Project,
+		Username:   clientConfig.Username,
+		Password:   clientConfig.Password,
+		CertDir:    clientConfig.CertDir,
+		Insecure:   clientConfig.Insecure,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: clientConfig.Insecure} //nolint:gosec // explicitly requested via configuration
+	if clientConfig.CertDir != "" {
+		if err := tlsclientconfig.SetupCertificates(clientConfig.CertDir, tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	transport := tlsclientconfig.NewTransport()
+	transport.TLSClientConfig = tlsConfig
+
+	host := strings.TrimSuffix(clientConfig.Repository, "/")
+	apiURLs := []string{fmt.Sprintf("https://%s/api/v2.0", host)}
+	if clientConfig.PlainHTTP {
+		apiURLs = append(apiURLs, fmt.Sprintf("http://%s/api/v2.0", host))
+	}
+
+	client := &HarborClient{
+		GenericClient: genericClient,
+		apiURLs:       apiURLs,
+		httpClient: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: transport,
+		},
+		project: clientConfig.Project,
+		options: clientConfig.ProjectOptions,
+	}
+
+	return client, nil
+}
+
+// CreateRepository ensures the Harbor project holding the repository exists, repositories are created on push
+func (h *HarborClient) CreateRepository(ctx context.Context, name string) error {
+	project, err := h.projectName(name)
+	if err != nil {
+		return err
+	}
+
+	if _, found := h.cache.Get(project); found {
+		return nil
+	}
+
+	log.Ctx(ctx).Debug().Str("project", project).Msg("create project")
+
+	storageLimit := h.options.StorageLimit
+	if storageLimit < 1 {
+		storageLimit = -1
+	}
+
+	err = h.request(ctx, http.MethodPost, "/projects", map[string]interface{}{
+		"project_name":  project,
+		"public":        h.options.Public,
+		"storage_limit": storageLimit,
+		"metadata": map[string]string{
+			"public": fmt.Sprintf("%t", h.options.Public),
+		},
+	}, nil)
+
+	if err != nil {
+		var harborErr *harborError
+		if !errors.As(err, &harborErr) || harborErr.StatusCode != http.StatusConflict {
+			return err
+		}
+		// We ignore this case as the project already exists.
+	}
+
+	if len(h.options.RetentionPolicy) > 0 {
+		log.Ctx(ctx).Debug().Str("project", project).Str("retentionPolicy", h.options.RetentionPolicy).Msg("setting retention policy on project")
+		if err := h.putRetentionPolicy(ctx, project); err != nil {
+			log.Err(err).Msg(err.Error())
+			return err
+		}
+	}
+
+	h.cache.SetWithTTL(project, "", 1, time.Duration(24*time.Hour))
+
+	return nil
+}
+
+// projectName returns the project for a repository name, e.g. "docker.io" for "docker.io/library/nginx".
+// Source registries which are not valid project names, e.g. "localhost:5000", require a configured project.
+func (h *HarborClient) projectName(name string) (string, error) {
+	if h.project != "" {
+		return h.project, nil
+	}
+	project, _, _ := strings.Cut(name, "/")
+	if !config.ValidHarborProject(project) {
+		return "", fmt.Errorf(`%q is not a valid harbor project, configure a project via "harbor.project"`, project)
+	}
+	return project, nil
+}
+
+// putRetentionPolicy creates or updates the retention policy of a project
+func (h *HarborClient) putRetentionPolicy(ctx context.Context, project string) error {
+	var policy map[string]interface{}
+	if err := json.Unmarshal([]byte(h.options.RetentionPolicy), &policy); err != nil {
+		return fmt.Errorf("invalid retention policy: %w", err)
+	}
+
+	var p harborProject
+	if err := h.request(ctx, http.MethodGet, "/projects/"+url.PathEscape(project), nil, &p); err != nil {
+		return err
+	}
+
+	policy["scope"] = map[string]interface{}{
+		"level": "project",
+		"ref":   p.ProjectID,
+	}
+
+	if retentionID := p.Metadata["retention_id"]; retentionID != "" {
+		return h.request(ctx, http.MethodPut, "/retentions/"+url.PathEscape(retentionID), policy, nil)
+	}
+
+	return h.request(ctx, http.MethodPost, "/retentions", policy, nil)
+}
+
+type harborError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *harborError) Error() string {
+	return fmt.Sprintf("harbor api returned status %d: %s", e.StatusCode, e.Body)
+}
+
+// request calls the Harbor API and decodes the response into out if provided
+func (h *HarborClient) request(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+	var payload []byte
+	if in != nil {
+		var err error
+		if payload, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	var resp *http.Response
+	var err error
+	for _, apiURL := range h.apiURLs {
+		resp, err = h.do(ctx, method, apiURL+path, payload)
+		if err == nil || ctx.Err() != nil || !isTLSError(err) {
+			break
+		}
+		log.Ctx(ctx).Debug().Err(err).Str("url", apiURL).Msg("harbor api not reachable")
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &harborError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(respBody))}
+	}
+
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+
+	return nil
+}
+
+// isTLSError returns true if the request failed to establish TLS, e.g. because the server only speaks plain HTTP
+func isTLSError(err error) bool {
+	var recordHeaderErr tls.RecordHeaderError
+	var verificationErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certificateInvalidErr x509.CertificateInvalidError
+	return errors.Is(err, http.ErrSchemeMismatch) ||
+		errors.As(err, &recordHeaderErr) ||
+		errors.As(err, &verificationErr) ||
+		errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &certificateInvalidErr)
+}
+
+// do sends a single request to the Harbor API
+func (h *HarborClient) do(ctx context.Context, method string, url string, payload []byte) (*http.Response, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	username, password, _ := strings.Cut(h.Credentials(), ":")
+	req.SetBasicAuth(username, password)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Is-Resource-Name", "true")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	return h.httpClient.Do(req)
+}
@@ -0,0 +1,226 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHarbor implements the subset of the Harbor API used to manage projects
+type fakeHarbor struct {
+	mu          sync.Mutex
+	projects    map[string]map[string]interface{}
+	retentions  map[string]map[string]interface{}
+	createCalls int
+}
+
+func newFakeHarbor() *fakeHarbor {
+	return &fakeHarbor{
+		projects:   map[string]map[string]interface{}{},
+		retentions: map[string]map[string]interface{}{},
+	}
+}
+
+func (f *fakeHarbor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if u, p, ok := r.BasicAuth(); !ok || u != "admin" || p != "Harbor12345" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v2.0/projects":
+		f.createCalls++
+		var project map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&project)
+		name := project["project_name"].(string)
+		if _, exists := f.projects[name]; exists {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		project["project_id"] = len(f.projects) + 1
+		project["metadata"] = map[string]string{}
+		f.projects[name] = project
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet && len(r.URL.Path) > len("/api/v2.0/projects/"):
+		project, exists := f.projects[r.URL.Path[len("/api/v2.0/projects/"):]]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(project)
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v2.0/retentions":
+		var policy map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&policy)
+		id := "1"
+		f.retentions[id] = policy
+		for _, project := range f.projects {
+			scope := policy["scope"].(map[string]interface{})
+			if project["project_id"] == int(scope["ref"].(float64)) {
+				project["metadata"] = map[string]string{"retention_id": id}
+			}
+		}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && r.URL.Path == "/api/v2.0/retentions/1":
+		var policy map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&policy)
+		f.retentions["1"] = policy
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestHarborClient(t *testing.T, server *httptest.Server, project string, options config.HarborProjectOptions) *HarborClient {
+	client, err := NewHarborClient(config.Harbor{
+		Repository:     serverHost(server),
+		Project:        project,
+		Username:       "admin",
+		Password:       "Harbor12345",
+		Insecure:       true,
+		ProjectOptions: options,
+	})
+	require.NoError(t, err)
+	return client
+}
+
+func TestHarborCreateRepository(t *testing.T) {
+	harbor := newFakeHarbor()
+	server := httptest.NewTLSServer(harbor)
+	defer server.Close()
+
+	client := newTestHarborClient(t, server, "", config.HarborProjectOptions{Public: true, StorageLimit: 1024})
+
+	assert.NoError(t, client.CreateRepository(context.Background(), "docker.io/library/nginx"))
+	client.cache.Wait()
+	assert.NoError(t, client.CreateRepository(context.Background(), "docker.io/library/busybox"))
+	assert.NoError(t, client.CreateRepository(context.Background(), "quay.io/prometheus/prometheus"))
+
+	assert.Equal(t, 2, harbor.createCalls, "project creation is cached")
+	assert.Contains(t, harbor.projects, "docker.io")
+	assert.Contains(t, harbor.projects, "quay.io")
+	assert.Equal(t, true, harbor.projects["docker.io"]["public"])
+	assert.Equal(t, float64(1024), harbor.projects["docker.io"]["storage_limit"])
+}
+
+func TestHarborCreateRepositoryWithProject(t *testing.T) {
+	harbor := newFakeHarbor()
+	server := httptest.NewTLSServer(harbor)
+	defer server.Close()
+
+	client := newTestHarborClient(t, server, "mirror", config.HarborProjectOptions{})
+
+	assert.Equal(t, serverHost(server)+"/mirror", client.Endpoint())
+	assert.NoError(t, client.CreateRepository(context.Background(), "docker.io/library/nginx"))
+
+	assert.Contains(t, harbor.projects, "mirror")
+	assert.Equal(t, false, harbor.projects["mirror"]["public"])
+	assert.Equal(t, float64(-1), harbor.projects["mirror"]["storage_limit"])
+}
+
+func TestHarborCreateRepositoryInvalidProject(t *testing.T) {
+	harbor := newFakeHarbor()
+	server := httptest.NewTLSServer(harbor)
+	defer server.Close()
+
+	client := newTestHarborClient(t, server, "", config.HarborProjectOptions{})
+
+	assert.Error(t, client.CreateRepository(context.Background(), "localhost:5000/library/nginx"))
+	assert.Equal(t, 0, harbor.createCalls)
+}
+
+func TestHarborCreateRepositoryPlainHTTP(t *testing.T) {
+	tests := []struct {
+		name      string
+		plainHTTP bool
+		expErr    bool
+	}{
+		{name: "plain HTTP allowed", plainHTTP: true},
+		{name: "plain HTTP not allowed", expErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			harbor := newFakeHarbor()
+			server := httptest.NewServer(harbor)
+			defer server.Close()
+
+			client, err := NewHarborClient(config.Harbor{
+				Repository:     serverHost(server),
+				Username:       "admin",
+				Password:       "Harbor12345",
+				Insecure:       true,
+				PlainHTTP:      test.plainHTTP,
+				ProjectOptions: config.HarborProjectOptions{RetentionPolicy: `{"algorithm":"or","rules":[]}`},
+			})
+			require.NoError(t, err)
+
+			err = client.CreateRepository(context.Background(), "docker.io/library/nginx")
+			if test.expErr {
+				assert.Error(t, err)
+				assert.Equal(t, 0, harbor.createCalls, "credentials are not sent via plain HTTP")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Contains(t, harbor.projects, "docker.io")
+			assert.Len(t, harbor.retentions, 1)
+		})
+	}
+}
+
+func TestHarborCreateRepositoryExistingProject(t *testing.T) {
+	harbor := newFakeHarbor()
+	harbor.projects["mirror"] = map[string]interface{}{"project_id": 7, "metadata": map[string]string{}}
+	server := httptest.NewTLSServer(harbor)
+	defer server.Close()
+
+	client := newTestHarborClient(t, server, "mirror", config.HarborProjectOptions{})
+
+	assert.NoError(t, client.CreateRepository(context.Background(), "docker.io/library/nginx"))
+	assert.Equal(t, 1, harbor.createCalls)
+}
+
+func TestHarborCreateRepositoryRetentionPolicy(t *testing.T) {
+	harbor := newFakeHarbor()
+	server := httptest.NewTLSServer(harbor)
+	defer server.Close()
+
+	retentionPolicy := `{"algorithm":"or","rules":[{"action":"retain","template":"latestPushedK","params":{"latestPushedK":10}}],"trigger":{"kind":"Schedule","settings":{"cron":"0 0 0 * * *"}}}`
+	client := newTestHarborClient(t, server, "", config.HarborProjectOptions{RetentionPolicy: retentionPolicy})
+
+	assert.NoError(t, client.CreateRepository(context.Background(), "docker.io/library/nginx"))
+	require.Contains(t, harbor.retentions, "1")
+	assert.Equal(t, map[string]interface{}{"level": "project", "ref": float64(1)}, harbor.retentions["1"]["scope"])
+	assert.Equal(t, "or", harbor.retentions["1"]["algorithm"])
+
+	// an existing retention policy is updated instead of created
+	client.cache.Clear()
+	harbor.retentions["1"]["algorithm"] = "outdated"
+	assert.NoError(t, client.CreateRepository(context.Background(), "docker.io/library/nginx"))
+	assert.Len(t, harbor.retentions, 1)
+	assert.Equal(t, "or", harbor.retentions["1"]["algorithm"])
+}
+
+func TestHarborCreateRepositoryError(t *testing.T) {
+	harbor := newFakeHarbor()
+	server := httptest.NewTLSServer(harbor)
+	defer server.Close()
+
+	client, err := NewHarborClient(config.Harbor{
+		Repository: serverHost(server),
+		Username:   "admin",
+		Password:   "wrong",
+		Insecure:   true,
+	})
+	require.NoError(t, err)
+
+	assert.Error(t, client.CreateRepository(context.Background(), "docker.io/library/nginx"))
+}
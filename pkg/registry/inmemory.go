@@ -1 +1,210 @@
 package registry
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/containers/image/v5/docker/reference"
+	ctypes "github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/rs/zerolog/log"
+)
+
+// InMemoryImage describes an image stored in the InMemoryClient
+type InMemoryImage struct {
+	// Source is the reference the image was copied from
+	Source    string
+	Digest    digest.Digest
+	Platforms []string
+}
+
+// InMemoryClient is a registry client keeping track of repositories and images in memory.
+// It does not transfer any image data and is intended for tests exercising the webhook end-to-end.
+type InMemoryClient struct {
+	mu           sync.RWMutex
+	endpoint     string
+	platforms    []string
+	repositories map[string]struct{}
+	images       map[string]InMemoryImage
+	copyErr      error
+}
+
+// NewInMemoryClient returns an empty in-memory registry client for the given endpoint.
+// Copied images are recorded with the provided platforms, defaulting to linux/amd64.
+func NewInMemoryClient(endpoint string, platforms ...string) *InMemoryClient {
+	if len(platforms) == 0 {
+		platforms = []string{"linux/amd64"}
+	}
+
+	return &InMemoryClient{
+		endpoint:     endpoint,
+		platforms:    platforms,
+		repositories: map[string]struct{}{},
+		images:       map[string]InMemoryImage{},
+	}
+}
+
+func (m *InMemoryClient) CreateRepository(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Ctx(ctx).Debug().Str("repository", name).Msg("create repository")
+	m.repositories[name] = struct{}{}
+
+	return nil
+}
+
+func (m *InMemoryClient) RepositoryExists() bool {
+	panic("implement me")
+}
+
+// CopyImage records the destination image, the digest is taken from the source digest or reference if present.
+// Platforms of the client are limited to the selected platforms.
+func (m *InMemoryClient) CopyImage(ctx context.Context, srcRef ctypes.ImageReference, srcCreds string, destRef ctypes.ImageReference, destCreds string, opts ...CopyOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.copyErr != nil {
+		return m.copyErr
+	}
+
+	src := srcRef.DockerReference().String()
+
+	imageDigest := digest.FromString(src)
+	if canonical, ok := srcRef.DockerReference().(reference.Canonical); ok {
+		imageDigest = canonical.Digest()
+	}
+
+	options := newCopyOptions(opts)
+	if options.sourceDigest != "" {
+		imageDigest = options.sourceDigest
+	}
+
+	m.images[destRef.DockerReference().String()] = InMemoryImage{
+		Source:    src,
+		Digest:    imageDigest,
+		Platforms: selectedPlatforms(m.platforms, options.platforms),
+	}
+
+	return nil
+}
+
+func (m *InMemoryClient) PullImage() error {
+	panic("implement me")
+}
+
+func (m *InMemoryClient) PutImage() error {
+	panic("implement me")
+}
+
+func (m *InMemoryClient) ImageExists(ctx context.Context, ref ctypes.ImageReference) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, found := m.images[ref.DockerReference().String()]
+	return found
+}
+
+// ImageDigest returns the digest recorded for the image
+func (m *InMemoryClient) ImageDigest(ctx context.Context, ref ctypes.ImageReference) (digest.Digest, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	image, found := m.images[ref.DockerReference().String()]
+	if !found {
+		return "", fmt.Errorf("image %s not found", ref.DockerReference().String())
+	}
+	return image.Digest, nil
+}
+
+func (m *InMemoryClient) Endpoint() string {
+	return m.endpoint
+}
+
+// Credentials returns no credentials as the in-memory registry does not require authentication
+func (m *InMemoryClient) Credentials() string {
+	return ""
+}
+
+// IsOrigin returns true if the references origin is from this registry
+func (m *InMemoryClient) IsOrigin(imageRef ctypes.ImageReference) bool {
+	return strings.HasPrefix(imageRef.DockerReference().String(), m.endpoint+"/")
+}
+
+// Close does nothing as the in-memory registry holds no resources
+func (m *InMemoryClient) Close() error {
+	return nil
+}
+
+// AddImage stores an image as if it had been copied before, e.g. to test the "exists" swap policy
+func (m *InMemoryClient) AddImage(ref string, image InMemoryImage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.images[ref] = image
+}
+
+// SetCopyError makes subsequent copies fail with the given error, nil restores successful copies
+func (m *InMemoryClient) SetCopyError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.copyErr = err
+}
+
+// Image returns the image stored for a reference
+func (m *InMemoryClient) Image(ref string) (InMemoryImage, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	image, found := m.images[ref]
+	return image, found
+}
+
+// Images returns a copy of all stored images indexed by reference
+func (m *InMemoryClient) Images() map[string]InMemoryImage {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	images := make(map[string]InMemoryImage, len(m.images))
+	for ref, image := range m.images {
+		images[ref] = image
+	}
+	return images
+}
+
+// Repositories returns the sorted names of all created repositories
+func (m *InMemoryClient) Repositories() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	repositories := make([]string, 0, len(m.repositories))
+	for name := range m.repositories {
+		repositories = append(repositories, name)
+	}
+	sort.Strings(repositories)
+	return repositories
+}
+
+// selectedPlatforms returns the platforms limited to the selection, all platforms are returned without a selection
+func selectedPlatforms(platforms []string, selection []string) []string {
+	selected := []string{}
+	for _, platform := range platforms {
+		if len(selection) == 0 || slices.Contains(selection, platform) {
+			selected = append(selected, platform)
+		}
+	}
+	return selected
+}
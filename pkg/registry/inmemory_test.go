@@ -0,0 +1,66 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInMemoryClient(t *testing.T) {
+	client := NewInMemoryClient("registry.example.com", "linux/amd64", "linux/arm64")
+
+	srcRef, _ := alltransports.ParseImageName("docker://k8s.gcr.io/ingress-nginx/controller@sha256:9bba603b99bf25f6d117cf1235b6598c16033ad027b143c90fa5b3cc583c5713")
+	destRef, _ := alltransports.ParseImageName("docker://registry.example.com/k8s.gcr.io/ingress-nginx/controller@sha256:9bba603b99bf25f6d117cf1235b6598c16033ad027b143c90fa5b3cc583c5713")
+
+	assert.True(t, client.IsOrigin(destRef))
+	assert.False(t, client.IsOrigin(srcRef))
+	assert.False(t, client.ImageExists(context.Background(), destRef))
+
+	assert.NoError(t, client.CreateRepository(context.Background(), "k8s.gcr.io/ingress-nginx/controller"))
+	assert.NoError(t, client.CopyImage(context.Background(), srcRef, "", destRef, client.Credentials()))
+
+	assert.True(t, client.ImageExists(context.Background(), destRef))
+	assert.Equal(t, []string{"k8s.gcr.io/ingress-nginx/controller"}, client.Repositories())
+
+	image, found := client.Image(destRef.DockerReference().String())
+	assert.True(t, found)
+	assert.Equal(t, InMemoryImage{
+		Source:    srcRef.DockerReference().String(),
+		Digest:    digest.Digest("sha256:9bba603b99bf25f6d117cf1235b6598c16033ad027b143c90fa5b3cc583c5713"),
+		Platforms: []string{"linux/amd64", "linux/arm64"},
+	}, image)
+	assert.Len(t, client.Images(), 1)
+}
+
+func TestInMemoryClientTaggedImage(t *testing.T) {
+	client := NewInMemoryClient("registry.example.com")
+
+	srcRef, _ := alltransports.ParseImageName("docker://nginx:latest")
+	destRef, _ := alltransports.ParseImageName("docker://registry.example.com/docker.io/library/nginx:latest")
+
+	assert.NoError(t, client.CopyImage(context.Background(), srcRef, "", destRef, ""))
+
+	image, _ := client.Image("registry.example.com/docker.io/library/nginx:latest")
+	assert.Equal(t, digest.FromString("docker.io/library/nginx:latest"), image.Digest)
+	assert.Equal(t, []string{"linux/amd64"}, image.Platforms)
+}
+
+func TestInMemoryClientCopyError(t *testing.T) {
+	client := NewInMemoryClient("registry.example.com")
+	client.SetCopyError(errors.New("copy failed"))
+
+	srcRef, _ := alltransports.ParseImageName("docker://nginx:latest")
+	destRef, _ := alltransports.ParseImageName("docker://registry.example.com/docker.io/library/nginx:latest")
+
+	assert.EqualError(t, client.CopyImage(context.Background(), srcRef, "", destRef, ""), "copy failed")
+	assert.False(t, client.ImageExists(context.Background(), destRef))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	client.SetCopyError(nil)
+	assert.ErrorIs(t, client.CopyImage(ctx, srcRef, "", destRef, ""), context.Canceled)
+}
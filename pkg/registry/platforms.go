@@ -0,0 +1,239 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	ctypes "github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog/log"
+)
+
+// SystemPlatform selects the single image matching the platform of k8s-image-swapper instead of a manifest list
+const SystemPlatform = "system"
+
+// CopyOption configures a single image copy
+type CopyOption func(*copyOptions)
+
+type copyOptions struct {
+	// platforms limits the platforms copied from a manifest list, all platforms are copied if empty
+	platforms []string
+	// artifacts enables copying cosign signatures, attestations and OCI referrers of the image
+	artifacts bool
+	// sourceDigest pins the source image instead of resolving its tag, e.g. to the digest verified during admission
+	sourceDigest digest.Digest
+}
+
+// WithPlatforms limits the platforms copied from a manifest list, e.g. "linux/amd64" or "linux/arm64/v8".
+// SystemPlatform copies only the image matching the platform of k8s-image-swapper.
+func WithPlatforms(platforms ...string) CopyOption {
+	return func(o *copyOptions) {
+		o.platforms = platforms
+	}
+}
+
+// WithArtifacts copies the cosign signatures, attestations and OCI referrers (e.g. SBOMs) along with the image
+func WithArtifacts(enabled bool) CopyOption {
+	return func(o *copyOptions) {
+		o.artifacts = enabled
+	}
+}
+
+// WithSourceDigest copies the source image by digest instead of resolving its tag again.
+// The digest is ignored if empty.
+func WithSourceDigest(imageDigest digest.Digest) CopyOption {
+	return func(o *copyOptions) {
+		o.sourceDigest = imageDigest
+	}
+}
+
+func newCopyOptions(opts []CopyOption) copyOptions {
+	options := copyOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// ParsePlatform parses a platform in the form "os/architecture[/variant]"
+func ParsePlatform(platform string) (imgspecv1.Platform, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return imgspecv1.Platform{}, fmt.Errorf("invalid platform %q, expected os/architecture[/variant]", platform)
+	}
+
+	p := imgspecv1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// platformMatches returns true if the platform of a manifest list instance is selected, variants are only compared if selected
+func platformMatches(selected []imgspecv1.Platform, platform *imgspecv1.Platform) bool {
+	if platform == nil {
+		return false
+	}
+
+	return slices.ContainsFunc(selected, func(s imgspecv1.Platform) bool {
+		return s.OS == platform.OS && s.Architecture == platform.Architecture && (s.Variant == "" || s.Variant == platform.Variant)
+	})
+}
+
+// selectPlatforms returns the manifest list of the source image limited to the instances matching the platforms,
+// nil is returned if the source image is not a manifest list
+func selectPlatforms(ctx context.Context, srcRef ctypes.ImageReference, srcCtx *ctypes.SystemContext, platforms []string) ([]byte, string, error) {
+	selected := make([]imgspecv1.Platform, 0, len(platforms))
+	for _, platform := range platforms {
+		p, err := ParsePlatform(platform)
+		if err != nil {
+			return nil, "", err
+		}
+		selected = append(selected, p)
+	}
+
+	src, err := srcRef.NewImageSource(ctx, srcCtx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer src.Close()
+
+	blob, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !manifest.MIMETypeIsMultiImage(mimeType) {
+		return nil, "", nil
+	}
+
+	list, err := manifest.ListFromBlob(blob, mimeType)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var instances []digest.Digest
+	for _, instanceDigest := range list.Instances() {
+		instance, err := list.Instance(instanceDigest)
+		if err != nil {
+			return nil, "", err
+		}
+		if platformMatches(selected, instance.ReadOnly.Platform) {
+			instances = append(instances, instanceDigest)
+		}
+	}
+
+	if len(instances) == 0 {
+		return nil, "", fmt.Errorf("image provides none of the platforms %s", strings.Join(platforms, ", "))
+	}
+
+	if len(instances) == len(list.Instances()) {
+		return nil, "", nil
+	}
+
+	trimmed, err := trimManifestList(blob, mimeType, instances)
+	return trimmed, mimeType, err
+}
+
+// trimManifestList removes the instances which are not selected from the manifest list
+func trimManifestList(blob []byte, mimeType string, instances []digest.Digest) ([]byte, error) {
+	switch mimeType {
+	case manifest.DockerV2ListMediaType:
+		schema2List, err := manifest.Schema2ListFromManifest(blob)
+		if err != nil {
+			return nil, err
+		}
+		schema2List.Manifests = slices.DeleteFunc(schema2List.Manifests, func(m manifest.Schema2ManifestDescriptor) bool {
+			return !slices.Contains(instances, m.Digest)
+		})
+		return schema2List.Serialize()
+	case imgspecv1.MediaTypeImageIndex:
+		index, err := manifest.OCI1IndexFromManifest(blob)
+		if err != nil {
+			return nil, err
+		}
+		index.Manifests = slices.DeleteFunc(index.Manifests, func(m imgspecv1.Descriptor) bool {
+			return !slices.Contains(instances, m.Digest)
+		})
+		return index.Serialize()
+	default:
+		return nil, fmt.Errorf("unsupported manifest list type %s", mimeType)
+	}
+}
+
+// trimmedReference is a source image serving a manifest list limited to the selected platforms
+type trimmedReference struct {
+	ctypes.ImageReference
+	manifest []byte
+	mimeType string
+}
+
+func (r trimmedReference) NewImageSource(ctx context.Context, sys *ctypes.SystemContext) (ctypes.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &trimmedSource{ImageSource: src, reference: r}, nil
+}
+
+// trimmedSource replaces the manifest list of the source image, the images of the platforms are read from the source
+type trimmedSource struct {
+	ctypes.ImageSource
+	reference trimmedReference
+}
+
+func (s *trimmedSource) Reference() ctypes.ImageReference {
+	return s.reference
+}
+
+func (s *trimmedSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	if instanceDigest == nil {
+		return s.reference.manifest, s.reference.mimeType, nil
+	}
+	return s.ImageSource.GetManifest(ctx, instanceDigest)
+}
+
+// GetSignatures omits the signatures of the source manifest list as they don't match the trimmed list
+func (s *trimmedSource) GetSignatures(ctx context.Context, instanceDigest *digest.Digest) ([][]byte, error) {
+	if instanceDigest == nil {
+		return nil, nil
+	}
+	return s.ImageSource.GetSignatures(ctx, instanceDigest)
+}
+
+// platformSource returns the source image and how to copy manifest lists for the selected platforms.
+// Manifest lists are trimmed to the selected platforms, except for images referenced by digest as the digest would change.
+// Images pinned via WithSourceDigest are still trimmed as they are referenced by tag.
+func platformSource(ctx context.Context, srcRef ctypes.ImageReference, srcCtx *ctypes.SystemContext, options copyOptions) (ctypes.ImageReference, copy.ImageListSelection, error) {
+	_, canonical := srcRef.DockerReference().(reference.Canonical)
+
+	srcRef, err := pinnedReference(srcRef, options.sourceDigest)
+	if err != nil {
+		return nil, copy.CopyAllImages, err
+	}
+
+	switch {
+	case len(options.platforms) == 0:
+		return srcRef, copy.CopyAllImages, nil
+	case slices.Equal(options.platforms, []string{SystemPlatform}):
+		return srcRef, copy.CopySystemImage, nil
+	}
+
+	if canonical {
+		log.Ctx(ctx).Debug().Msg("image referenced by digest, copying all platforms")
+		return srcRef, copy.CopyAllImages, nil
+	}
+
+	trimmed, mimeType, err := selectPlatforms(ctx, srcRef, srcCtx, options.platforms)
+	if err != nil || trimmed == nil {
+		return srcRef, copy.CopyAllImages, err
+	}
+
+	return trimmedReference{ImageReference: srcRef, manifest: trimmed, mimeType: mimeType}, copy.CopyAllImages, nil
+}
@@ -0,0 +1,110 @@
+package registry
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePlatform(t *testing.T) {
+	platform, err := ParsePlatform("linux/arm64/v8")
+	require.NoError(t, err)
+	assert.Equal(t, imgspecv1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, platform)
+
+	platform, err = ParsePlatform("linux/amd64")
+	require.NoError(t, err)
+	assert.Equal(t, imgspecv1.Platform{OS: "linux", Architecture: "amd64"}, platform)
+
+	for _, invalid := range []string{"linux", "linux/", "/amd64", "linux/arm64/v8/extra"} {
+		_, err = ParsePlatform(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestPlatformMatches(t *testing.T) {
+	selected := []imgspecv1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm", Variant: "v7"}}
+
+	assert.True(t, platformMatches(selected, &imgspecv1.Platform{OS: "linux", Architecture: "amd64"}))
+	assert.True(t, platformMatches(selected, &imgspecv1.Platform{OS: "linux", Architecture: "amd64", Variant: "v3"}), "variant is not selected")
+	assert.True(t, platformMatches(selected, &imgspecv1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}))
+	assert.False(t, platformMatches(selected, &imgspecv1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}))
+	assert.False(t, platformMatches(selected, &imgspecv1.Platform{OS: "windows", Architecture: "amd64"}))
+	assert.False(t, platformMatches(selected, nil))
+}
+
+func TestGenericCopyImagePlatforms(t *testing.T) {
+	index := mutate.IndexMediaType(empty.Index, "application/vnd.oci.image.index.v1+json")
+	for _, platform := range []v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		{OS: "linux", Architecture: "s390x"},
+	} {
+		img, err := random.Image(1024, 1)
+		require.NoError(t, err)
+		index = mutate.AppendManifests(index, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: &platform},
+		})
+	}
+
+	layoutPath, err := layout.Write(t.TempDir(), empty.Index)
+	require.NoError(t, err)
+	require.NoError(t, layoutPath.AppendIndex(index, layout.WithAnnotations(map[string]string{
+		"org.opencontainers.image.ref.name": "latest",
+	})))
+
+	server := httptest.NewServer(withBasicAuth(newTestRegistry(), "user", "pass"))
+	defer server.Close()
+
+	client, err := NewGenericClient(config.Generic{Repository: serverHost(server), Username: "user", Password: "pass", Insecure: true})
+	require.NoError(t, err)
+
+	srcRef, err := alltransports.ParseImageName("oci:" + string(layoutPath) + ":latest")
+	require.NoError(t, err)
+	destRef, err := alltransports.ParseImageName("docker://" + client.Endpoint() + "/docker.io/library/nginx:latest")
+	require.NoError(t, err)
+
+	require.NoError(t, client.CopyImage(context.Background(), srcRef, "", destRef, client.Credentials(), WithPlatforms("linux/amd64", "linux/arm64")))
+
+	ref, err := name.ParseReference(client.Endpoint() + "/docker.io/library/nginx:latest")
+	require.NoError(t, err)
+	copied, err := remote.Index(ref, remote.WithAuth(&authn.Basic{Username: "user", Password: "pass"}))
+	require.NoError(t, err)
+
+	// the manifest list only references the selected platforms
+	indexManifest, err := copied.IndexManifest()
+	require.NoError(t, err)
+	require.Len(t, indexManifest.Manifests, 2)
+	assert.Equal(t, "amd64", indexManifest.Manifests[0].Platform.Architecture)
+	assert.Equal(t, "arm64", indexManifest.Manifests[1].Platform.Architecture)
+
+	for _, descriptor := range indexManifest.Manifests {
+		_, err := copied.Image(descriptor.Digest)
+		assert.NoError(t, err, "the images of the selected platforms are copied")
+	}
+
+	// the cached digest is the one of the trimmed manifest list
+	copiedDigest, err := copied.Digest()
+	require.NoError(t, err)
+	client.cache.Wait()
+	imageDigest, err := client.ImageDigest(context.Background(), destRef)
+	require.NoError(t, err)
+	assert.Equal(t, copiedDigest.String(), imageDigest.String())
+
+	assert.Error(t, client.CopyImage(context.Background(), srcRef, "", destRef, client.Credentials(), WithPlatforms("windows/amd64")),
+		"images without any of the platforms are not copied")
+}
@@ -0,0 +1,49 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	ctypes "github.com/containers/image/v5/types"
+)
+
+// scanCacheTTL defines how long scan findings are reused before asking the registry again
+const scanCacheTTL = 5 * time.Minute
+
+// ErrScanNotAvailable is returned if an image was not scanned or the scan did not finish yet
+var ErrScanNotAvailable = errors.New("image scan results not available")
+
+// Vulnerability is a finding of the image scan in the target registry
+type Vulnerability struct {
+	// ID of the vulnerability, e.g. "CVE-2023-4863"
+	ID string
+	// Severity as reported by the registry, e.g. "CRITICAL" or "HIGH"
+	Severity string
+}
+
+// VulnerabilityScanner is implemented by registries providing the scan findings of stored images, e.g. ECR
+type VulnerabilityScanner interface {
+	// ImageVulnerabilities returns the scan findings of an image, ErrScanNotAvailable is returned without scan results
+	ImageVulnerabilities(ctx context.Context, ref ctypes.ImageReference) ([]Vulnerability, error)
+}
+
+// cachedVulnerabilities returns the scan findings of an image from the cache or fetches them, missing scan results are
+// not cached as the scan may still be in progress
+func (b *baseClient) cachedVulnerabilities(ref ctypes.ImageReference, fetch func() ([]Vulnerability, error)) ([]Vulnerability, error) {
+	key := "vulnerabilities:" + ref.DockerReference().String()
+	if value, found := b.cache.Get(key); found {
+		if vulnerabilities, ok := value.([]Vulnerability); ok {
+			return vulnerabilities, nil
+		}
+	}
+
+	vulnerabilities, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	b.cache.SetWithTTL(key, vulnerabilities, 1, scanCacheTTL)
+
+	return vulnerabilities, nil
+}
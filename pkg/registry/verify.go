@@ -0,0 +1,267 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/transports"
+	ctypes "github.com/containers/image/v5/types"
+	"github.com/dgraph-io/ristretto"
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/opencontainers/go-digest"
+	"github.com/rs/zerolog/log"
+)
+
+// verificationCacheTTL defines how long the result of a signature verification is reused, tags may be moved
+const verificationCacheTTL = 10 * time.Minute
+
+// registriesConfig enables reading cosign signatures ("sha256-<digest>.sig" tags) for all registries
+const registriesConfig = "default-docker:\n  use-sigstore-attachments: true\n"
+
+// SignatureVerificationError is returned if an image is not signed as required by the verification rules
+type SignatureVerificationError struct {
+	Image  string
+	Reason string
+}
+
+func (e *SignatureVerificationError) Error() string {
+	return fmt.Sprintf("signature verification of %s failed: %s", e.Image, e.Reason)
+}
+
+// SignatureVerifier verifies sigstore (cosign) signatures of source images before they are copied
+type SignatureVerifier struct {
+	// rules by scope, the policy holds the same requirements
+	rules  map[string]config.SignatureVerification
+	policy *signature.Policy
+
+	// registriesDir holds the registries.d configuration enabling sigstore attachments
+	registriesDir string
+	cache         *ristretto.Cache
+}
+
+// NewSignatureVerifier returns a verifier requiring signatures for images matching the scope of a rule.
+// The most specific rule applies, images without a matching rule are not verified.
+func NewSignatureVerifier(rules []config.SignatureVerification) (*SignatureVerifier, error) {
+	policy := &signature.Policy{
+		Default:    signature.PolicyRequirements{signature.NewPRInsecureAcceptAnything()},
+		Transports: map[string]signature.PolicyTransportScopes{"docker": {}},
+	}
+
+	scopes := make(map[string]config.SignatureVerification, len(rules))
+	for _, rule := range rules {
+		scopes[rule.Scope] = rule
+
+		requirement, err := policyRequirement(rule)
+		if err != nil {
+			return nil, fmt.Errorf("signature verification of %q: %w", rule.Scope, err)
+		}
+
+		if rule.Scope == "*" {
+			policy.Default = signature.PolicyRequirements{requirement}
+		} else {
+			policy.Transports["docker"][rule.Scope] = signature.PolicyRequirements{requirement}
+		}
+	}
+
+	registriesDir, err := os.MkdirTemp("", "registries.d")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(registriesDir, "default.yaml"), []byte(registriesConfig), 0o600); err != nil {
+		return nil, err
+	}
+
+	cache, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters: 1e5,
+		MaxCost:     1e4,
+		BufferItems: 64,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &SignatureVerifier{rules: scopes, policy: policy, registriesDir: registriesDir, cache: cache}, nil
+}
+
+// policyRequirement returns the sigstore requirement for a rule, signatures of any of the keys or the keyless
+// identity are accepted
+func policyRequirement(rule config.SignatureVerification) (signature.PolicyRequirement, error) {
+	// cosign signs the repository without tag, the signature payload binds it to the image digest
+	options := []signature.PRSigstoreSignedOption{signature.PRSigstoreSignedWithSignedIdentity(signature.NewPRMMatchRepository())}
+
+	switch {
+	case len(rule.Keys) > 0 && rule.Keyless != nil:
+		return nil, errors.New("keys and keyless are mutually exclusive")
+	case len(rule.Keys) > 0:
+		options = append(options, signature.PRSigstoreSignedWithKeyPaths(rule.Keys))
+	case rule.Keyless != nil:
+		fulcio, err := signature.NewPRSigstoreSignedFulcio(
+			signature.PRSigstoreSignedFulcioWithCAPath(rule.Keyless.FulcioCA),
+			signature.PRSigstoreSignedFulcioWithOIDCIssuer(rule.Keyless.OIDCIssuer),
+			signature.PRSigstoreSignedFulcioWithSubjectEmail(rule.Keyless.SubjectEmail),
+		)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, signature.PRSigstoreSignedWithFulcio(fulcio))
+	default:
+		return nil, errors.New("either keys or keyless is required")
+	}
+
+	if rule.RekorPublicKey != "" {
+		options = append(options, signature.PRSigstoreSignedWithRekorPublicKeyPath(rule.RekorPublicKey))
+	}
+
+	return signature.NewPRSigstoreSigned(options...)
+}
+
+// Required returns true if a rule applies to the image
+func (v *SignatureVerifier) Required(ref ctypes.ImageReference) bool {
+	named := ref.DockerReference()
+	if named == nil {
+		return false
+	}
+
+	_, found := v.rule(named)
+	return found
+}
+
+// rule returns the most specific rule for the image, the same precedence the signature policy applies to its scopes:
+// the repository, its namespaces up to the registry, wildcard domains from the longest and finally "*"
+func (v *SignatureVerifier) rule(named reference.Named) (config.SignatureVerification, bool) {
+	for scope := named.Name(); ; {
+		if rule, found := v.rules[scope]; found {
+			return rule, true
+		}
+
+		i := strings.LastIndex(scope, "/")
+		if i < 0 {
+			break
+		}
+		scope = scope[:i]
+	}
+
+	for domain := reference.Domain(named); ; {
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+
+		if rule, found := v.rules["*."+domain]; found {
+			return rule, true
+		}
+	}
+
+	rule, found := v.rules["*"]
+	return rule, found
+}
+
+// Verify resolves the digest of the source image and checks its signatures using the given docker auth file.
+// The verified digest is returned, it is empty if no rule applies to the image. Images have to be copied by this digest
+// as the tag may be moved after the verification.
+// A SignatureVerificationError is returned if the image is not signed as required, results are cached by digest for a while.
+func (v *SignatureVerifier) Verify(ctx context.Context, srcRef ctypes.ImageReference, srcCreds string) (digest.Digest, error) {
+	return v.verifyCached(ctx, srcRef, sourceSystemContext(srcCreds))
+}
+
+func (v *SignatureVerifier) verifyCached(ctx context.Context, srcRef ctypes.ImageReference, srcCtx *ctypes.SystemContext) (digest.Digest, error) {
+	named := srcRef.DockerReference()
+	if named == nil {
+		return "", nil
+	}
+	rule, found := v.rule(named)
+	if !found {
+		return "", nil
+	}
+
+	var verifiedDigest digest.Digest
+	if canonical, ok := named.(reference.Canonical); ok {
+		verifiedDigest = canonical.Digest()
+	} else {
+		var err error
+		if verifiedDigest, err = imageDigest(ctx, srcRef, srcCtx); err != nil {
+			return "", err
+		}
+	}
+
+	pinnedRef, err := pinnedReference(srcRef, verifiedDigest)
+	if err != nil {
+		return "", err
+	}
+
+	key := pinnedRef.DockerReference().String()
+	value, cached := v.cache.Get(key)
+	if !cached {
+		log.Ctx(ctx).Trace().Str("src", transports.ImageName(pinnedRef)).Str("scope", rule.Scope).Msg("verify image signatures")
+
+		err := v.verify(ctx, pinnedRef, srcCtx)
+
+		var verificationErr *SignatureVerificationError
+		switch {
+		case err == nil:
+			value = true
+		case errors.As(err, &verificationErr):
+			value = verificationErr
+		default:
+			return "", err
+		}
+		v.cache.SetWithTTL(key, value, 1, verificationCacheTTL)
+	}
+
+	// the reason is cached for the digest, the error refers to the image as referenced by the pod
+	if verificationErr, ok := value.(*SignatureVerificationError); ok {
+		return "", &SignatureVerificationError{Image: named.String(), Reason: verificationErr.Reason}
+	}
+
+	return verifiedDigest, nil
+}
+
+func (v *SignatureVerifier) verify(ctx context.Context, srcRef ctypes.ImageReference, srcCtx *ctypes.SystemContext) error {
+	srcCtx.RegistriesDirPath = v.registriesDir
+
+	// policy contexts must not be used concurrently
+	policyContext, err := signature.NewPolicyContext(v.policy)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = policyContext.Destroy()
+	}()
+
+	src, err := srcRef.NewImageSource(ctx, srcCtx)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	allowed, err := policyContext.IsRunningImageAllowed(ctx, image.UnparsedInstance(src, nil))
+	if allowed {
+		return nil
+	}
+
+	var requirementErr signature.PolicyRequirementError
+	if errors.As(err, &requirementErr) || err == nil {
+		reason := "rejected by policy"
+		if err != nil {
+			reason = err.Error()
+		}
+		return &SignatureVerificationError{Image: srcRef.DockerReference().String(), Reason: reason}
+	}
+
+	return err
+}
+
+// Close removes the temporary registries configuration
+func (v *SignatureVerifier) Close() error {
+	v.cache.Close()
+	return os.RemoveAll(v.registriesDir)
+}
@@ -0,0 +1,134 @@
+package registry
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/signature/signer"
+	"github.com/containers/image/v5/signature/sigstore"
+	"github.com/containers/image/v5/transports/alltransports"
+	ctypes "github.com/containers/image/v5/types"
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signTestImage copies an image within the test registry and attaches a cosign signature
+func signTestImage(t *testing.T, verifier *SignatureVerifier, sysCtx *ctypes.SystemContext, src, dest, privateKey string) {
+	signingCtx := *sysCtx
+	signingCtx.RegistriesDirPath = verifier.registriesDir
+
+	imageSigner, err := sigstore.NewSigner(sigstore.WithPrivateKeyFile(privateKey, []byte("passphrase")))
+	require.NoError(t, err)
+	defer imageSigner.Close()
+
+	srcRef, err := alltransports.ParseImageName("docker://" + src)
+	require.NoError(t, err)
+	destRef, err := alltransports.ParseImageName("docker://" + dest)
+	require.NoError(t, err)
+
+	policyContext, err := signature.NewPolicyContext(&signature.Policy{Default: signature.PolicyRequirements{signature.NewPRInsecureAcceptAnything()}})
+	require.NoError(t, err)
+	defer func() { _ = policyContext.Destroy() }()
+
+	_, err = copy.Image(context.Background(), policyContext, destRef, srcRef, &copy.Options{
+		SourceCtx:      &signingCtx,
+		DestinationCtx: &signingCtx,
+		Signers:        []*signer.Signer{imageSigner},
+	})
+	require.NoError(t, err)
+}
+
+func TestSignatureVerifier(t *testing.T) {
+	handler := newTestRegistry()
+	pushTestImage(t, handler, "upstream/unsigned:latest")
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	host := serverHost(server)
+
+	keys, err := sigstore.GenerateKeyPair([]byte("passphrase"))
+	require.NoError(t, err)
+	keyDir := t.TempDir()
+	privateKey := filepath.Join(keyDir, "cosign.key")
+	publicKey := filepath.Join(keyDir, "cosign.pub")
+	require.NoError(t, os.WriteFile(privateKey, keys.PrivateKey, 0o600))
+	require.NoError(t, os.WriteFile(publicKey, keys.PublicKey, 0o600))
+
+	verifier, err := NewSignatureVerifier([]config.SignatureVerification{
+		{Scope: host + "/upstream", Keys: []string{publicKey}},
+	})
+	require.NoError(t, err)
+	defer verifier.Close()
+
+	sysCtx := &ctypes.SystemContext{DockerInsecureSkipTLSVerify: ctypes.OptionalBoolTrue}
+	signTestImage(t, verifier, sysCtx, host+"/upstream/unsigned:latest", host+"/upstream/signed:latest", privateKey)
+
+	verify := func(image string) error {
+		ref, err := alltransports.ParseImageName("docker://" + image)
+		require.NoError(t, err)
+		srcCtx := *sysCtx
+		_, err = verifier.verifyCached(context.Background(), ref, &srcCtx)
+		return err
+	}
+
+	signedRef, err := alltransports.ParseImageName("docker://" + host + "/upstream/signed:latest")
+	require.NoError(t, err)
+	signedDigest, err := imageDigest(context.Background(), signedRef, sysCtx)
+	require.NoError(t, err)
+
+	srcCtx := *sysCtx
+	verifiedDigest, err := verifier.verifyCached(context.Background(), signedRef, &srcCtx)
+	require.NoError(t, err)
+	assert.Equal(t, signedDigest, verifiedDigest, "the digest of the verified image is returned")
+
+	err = verify(host + "/upstream/unsigned:latest")
+	var verificationErr *SignatureVerificationError
+	require.ErrorAs(t, err, &verificationErr)
+	assert.Equal(t, host+"/upstream/unsigned:latest", verificationErr.Image)
+
+	pushTestImage(t, handler, "upstream/signed:latest")
+	assert.ErrorAs(t, verify(host+"/upstream/signed:latest"), &verificationErr, "results are cached by digest, not by tag")
+
+	pushTestImage(t, handler, "other/unsigned:latest")
+	assert.NoError(t, verify(host+"/other/unsigned:latest"), "images without a matching rule are not verified")
+}
+
+func TestSignatureVerifierRequired(t *testing.T) {
+	verifier, err := NewSignatureVerifier([]config.SignatureVerification{
+		{Scope: "docker.io", Keys: []string{"cosign.pub"}},
+		{Scope: "ghcr.io/org", Keys: []string{"cosign.pub"}},
+		{Scope: "ghcr.io/org/team", Keys: []string{"team.pub"}},
+		{Scope: "*.example.com", Keys: []string{"cosign.pub"}},
+		{Scope: "*.eu.example.com", Keys: []string{"eu.pub"}},
+	})
+	require.NoError(t, err)
+	defer verifier.Close()
+
+	tests := map[string]string{
+		"nginx:latest":                     "docker.io",
+		"ghcr.io/org/app:v1":               "ghcr.io/org",
+		"ghcr.io/org/team/app:v1":          "ghcr.io/org/team",
+		"ghcr.io/organization/app:v1":      "",
+		"registry.example.com/app:v1":      "*.example.com",
+		"registry.eu.example.com/app:v1":   "*.eu.example.com",
+		"quay.io/prometheus/prometheus:v2": "",
+	}
+
+	for image, scope := range tests {
+		ref, err := alltransports.ParseImageName("docker://" + image)
+		require.NoError(t, err)
+		assert.Equal(t, scope != "", verifier.Required(ref), image)
+
+		rule, _ := verifier.rule(ref.DockerReference())
+		assert.Equal(t, scope, rule.Scope, "the most specific rule applies to %s", image)
+	}
+
+	_, err = NewSignatureVerifier([]config.SignatureVerification{{Scope: "docker.io"}})
+	assert.Error(t, err, "a key or keyless identity is required")
+}
@@ -8,10 +8,13 @@ const (
 	RegistryUnknown = iota
 	RegistryAWS
 	RegistryGCP
+	RegistryGeneric
+	RegistryHarbor
+	RegistryAzure
 )
 
 func (p Registry) String() string {
-	return [...]string{"unknown", "aws", "gcp"}[p]
+	return [...]string{"unknown", "aws", "gcp", "generic", "harbor", "azure"}[p]
 }
 
 func ParseRegistry(p string) (Registry, error) {
@@ -20,6 +23,12 @@ func ParseRegistry(p string) (Registry, error) {
 		return RegistryAWS, nil
 	case Registry(RegistryGCP).String():
 		return RegistryGCP, nil
+	case Registry(RegistryGeneric).String():
+		return RegistryGeneric, nil
+	case Registry(RegistryHarbor).String():
+		return RegistryHarbor, nil
+	case Registry(RegistryAzure).String():
+		return RegistryAzure, nil
 	}
 	return RegistryUnknown, fmt.Errorf("unknown target registry string: '%s', defaulting to unknown", p)
 }
@@ -71,3 +80,48 @@ func ParseImageCopyPolicy(p string) (ImageCopyPolicy, error) {
 	}
 	return ImageCopyPolicyDelayed, fmt.Errorf("unknown image copy policy string: '%s', defaulting to delayed", p)
 }
+
+type ImageCopyQueueFullPolicy int
+
+const (
+	ImageCopyQueueFullPolicyBlock = iota
+	ImageCopyQueueFullPolicyDrop
+	ImageCopyQueueFullPolicyReject
+)
+
+func (p ImageCopyQueueFullPolicy) String() string {
+	return [...]string{"block", "drop", "reject"}[p]
+}
+
+func ParseImageCopyQueueFullPolicy(p string) (ImageCopyQueueFullPolicy, error) {
+	switch p {
+	case ImageCopyQueueFullPolicy(ImageCopyQueueFullPolicyBlock).String():
+		return ImageCopyQueueFullPolicyBlock, nil
+	case ImageCopyQueueFullPolicy(ImageCopyQueueFullPolicyDrop).String():
+		return ImageCopyQueueFullPolicyDrop, nil
+	case ImageCopyQueueFullPolicy(ImageCopyQueueFullPolicyReject).String():
+		return ImageCopyQueueFullPolicyReject, nil
+	}
+	return ImageCopyQueueFullPolicyBlock, fmt.Errorf("unknown image copy queue full policy string: '%s', defaulting to block", p)
+}
+
+type VulnerabilityAction int
+
+const (
+	VulnerabilityActionSkip = iota
+	VulnerabilityActionDeny
+)
+
+func (a VulnerabilityAction) String() string {
+	return [...]string{"skip", "deny"}[a]
+}
+
+func ParseVulnerabilityAction(a string) (VulnerabilityAction, error) {
+	switch a {
+	case VulnerabilityAction(VulnerabilityActionSkip).String():
+		return VulnerabilityActionSkip, nil
+	case VulnerabilityAction(VulnerabilityActionDeny).String():
+		return VulnerabilityActionDeny, nil
+	}
+	return VulnerabilityActionSkip, fmt.Errorf("unknown vulnerability action string: '%s', defaulting to skip", a)
+}
@@ -93,3 +93,146 @@ func TestParseImageCopyPolicy(t *testing.T) {
 		})
 	}
 }
+
+func TestParseImageCopyQueueFullPolicy(t *testing.T) {
+	type args struct {
+		p string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    ImageCopyQueueFullPolicy
+		wantErr bool
+	}{
+		{
+			name: "block",
+			args: args{p: "block"},
+			want: ImageCopyQueueFullPolicyBlock,
+		},
+		{
+			name: "drop",
+			args: args{p: "drop"},
+			want: ImageCopyQueueFullPolicyDrop,
+		},
+		{
+			name: "reject",
+			args: args{p: "reject"},
+			want: ImageCopyQueueFullPolicyReject,
+		},
+		{
+			name:    "random-non-existent",
+			args:    args{p: "random-non-existent"},
+			want:    ImageCopyQueueFullPolicyBlock,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseImageCopyQueueFullPolicy(tt.args.p)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseImageCopyQueueFullPolicy() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseImageCopyQueueFullPolicy() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRegistry(t *testing.T) {
+	type args struct {
+		p string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    Registry
+		wantErr bool
+	}{
+		{
+			name: "aws",
+			args: args{p: "aws"},
+			want: RegistryAWS,
+		},
+		{
+			name: "gcp",
+			args: args{p: "gcp"},
+			want: RegistryGCP,
+		},
+		{
+			name: "generic",
+			args: args{p: "generic"},
+			want: RegistryGeneric,
+		},
+		{
+			name: "harbor",
+			args: args{p: "harbor"},
+			want: RegistryHarbor,
+		},
+		{
+			name: "azure",
+			args: args{p: "azure"},
+			want: RegistryAzure,
+		},
+		{
+			name:    "random-non-existent",
+			args:    args{p: "random-non-existent"},
+			want:    RegistryUnknown,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRegistry(tt.args.p)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseRegistry() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseRegistry() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseVulnerabilityAction(t *testing.T) {
+	type args struct {
+		a string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    VulnerabilityAction
+		wantErr bool
+	}{
+		{
+			name: "skip",
+			args: args{a: "skip"},
+			want: VulnerabilityActionSkip,
+		},
+		{
+			name: "deny",
+			args: args{a: "deny"},
+			want: VulnerabilityActionDeny,
+		},
+		{
+			name:    "random-non-existent",
+			args:    args{a: "random-non-existent"},
+			want:    VulnerabilityActionSkip,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseVulnerabilityAction(tt.args.a)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseVulnerabilityAction() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseVulnerabilityAction() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package webhook
+
+import (
+	"encoding/json"
+
+	"github.com/rs/zerolog/log"
+	kwhmodel "github.com/slok/kubewebhook/v2/pkg/model"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ephemeralContainersSubResource is the pod sub-resource used to add ephemeral containers, e.g. by `kubectl debug`
+const ephemeralContainersSubResource = "ephemeralcontainers"
+
+// containerImage references a container and the image field to be swapped
+type containerImage struct {
+	container corev1.Container
+	image     *string
+}
+
+// containerImages returns the containers of a pod spec to be processed.
+// Requests for the ephemeral containers sub-resource only process ephemeral containers which are being added,
+// as the API server rejects changes to the remaining containers.
+func (p *ImageSwapper) containerImages(ar *kwhmodel.AdmissionReview, podSpec *corev1.PodSpec) []containerImage {
+	var containerImages []containerImage
+
+	ephemeralOnly := subResource(ar) == ephemeralContainersSubResource
+
+	if !ephemeralOnly {
+		for i := range podSpec.Containers {
+			containerImages = append(containerImages, containerImage{container: podSpec.Containers[i], image: &podSpec.Containers[i].Image})
+		}
+		for i := range podSpec.InitContainers {
+			containerImages = append(containerImages, containerImage{container: podSpec.InitContainers[i], image: &podSpec.InitContainers[i].Image})
+		}
+	}
+
+	existing := map[string]bool{}
+	if ephemeralOnly {
+		existing = existingEphemeralContainers(ar)
+	}
+
+	for i := range podSpec.EphemeralContainers {
+		ephemeralContainer := &podSpec.EphemeralContainers[i]
+		if existing[ephemeralContainer.Name] {
+			continue
+		}
+		containerImages = append(containerImages, containerImage{
+			container: corev1.Container(ephemeralContainer.EphemeralContainerCommon),
+			image:     &ephemeralContainer.Image,
+		})
+	}
+
+	return containerImages
+}
+
+// subResource returns the sub-resource of the admission request, e.g. "ephemeralcontainers"
+func subResource(ar *kwhmodel.AdmissionReview) string {
+	switch review := ar.OriginalAdmissionReview.(type) {
+	case *admissionv1.AdmissionReview:
+		if review.Request != nil {
+			return review.Request.SubResource
+		}
+	case *admissionv1beta1.AdmissionReview:
+		if review.Request != nil {
+			return review.Request.SubResource
+		}
+	}
+
+	return ""
+}
+
+// existingEphemeralContainers returns the names of the ephemeral containers present before the request
+func existingEphemeralContainers(ar *kwhmodel.AdmissionReview) map[string]bool {
+	existing := map[string]bool{}
+	if len(ar.OldObjectRaw) == 0 {
+		return existing
+	}
+
+	oldPod := &corev1.Pod{}
+	if err := json.Unmarshal(ar.OldObjectRaw, oldPod); err != nil {
+		log.Warn().Err(err).Msg("could not decode previous pod, processing all ephemeral containers")
+		return existing
+	}
+
+	for _, ephemeralContainer := range oldPod.Spec.EphemeralContainers {
+		existing[ephemeralContainer.Name] = true
+	}
+
+	return existing
+}
@@ -0,0 +1,211 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/containers/image/v5/transports/alltransports"
+	ctypes "github.com/containers/image/v5/types"
+	"github.com/estahn/k8s-image-swapper/pkg/queue"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// copyJobStoreTimeout bounds the store operations of copies, e.g. updates of the ConfigMap shared by all replicas
+const copyJobStoreTimeout = 5 * time.Second
+
+// newCopyJob returns the job copying the image of a container, including the pod details to look up image pull secrets
+func newCopyJob(pod *corev1.Pod, container corev1.Container, srcRef ctypes.ImageReference, targetRef ctypes.ImageReference) queue.Job {
+	targetImage := targetRef.DockerReference().String()
+
+	imagePullSecrets := make([]string, 0, len(pod.Spec.ImagePullSecrets))
+	for _, imagePullSecret := range pod.Spec.ImagePullSecrets {
+		imagePullSecrets = append(imagePullSecrets, imagePullSecret.Name)
+	}
+
+	return queue.Job{
+		ID:                 queue.JobID(targetImage),
+		SourceImage:        srcRef.DockerReference().String(),
+		TargetImage:        targetImage,
+		Namespace:          pod.Namespace,
+		ServiceAccountName: pod.Spec.ServiceAccountName,
+		ImagePullSecrets:   imagePullSecrets,
+		ImagePullPolicy:    string(container.ImagePullPolicy),
+		CreatedAt:          time.Now().UTC(),
+	}
+}
+
+// imageCopierFromJob restores the image copier of a persisted job
+func (p *ImageSwapper) imageCopierFromJob(job queue.Job) (*ImageCopier, error) {
+	srcRef, err := alltransports.ParseImageName("docker://" + job.SourceImage)
+	if err != nil {
+		return nil, err
+	}
+
+	targetRef, err := alltransports.ParseImageName("docker://" + job.TargetImage)
+	if err != nil {
+		return nil, err
+	}
+
+	// the pod only carries the details required to look up image pull secrets
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: job.Namespace},
+		Spec:       corev1.PodSpec{ServiceAccountName: job.ServiceAccountName},
+	}
+	for _, name := range job.ImagePullSecrets {
+		pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, corev1.LocalObjectReference{Name: name})
+	}
+
+	logger := log.With().
+		Str("source-image", job.SourceImage).
+		Str("target-image", job.TargetImage).
+		Logger()
+
+	return &ImageCopier{
+		sourcePod:       pod,
+		sourceImageRef:  srcRef,
+		targetImageRef:  targetRef,
+		imagePullPolicy: corev1.PullPolicy(job.ImagePullPolicy),
+		imageSwapper:    p,
+		target:          p.originTarget(targetRef),
+		context:         logger.WithContext(context.Background()),
+		job:             job,
+		persisted:       true,
+	}, nil
+}
+
+// resumeCopyJobs submits the jobs left in the store, e.g. by a previous instance, to the copier.
+// Failed jobs are retried once their backoff elapsed, dead-lettered jobs are kept for inspection only.
+func (p *ImageSwapper) resumeCopyJobs() {
+	jobs, err := p.copyJobStore.List(context.Background())
+	if err != nil {
+		log.Err(err).Msg("failed listing copy jobs to resume")
+		return
+	}
+
+	for _, job := range jobs {
+		if job.DeadLetter {
+			continue
+		}
+
+		log.Info().Str("target-image", job.TargetImage).Int("attempts", job.Attempts).Msg("resuming copy job")
+		p.scheduleCopyJob(job, time.Until(job.NextAttemptAt))
+	}
+}
+
+// PersistQueuedCopies persists the delayed copies which are still queued once the copier stopped, e.g. on shutdown,
+// to resume them after the restart
+func (p *ImageSwapper) PersistQueuedCopies(ctx context.Context) {
+	for _, job := range p.copyQueue.pendingJobs() {
+		p.saveCopyJob(ctx, job)
+	}
+}
+
+// saveCopyJob persists the job within the store timeout, false is returned if it was not persisted
+func (p *ImageSwapper) saveCopyJob(ctx context.Context, job queue.Job) bool {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), copyJobStoreTimeout)
+	defer cancel()
+
+	if err := p.copyJobStore.Save(ctx, job); err != nil {
+		log.Ctx(ctx).Err(err).Msg("failed persisting copy job")
+		return false
+	}
+	return true
+}
+
+// retryCopyJob records a failed attempt and schedules the job again using the retry policy,
+// the job is dead-lettered once all attempts are exhausted or the image failed the signature verification
+func (p *ImageSwapper) retryCopyJob(ctx context.Context, job queue.Job, copyErr error) {
+	job.Attempts++
+	job.LastError = copyErr.Error()
+
+	// images failing the signature verification are not retried
+	var verificationErr *registry.SignatureVerificationError
+	permanent := errors.As(copyErr, &verificationErr)
+
+	var backoff time.Duration
+	if permanent || p.copyRetryPolicy.Exhausted(job.Attempts) {
+		job.DeadLetter = true
+		job.NextAttemptAt = time.Time{}
+		log.Ctx(ctx).Error().Int("attempts", job.Attempts).Msg("image copy failed permanently, moving job to dead-letter list")
+	} else {
+		backoff = p.copyRetryPolicy.Backoff(job.Attempts)
+		job.NextAttemptAt = time.Now().UTC().Add(backoff)
+		log.Ctx(ctx).Info().Int("attempts", job.Attempts).Dur("backoff", backoff).Msg("retrying image copy")
+	}
+
+	if err := p.copyJobStore.Save(ctx, job); err != nil {
+		log.Ctx(ctx).Err(err).Msg("failed updating copy job")
+	}
+
+	if job.DeadLetter {
+		deadLetteredImageCopies.Inc()
+		return
+	}
+
+	imageCopyRetries.Inc()
+	p.scheduleCopyJob(job, backoff)
+}
+
+// scheduleCopyJob submits the job to the copier after the delay, jobs of images which are being copied already are
+// settled by the running copy. Jobs are rescheduled if the copier is full.
+func (p *ImageSwapper) scheduleCopyJob(job queue.Job, delay time.Duration) {
+	submit := func() {
+		imageCopier, err := p.imageCopierFromJob(job)
+		if err != nil {
+			log.Err(err).Str("target-image", job.TargetImage).Msg("dropping invalid copy job")
+			if err := p.copyJobStore.Delete(context.Background(), job.ID); err != nil {
+				log.Err(err).Msg("failed removing copy job")
+			}
+			return
+		}
+
+		running, owner := p.inflightCopies.start(job.TargetImage)
+		if !owner {
+			go p.settleCopyJob(job, running)
+			return
+		}
+		imageCopier.inflight = running
+
+		// background copies never block, e.g. a timer or the startup
+		if !p.trySubmitCopy(&copyTask{class: copyClassBackground, priority: job.Priority, run: imageCopier.start, source: imageCopier.sourceDomain()}) {
+			p.inflightCopies.finish(job.TargetImage, running, ErrCopyQueueFull)
+
+			// the job is kept in the store and resumed after the restart
+			if p.copier.Stopped() {
+				return
+			}
+
+			// try again later instead of losing the job
+			droppedImageCopies.Inc()
+			p.scheduleCopyJob(job, p.copyRetryPolicy.Backoff(1))
+		}
+	}
+
+	if delay <= 0 {
+		submit()
+		return
+	}
+
+	time.AfterFunc(delay, submit)
+}
+
+// settleCopyJob waits for the running copy of the same image and settles the job with its result. The job is removed
+// once the image was copied, failed copies retry the job with the same ID themselves and dropped copies are rescheduled.
+func (p *ImageSwapper) settleCopyJob(job queue.Job, running *inflightCopy) {
+	err := running.wait(context.Background())
+
+	switch {
+	case err == nil:
+		ctx, cancel := context.WithTimeout(context.Background(), copyJobStoreTimeout)
+		defer cancel()
+		if err := p.copyJobStore.Delete(ctx, job.ID); err != nil {
+			log.Err(err).Str("target-image", job.TargetImage).Msg("failed removing copy job")
+		}
+	case errors.Is(err, ErrCopyQueueFull) && !p.copier.Stopped():
+		p.scheduleCopyJob(job, p.copyRetryPolicy.Backoff(1))
+	}
+}
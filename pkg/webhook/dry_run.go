@@ -0,0 +1,70 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+
+	ctypes "github.com/containers/image/v5/types"
+	"github.com/estahn/k8s-image-swapper/pkg/types"
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// dryRunAnnotation is set on pods in dry-run mode and describes the changes which would have been made
+const dryRunAnnotation = "k8s-image-swapper.github.io/dry-run"
+
+// dryRunAction describes the actions which would have been taken for a container
+type dryRunAction struct {
+	Container   string `json:"container"`
+	Image       string `json:"image"`
+	TargetImage string `json:"targetImage"`
+	Swap        bool   `json:"swap"`
+	Copy        bool   `json:"copy"`
+}
+
+// dryRunAction determines whether the image would have been copied and swapped based on the configured policies
+func (p *ImageSwapper) dryRunAction(ctx context.Context, target *targetRegistry, container corev1.Container, srcRef ctypes.ImageReference, targetRef ctypes.ImageReference) dryRunAction {
+	exists := target.client.ImageExists(ctx, targetRef)
+
+	action := dryRunAction{
+		Container:   container.Name,
+		Image:       container.Image,
+		TargetImage: targetRef.DockerReference().String(),
+		Copy:        p.imageCopyPolicy != types.ImageCopyPolicyNone && !exists,
+		Swap:        p.imageSwapPolicy == types.ImageSwapPolicyAlways || exists,
+	}
+
+	if action.Copy {
+		dryRunImageCopies.Inc()
+	}
+	if action.Swap {
+		dryRunImageSwaps.Inc()
+	}
+
+	log.Ctx(ctx).Info().
+		Str("source-image", srcRef.DockerReference().String()).
+		Str("target-image", action.TargetImage).
+		Bool("copy", action.Copy).
+		Bool("swap", action.Swap).
+		Msg("dry-run, not copying or swapping image")
+
+	return action
+}
+
+// annotateDryRun records the dry-run actions on the object
+func annotateDryRun(obj metav1.Object, actions []dryRunAction) error {
+	value, err := json.Marshal(actions)
+	if err != nil {
+		return err
+	}
+
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[dryRunAnnotation] = string(value)
+	obj.SetAnnotations(annotations)
+
+	return nil
+}
@@ -0,0 +1,404 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/estahn/k8s-image-swapper/pkg/types"
+	"github.com/rs/zerolog/log"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// originalImagesAnnotation records the images of the swapped containers before the swap, keyed by container name
+	originalImagesAnnotation = "k8s-image-swapper.github.io/original-images"
+	// fallbackAnnotation lists the containers restored to their original image, they are not swapped again
+	fallbackAnnotation = "k8s-image-swapper.github.io/fallback"
+)
+
+// fallbackResyncPeriod defines how often pods are checked again, the pull failures do not necessarily update the pod
+const fallbackResyncPeriod = 30 * time.Second
+
+// podMeta returns the object metadata of pods and of the pod template of workload controllers
+func podMeta(obj metav1.Object) metav1.Object {
+	switch workload := obj.(type) {
+	case *appsv1.Deployment:
+		return &workload.Spec.Template.ObjectMeta
+	case *appsv1.StatefulSet:
+		return &workload.Spec.Template.ObjectMeta
+	case *appsv1.DaemonSet:
+		return &workload.Spec.Template.ObjectMeta
+	case *batchv1.Job:
+		return &workload.Spec.Template.ObjectMeta
+	case *batchv1.CronJob:
+		return &workload.Spec.JobTemplate.Spec.Template.ObjectMeta
+	default:
+		return obj
+	}
+}
+
+// originalImages returns the images recorded before the swap, keyed by container name
+func originalImages(obj metav1.Object) (map[string]string, error) {
+	images := map[string]string{}
+
+	value, ok := obj.GetAnnotations()[originalImagesAnnotation]
+	if !ok {
+		return images, nil
+	}
+
+	if err := json.Unmarshal([]byte(value), &images); err != nil {
+		return images, fmt.Errorf("invalid annotation %s: %w", originalImagesAnnotation, err)
+	}
+
+	return images, nil
+}
+
+// annotateOriginalImages records the images of the swapped containers on the pod or pod template,
+// images recorded previously are kept
+func annotateOriginalImages(obj metav1.Object, images map[string]string) error {
+	meta := podMeta(obj)
+
+	recorded, err := originalImages(meta)
+	if err != nil {
+		log.Warn().Err(err).Msg("replacing invalid original images annotation")
+	}
+	for container, image := range images {
+		recorded[container] = image
+	}
+
+	value, err := json.Marshal(recorded)
+	if err != nil {
+		return err
+	}
+
+	annotations := meta.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[originalImagesAnnotation] = string(value)
+	meta.SetAnnotations(annotations)
+
+	return nil
+}
+
+// fallbackContainers returns the containers restored to their original image by the fallback controller
+func fallbackContainers(obj metav1.Object) map[string]bool {
+	containers := map[string]bool{}
+
+	value := obj.GetAnnotations()[fallbackAnnotation]
+	for _, name := range strings.Split(value, ",") {
+		if name != "" {
+			containers[name] = true
+		}
+	}
+
+	return containers
+}
+
+// retryCopy copies the original image of a container again, e.g. after the swapped image could not be pulled.
+// The job is scheduled in the background, failed and dead-lettered jobs of the image start over.
+// Images are not copied in dry-run.
+func (p *ImageSwapper) retryCopy(ctx context.Context, pod *corev1.Pod, container corev1.Container) error {
+	if p.imageCopyPolicy == types.ImageCopyPolicyNone || p.dryRun {
+		return nil
+	}
+
+	normalizedName, err := imageNamesWithDigestOrTag(container.Image)
+	if err != nil {
+		return err
+	}
+
+	srcRef, err := alltransports.ParseImageName("docker://" + normalizedName)
+	if err != nil {
+		return err
+	}
+
+	filterCtx := FilterContext{Obj: pod, Container: container}
+	target := p.selectTarget(filterCtx)
+	targetRef := target.targetRef(srcRef)
+
+	job := newCopyJob(pod, container, srcRef, targetRef)
+	job.Priority = p.copyPriority(filterCtx)
+	job.Platforms = p.copyPlatforms(filterCtx, target)
+
+	if err := p.copyJobStore.Save(ctx, job); err != nil {
+		log.Ctx(ctx).Err(err).Msg("failed persisting copy job")
+	}
+
+	p.scheduleCopyJob(job, 0)
+
+	return nil
+}
+
+// FallbackController watches pods whose swapped images cannot be pulled, e.g. with `imageSwapPolicy: always` after
+// a failed copy. The copy is retriggered once the pull fails and the original image is restored if the container
+// still fails to pull the image after the grace period.
+type FallbackController struct {
+	client       kubernetes.Interface
+	imageSwapper *ImageSwapper
+	gracePeriod  time.Duration
+
+	mu sync.Mutex
+	// failures records when a container was first seen failing to pull its image, keyed by pod UID and container
+	failures map[string]time.Time
+
+	now func() time.Time
+}
+
+// NewFallbackController returns a controller retriggering copies through the image swapper and restoring the
+// original images of pods after the grace period
+func NewFallbackController(client kubernetes.Interface, imageSwapper *ImageSwapper, gracePeriod time.Duration) *FallbackController {
+	return &FallbackController{
+		client:       client,
+		imageSwapper: imageSwapper,
+		gracePeriod:  gracePeriod,
+		failures:     map[string]time.Time{},
+		now:          time.Now,
+	}
+}
+
+// Run watches pending pods until the context is cancelled
+func (c *FallbackController) Run(ctx context.Context) error {
+	// failures observed during a previous leadership may be outdated
+	c.mu.Lock()
+	c.failures = map[string]time.Time{}
+	c.mu.Unlock()
+
+	// containers failing to pull their image keep the pod pending
+	factory := informers.NewSharedInformerFactoryWithOptions(c.client, fallbackResyncPeriod,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = "status.phase=" + string(corev1.PodPending)
+		}),
+	)
+
+	podInformer := factory.Core().V1().Pods().Informer()
+	_, err := podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.handle(ctx, obj)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			c.handle(ctx, obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if pod, ok := obj.(*corev1.Pod); ok {
+				c.forget(pod.UID, nil)
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+
+	if !cache.WaitForCacheSync(ctx.Done(), podInformer.HasSynced) {
+		return ctx.Err()
+	}
+
+	log.Info().Dur("grace-period", c.gracePeriod).Msg("fallback controller started")
+	<-ctx.Done()
+
+	return nil
+}
+
+// handle reconciles pods received from the informer
+func (c *FallbackController) handle(ctx context.Context, obj interface{}) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return
+	}
+
+	if err := c.reconcile(ctx, pod); err != nil {
+		log.Err(err).Str("namespace", pod.Namespace).Str("name", pod.Name).Msg("fallback to original images failed")
+	}
+}
+
+// reconcile retriggers the copy of swapped images which cannot be pulled and restores the original images once the
+// grace period elapsed
+func (c *FallbackController) reconcile(ctx context.Context, pod *corev1.Pod) error {
+	images, err := originalImages(pod)
+	if err != nil || len(images) == 0 {
+		return err
+	}
+
+	logger := log.With().
+		Str("namespace", pod.Namespace).
+		Str("name", pod.Name).
+		Logger()
+	lctx := logger.WithContext(ctx)
+
+	// pods are shared with the informer cache and must not be modified
+	specs := map[string]corev1.Container{}
+	for _, container := range pod.Spec.InitContainers {
+		specs[container.Name] = container
+	}
+	for _, container := range pod.Spec.Containers {
+		specs[container.Name] = container
+	}
+	statuses := make([]corev1.ContainerStatus, 0, len(pod.Status.InitContainerStatuses)+len(pod.Status.ContainerStatuses))
+	statuses = append(statuses, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+
+	now := c.now()
+	failing := map[string]bool{}
+	var fallback []string
+
+	for _, status := range statuses {
+		original, recorded := images[status.Name]
+		spec, exists := specs[status.Name]
+		if !recorded || !exists || spec.Image == original || !imagePullFailed(status) {
+			continue
+		}
+		failing[status.Name] = true
+
+		failingSince, known := c.failingSince(pod.UID, status.Name, now)
+		if !known {
+			log.Ctx(lctx).Info().Str("container", status.Name).Str("image", spec.Image).Msg("swapped image cannot be pulled, retriggering copy")
+			spec.Image = original
+			if err := c.imageSwapper.retryCopy(lctx, pod, spec); err != nil {
+				log.Ctx(lctx).Warn().Err(err).Str("image", original).Msg("unable to retrigger image copy")
+			} else {
+				fallbackCopyRetries.Inc()
+			}
+		}
+
+		if now.Sub(failingSince) >= c.gracePeriod {
+			fallback = append(fallback, status.Name)
+		}
+	}
+
+	c.forget(pod.UID, failing)
+
+	if len(fallback) == 0 {
+		return nil
+	}
+
+	if err := c.restoreOriginalImages(ctx, pod, images, fallback); err != nil {
+		return err
+	}
+
+	for _, name := range fallback {
+		log.Ctx(lctx).Warn().Str("container", name).Str("image", images[name]).Msg("restored original image after grace period")
+		imageFallbacks.Inc()
+	}
+	c.forget(pod.UID, nil)
+
+	return nil
+}
+
+// restoreOriginalImages updates the containers of the pod to their original image, which restarts them.
+// The containers are recorded in the fallback annotation to not be swapped again.
+func (c *FallbackController) restoreOriginalImages(ctx context.Context, pod *corev1.Pod, images map[string]string, containers []string) error {
+	restored := fallbackContainers(pod)
+	for _, name := range containers {
+		restored[name] = true
+	}
+	names := make([]string, 0, len(restored))
+	for name := range restored {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	type containerImage struct {
+		Name  string `json:"name"`
+		Image string `json:"image"`
+	}
+	var initContainers, regularContainers []containerImage
+	for _, name := range containers {
+		image := containerImage{Name: name, Image: images[name]}
+		if isInitContainer(pod, name) {
+			initContainers = append(initContainers, image)
+		} else {
+			regularContainers = append(regularContainers, image)
+		}
+	}
+
+	spec := map[string]interface{}{}
+	if len(initContainers) > 0 {
+		spec["initContainers"] = initContainers
+	}
+	if len(regularContainers) > 0 {
+		spec["containers"] = regularContainers
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{fallbackAnnotation: strings.Join(names, ",")},
+		},
+		"spec": spec,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.client.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, k8stypes.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// failingSince returns when the container was first seen failing, false if it is seen failing for the first time
+func (c *FallbackController) failingSince(uid k8stypes.UID, container string, now time.Time) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := string(uid) + "/" + container
+	if since, ok := c.failures[key]; ok {
+		return since, true
+	}
+	c.failures[key] = now
+
+	return now, false
+}
+
+// forget removes the containers of the pod which are no longer failing, all containers if failing is nil
+func (c *FallbackController) forget(uid k8stypes.UID, failing map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	prefix := string(uid) + "/"
+	for key := range c.failures {
+		if name, ok := strings.CutPrefix(key, prefix); ok && !failing[name] {
+			delete(c.failures, key)
+		}
+	}
+}
+
+// imagePullFailed returns true if the container is waiting for its image to be pulled after a failed attempt
+func imagePullFailed(status corev1.ContainerStatus) bool {
+	if status.State.Waiting == nil {
+		return false
+	}
+
+	switch status.State.Waiting.Reason {
+	case "ErrImagePull", "ImagePullBackOff":
+		return true
+	default:
+		return false
+	}
+}
+
+// isInitContainer returns true if the container is an init container of the pod
+func isInitContainer(pod *corev1.Pod, name string) bool {
+	for _, container := range pod.Spec.InitContainers {
+		if container.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package webhook
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/estahn/k8s-image-swapper/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestFallbackController_Reconcile(t *testing.T) {
+	registryClient := registry.NewInMemoryClient("registry.example.com")
+	imageSwapper := NewImageSwapperWithOpts(
+		registryClient,
+		ImageSwapPolicy(types.ImageSwapPolicyAlways),
+		ImageCopyPolicy(types.ImageCopyPolicyDelayed),
+	).(*ImageSwapper)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "nginx",
+			Namespace:   "default",
+			UID:         "1234",
+			Annotations: map[string]string{originalImagesAnnotation: `{"nginx":"nginx:1.25","sidecar":"busybox"}`},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "nginx", Image: "registry.example.com/docker.io/library/nginx:1.25"},
+				{Name: "sidecar", Image: "registry.example.com/docker.io/library/busybox:latest"},
+			},
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodPending,
+			ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "nginx", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}}},
+				{Name: "sidecar", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+			},
+		},
+	}
+
+	client := fake.NewSimpleClientset(pod)
+	controller := NewFallbackController(client, imageSwapper, 5*time.Minute)
+
+	now := time.Now()
+	controller.now = func() time.Time { return now }
+
+	// the copy is retriggered once the pull fails
+	require.NoError(t, controller.reconcile(context.Background(), pod))
+	assert.Eventually(t, func() bool {
+		_, found := registryClient.Image("registry.example.com/docker.io/library/nginx:1.25")
+		return found
+	}, 5*time.Second, 10*time.Millisecond, "image is copied again")
+
+	_, found := registryClient.Image("registry.example.com/docker.io/library/busybox:latest")
+	assert.False(t, found, "images of running containers are not copied")
+
+	// the original image is kept within the grace period
+	now = now.Add(time.Minute)
+	require.NoError(t, controller.reconcile(context.Background(), pod))
+	updated, err := client.CoreV1().Pods("default").Get(context.Background(), "nginx", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "registry.example.com/docker.io/library/nginx:1.25", updated.Spec.Containers[0].Image)
+
+	// the original image is restored after the grace period
+	now = now.Add(5 * time.Minute)
+	require.NoError(t, controller.reconcile(context.Background(), pod))
+	updated, err = client.CoreV1().Pods("default").Get(context.Background(), "nginx", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "nginx:1.25", updated.Spec.Containers[0].Image)
+	assert.Equal(t, "registry.example.com/docker.io/library/busybox:latest", updated.Spec.Containers[1].Image)
+	assert.Equal(t, "nginx", updated.Annotations[fallbackAnnotation])
+	assert.Empty(t, controller.failures)
+}
+
+func TestFallbackController_ReconcileRecovered(t *testing.T) {
+	imageSwapper := NewImageSwapperWithOpts(
+		registry.NewInMemoryClient("registry.example.com"),
+		ImageCopyPolicy(types.ImageCopyPolicyNone),
+	).(*ImageSwapper)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "nginx",
+			Namespace:   "default",
+			UID:         "1234",
+			Annotations: map[string]string{originalImagesAnnotation: `{"nginx":"nginx:1.25"}`},
+		},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "nginx", Image: "registry.example.com/docker.io/library/nginx:1.25"}},
+		},
+		Status: corev1.PodStatus{
+			InitContainerStatuses: []corev1.ContainerStatus{
+				{Name: "nginx", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ErrImagePull"}}},
+			},
+		},
+	}
+
+	client := fake.NewSimpleClientset(pod)
+	controller := NewFallbackController(client, imageSwapper, time.Minute)
+
+	require.NoError(t, controller.reconcile(context.Background(), pod))
+	assert.Len(t, controller.failures, 1)
+
+	// containers pulling the image after all are forgotten
+	recovered := pod.DeepCopy()
+	recovered.Status.InitContainerStatuses[0].State = corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+	require.NoError(t, controller.reconcile(context.Background(), recovered))
+	assert.Empty(t, controller.failures)
+}
@@ -4,9 +4,13 @@ import (
 	"context"
 	"errors"
 	"os"
+	"strings"
 
 	"github.com/containers/image/v5/docker/reference"
 	ctypes "github.com/containers/image/v5/types"
+	"github.com/estahn/k8s-image-swapper/pkg/queue"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/opencontainers/go-digest"
 	"github.com/rs/zerolog/log"
 	corev1 "k8s.io/api/core/v1"
 )
@@ -16,9 +20,25 @@ type ImageCopier struct {
 	sourcePod      *corev1.Pod
 	sourceImageRef ctypes.ImageReference
 	targetImageRef ctypes.ImageReference
+	// sourceDigest is the digest the signatures were verified for, the image is copied by this digest
+	sourceDigest digest.Digest
 
 	imagePullPolicy corev1.PullPolicy
 	imageSwapper    *ImageSwapper
+	// target is the registry the image is copied to
+	target *targetRegistry
+	// targetPresent is set if the image exists in the target registry but is missing in one of its replicas
+	targetPresent bool
+
+	// job is the persisted representation of the copy, removed from the store once the copy succeeded
+	job queue.Job
+	// persist stores the job once the image needs to be copied, e.g. delayed copies resumed after a restart
+	persist bool
+	// persisted is set if the job is in the store
+	persisted bool
+
+	// inflight is the copy operation shared with concurrent requests for the same target image
+	inflight *inflightCopy
 
 	context       context.Context
 	cancelContext context.CancelFunc
@@ -31,6 +51,8 @@ type Task struct {
 
 var ErrImageAlreadyPresent = errors.New("image already present in target registry")
 
+var ErrCopyQueueFull = errors.New("image copy queue is full")
+
 // replace the default context with a new one with a timeout
 func (ic *ImageCopier) withDeadline() *ImageCopier {
 	imageCopierContext, imageCopierContextCancel := context.WithTimeout(ic.context, ic.imageSwapper.imageCopyDeadline)
@@ -51,6 +73,14 @@ func (ic *ImageCopier) start() {
 			function:    ic.taskCheckImage,
 			description: "checking image presence in target registry",
 		},
+		{
+			function:    ic.taskPersistJob,
+			description: "persisting the copy job",
+		},
+		{
+			function:    ic.taskVerifySignature,
+			description: "verifying signatures of the source image",
+		},
 		{
 			function:    ic.taskCreateRepository,
 			description: "creating a new repository in target registry",
@@ -59,10 +89,15 @@ func (ic *ImageCopier) start() {
 			function:    ic.taskCopyImage,
 			description: "copying image data to target repository",
 		},
+		{
+			function:    ic.taskReplicateImage,
+			description: "replicating image to the replicas of the target registry",
+		},
 	}
 
+	var err error
 	for _, task := range tasks {
-		err := ic.run(task.function)
+		err = ic.run(task.function)
 
 		if err != nil {
 			if errors.Is(err, context.DeadlineExceeded) {
@@ -75,6 +110,42 @@ func (ic *ImageCopier) start() {
 			break
 		}
 	}
+
+	if ic.inflight != nil {
+		result := err
+		if errors.Is(result, ErrImageAlreadyPresent) {
+			result = nil
+		}
+		ic.imageSwapper.inflightCopies.finish(ic.job.TargetImage, ic.inflight, result)
+	}
+
+	ic.finish(err)
+}
+
+// finish removes the job from the store after a successful copy, failed jobs are retried with backoff
+func (ic *ImageCopier) finish(err error) {
+	store := ic.imageSwapper.copyJobStore
+	if store == nil || ic.job.ID == "" {
+		return
+	}
+
+	// the copy context may be expired already
+	ctx := context.WithoutCancel(ic.context)
+
+	if err == nil || errors.Is(err, ErrImageAlreadyPresent) {
+		if !ic.persisted {
+			return
+		}
+
+		deleteCtx, cancel := context.WithTimeout(ctx, copyJobStoreTimeout)
+		defer cancel()
+		if err := store.Delete(deleteCtx, ic.job.ID); err != nil {
+			log.Ctx(ctx).Err(err).Msg("failed removing copy job")
+		}
+		return
+	}
+
+	ic.imageSwapper.retryCopyJob(ctx, ic.job, err)
 }
 
 // run a task function and check for timeout
@@ -87,27 +158,90 @@ func (ic *ImageCopier) run(taskFunc func() error) error {
 }
 
 func (ic *ImageCopier) taskCheckImage() error {
-	registryClient := ic.imageSwapper.registryClient
+	registryClient := ic.target.client
 
 	imageAlreadyExists := registryClient.ImageExists(ic.context, ic.targetImageRef) && ic.imagePullPolicy != corev1.PullAlways
 
 	if err := ic.context.Err(); err != nil {
 		return err
-	} else if imageAlreadyExists {
-		return ErrImageAlreadyPresent
+	} else if !imageAlreadyExists {
+		return nil
+	}
+
+	for _, replica := range ic.target.replicas {
+		if !ic.replicaExists(replica) {
+			ic.targetPresent = true
+			return nil
+		}
 	}
 
+	return ErrImageAlreadyPresent
+}
+
+// taskPersistJob stores the job of a copy which is needed, e.g. delayed copies, to resume it after a restart.
+// The copy continues if the job could not be persisted.
+func (ic *ImageCopier) taskPersistJob() error {
+	if ic.persist && !ic.persisted {
+		ic.persisted = ic.imageSwapper.saveCopyJob(ic.context, ic.job)
+	}
 	return nil
 }
 
+// replicaExists returns true if the image is present in the replica and doesn't need to be copied again
+func (ic *ImageCopier) replicaExists(replica *targetRegistry) bool {
+	replicaRef, err := ic.target.replicaRef(replica, ic.targetImageRef)
+	if err != nil {
+		return false
+	}
+
+	return replica.client.ImageExists(ic.context, replicaRef) && ic.imagePullPolicy != corev1.PullAlways
+}
+
+// taskCreateRepository creates the target repository, named relative to the target registry as it may be rewritten
 func (ic *ImageCopier) taskCreateRepository() error {
-	createRepoName := reference.TrimNamed(ic.sourceImageRef.DockerReference()).String()
+	if ic.targetPresent {
+		return nil
+	}
 
-	return ic.imageSwapper.registryClient.CreateRepository(ic.context, createRepoName)
+	return createRepository(ic.context, ic.target.client, ic.targetImageRef)
 }
 
-func (ic *ImageCopier) taskCopyImage() error {
-	ctx := ic.context
+// createRepository creates the repository of the reference, named relative to the registry
+func createRepository(ctx context.Context, registryClient registry.Client, ref ctypes.ImageReference) error {
+	repository := reference.TrimNamed(ref.DockerReference()).String()
+
+	return registryClient.CreateRepository(ctx, strings.TrimPrefix(repository, registryClient.Endpoint()+"/"))
+}
+
+// taskVerifySignature refuses to copy images which are not signed as required by the signature verification rules.
+// Images verified during the admission are not verified again, e.g. resumed copy jobs are.
+func (ic *ImageCopier) taskVerifySignature() error {
+	if ic.sourceDigest != "" {
+		return nil
+	}
+	return ic.verifySignature(ic.context)
+}
+
+// verifySignature checks the signatures of the source image if a signature verification rule applies
+// and remembers the verified digest
+func (ic *ImageCopier) verifySignature(ctx context.Context) error {
+	verifier := ic.imageSwapper.signatureVerifier
+	if verifier == nil || !verifier.Required(ic.sourceImageRef) {
+		return nil
+	}
+
+	return ic.withAuthFile(ctx, func(authFile string) error {
+		sourceDigest, err := verifier.Verify(ctx, ic.sourceImageRef, authFile)
+		if err != nil {
+			return err
+		}
+		ic.sourceDigest = sourceDigest
+		return nil
+	})
+}
+
+// withAuthFile calls the function with a docker auth file holding the image pull secrets of the pod
+func (ic *ImageCopier) withAuthFile(ctx context.Context, fn func(authFile string) error) error {
 	// Retrieve secrets and auth credentials
 	imagePullSecrets, err := ic.imageSwapper.imagePullSecretProvider.GetImagePullSecrets(ctx, ic.sourcePod)
 	// not possible at the moment
@@ -130,10 +264,97 @@ func (ic *ImageCopier) taskCopyImage() error {
 		return err
 	}
 
-	// Copy image
-	// TODO: refactor to use structure instead of passing file name / string
-	//
-	//	or transform registryClient creds into auth compatible form, e.g.
-	//	{"auths":{"aws_account_id.dkr.ecr.region.amazonaws.com":{"username":"AWS","password":"..."	}}}
-	return ic.imageSwapper.registryClient.CopyImage(ctx, ic.sourceImageRef, authFile.Name(), ic.targetImageRef, ic.imageSwapper.registryClient.Credentials())
+	return fn(authFile.Name())
+}
+
+// sourceDomain returns the domain of the source registry
+func (ic *ImageCopier) sourceDomain() string {
+	return reference.Domain(ic.sourceImageRef.DockerReference())
+}
+
+func (ic *ImageCopier) taskCopyImage() error {
+	ctx := ic.context
+
+	if ic.targetPresent {
+		return nil
+	}
+
+	return ic.withAuthFile(ctx, func(authFile string) error {
+		// queued copies only start once the source registry allows a copy, this rarely waits
+		release, err := ic.imageSwapper.sourceLimiters.acquire(ctx, ic.sourceDomain())
+		if err != nil {
+			return err
+		}
+		defer func() {
+			release()
+			// copies waiting for a slot of the source registry may start
+			ic.imageSwapper.copyQueue.wake()
+		}()
+
+		// Copy image
+		// TODO: refactor to use structure instead of passing file name / string
+		//
+		//	or transform registryClient creds into auth compatible form, e.g.
+		//	{"auths":{"aws_account_id.dkr.ecr.region.amazonaws.com":{"username":"AWS","password":"..."	}}}
+		// verified images are copied by digest as the tag may have been moved since
+		return ic.target.client.CopyImage(ctx, ic.sourceImageRef, authFile, ic.targetImageRef, ic.target.client.Credentials(),
+			registry.WithPlatforms(ic.job.Platforms...), registry.WithArtifacts(ic.target.copyArtifacts),
+			registry.WithSourceDigest(ic.sourceDigest))
+	})
+}
+
+// taskReplicateImage copies the image from the target registry to its replicas which don't have the image yet
+func (ic *ImageCopier) taskReplicateImage() error {
+	if len(ic.target.replicas) == 0 {
+		return nil
+	}
+
+	// the target registry is the source of the replication
+	dockerConfig, err := registry.GenerateDockerConfig(ic.target.client)
+	if err != nil {
+		return err
+	}
+
+	authFile, err := os.CreateTemp("", "auth")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.RemoveAll(authFile.Name()); err != nil {
+			log.Ctx(ic.context).Err(err).Str("file", authFile.Name()).Msg("failed removing auth file")
+		}
+	}()
+
+	if _, err := authFile.Write(dockerConfig); err != nil {
+		return err
+	}
+	if err := authFile.Close(); err != nil {
+		return err
+	}
+
+	for _, replica := range ic.target.replicas {
+		if ic.replicaExists(replica) {
+			continue
+		}
+
+		replicaRef, err := ic.target.replicaRef(replica, ic.targetImageRef)
+		if err != nil {
+			return err
+		}
+
+		log.Ctx(ic.context).Debug().Str("replica-image", replicaRef.DockerReference().String()).Msg("replicate image")
+
+		if err := createRepository(ic.context, replica.client, replicaRef); err != nil {
+			return err
+		}
+
+		if err := replica.client.CopyImage(ic.context, ic.targetImageRef, authFile.Name(), replicaRef, replica.client.Credentials(),
+			registry.WithArtifacts(replica.copyArtifacts)); err != nil {
+			return err
+		}
+
+		imageReplications.WithLabelValues(replica.client.Endpoint()).Inc()
+	}
+
+	return nil
 }
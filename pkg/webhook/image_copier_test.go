@@ -81,6 +81,7 @@ func TestImageCopier_tasksTimeout(t *testing.T) {
 	targetRef, _ := alltransports.ParseImageName("docker://123456789.dkr.ecr.ap-southeast-2.amazonaws.com/docker.io/library/init-container:latest")
 	imageCopier := &ImageCopier{
 		imageSwapper:    imageSwapper,
+		target:          imageSwapper.defaultTarget(),
 		context:         context.Background(),
 		sourceImageRef:  srcRef,
 		targetImageRef:  targetRef,
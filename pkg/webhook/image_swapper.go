@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/alitto/pond"
@@ -11,16 +12,21 @@ import (
 	"github.com/containers/image/v5/transports/alltransports"
 	ctypes "github.com/containers/image/v5/types"
 	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/queue"
 	"github.com/estahn/k8s-image-swapper/pkg/registry"
 	"github.com/estahn/k8s-image-swapper/pkg/secrets"
 	types "github.com/estahn/k8s-image-swapper/pkg/types"
 	jmespath "github.com/jmespath/go-jmespath"
+	"github.com/opencontainers/go-digest"
 	"github.com/rs/zerolog/log"
 	kwhmodel "github.com/slok/kubewebhook/v2/pkg/model"
 	"github.com/slok/kubewebhook/v2/pkg/webhook"
 	kwhmutating "github.com/slok/kubewebhook/v2/pkg/webhook/mutating"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
 )
 
 // Option represents an option that can be passed when instantiating the image swapper to customize it
@@ -68,6 +74,147 @@ func Copier(pool *pond.WorkerPool) Option {
 	}
 }
 
+// DryRun allows to pass the dry-run option, images are neither copied nor swapped and the intended changes are
+// reported via logs, metrics and pod annotations instead
+func DryRun(dryRun bool) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.dryRun = dryRun
+	}
+}
+
+// MutateWorkloads allows to enable the mutation of pod templates in workload controllers, e.g. Deployments
+func MutateWorkloads(enabled bool) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.mutateWorkloads = enabled
+	}
+}
+
+// DigestPinning allows to enable pinning swapped images to the digest in the target registry
+func DigestPinning(enabled bool) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.digestPinning = enabled
+	}
+}
+
+// CopyJobStore allows to pass the store persisting copy jobs, pending jobs are resumed on startup
+func CopyJobStore(store queue.Store) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.copyJobStore = store
+	}
+}
+
+// CopyQueueFullPolicy allows to define the behavior when the copy queue is full
+func CopyQueueFullPolicy(policy types.ImageCopyQueueFullPolicy) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.copyQueueFullPolicy = policy
+	}
+}
+
+// SourceRateLimits allows to limit the concurrency and rate of copies per source registry
+func SourceRateLimits(limits []config.SourceRateLimit) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.sourceLimiters = newSourceLimiters(limits)
+	}
+}
+
+// CopyPriorities allows to define rules assigning priorities to image copies
+func CopyPriorities(priorities []config.CopyPriority) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.copyPriorities = priorities
+	}
+}
+
+// NamespaceLister provides the namespace labels matched by the namespace selectors of copy priorities,
+// rules with a namespace selector never match without it
+func NamespaceLister(lister corelisters.NamespaceLister) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.namespaceLister = lister
+	}
+}
+
+// CopyRetryPolicy allows to pass the policy to retry failed image copies
+func CopyRetryPolicy(policy queue.RetryPolicy) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.copyRetryPolicy = policy
+	}
+}
+
+// Platforms allows to limit the platforms copied from manifest lists
+func Platforms(platforms []string) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.platforms = platforms
+	}
+}
+
+// SourcePlatforms allows to select the platforms copied per source filter, overriding the platforms option
+func SourcePlatforms(rules []config.SourcePlatforms) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.sourcePlatforms = rules
+	}
+}
+
+// CopyArtifacts allows to copy signatures, attestations and OCI referrers along with the images
+func CopyArtifacts(enabled bool) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.copyArtifacts = enabled
+	}
+}
+
+// SignatureVerifier verifies the signatures of source images before they are copied and swapped
+type SignatureVerifier interface {
+	// Required returns true if the signatures of the image have to be verified
+	Required(ref ctypes.ImageReference) bool
+	// Verify resolves the digest of the image and checks its signatures using the docker auth file,
+	// the verified digest is returned
+	Verify(ctx context.Context, ref ctypes.ImageReference, authFile string) (digest.Digest, error)
+}
+
+// VerifySignatures allows to refuse copying and swapping images which are not signed as required
+func VerifySignatures(verifier SignatureVerifier) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.signatureVerifier = verifier
+	}
+}
+
+// RepositoryRewrites allows to map source repositories to a different path in the target registry
+func RepositoryRewrites(rules []config.RepositoryRewrite) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.repositoryRewrites = newRepositoryRewrites(rules)
+	}
+}
+
+// Replicas allows to replicate the images copied to the target registry to further registries, e.g. in other regions
+func Replicas(region string, replicas []Replica) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.region = region
+		swapper.replicas = newReplicas(replicas)
+	}
+}
+
+// ClusterRegion allows to swap images to the replica of the target registry in the region of the cluster
+func ClusterRegion(region string) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.clusterRegion = region
+	}
+}
+
+// RecordOriginalImages annotates pods with the original images of swapped containers, required by the
+// FallbackController to restore them
+func RecordOriginalImages(enabled bool) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.recordOriginalImages = enabled
+	}
+}
+
+// VulnerabilityPolicy allows to skip or deny swapping to images whose scan findings in the target registry exceed
+// the thresholds, only applies to the "exists" image swap policy
+func VulnerabilityPolicy(policy config.VulnerabilityPolicy, action types.VulnerabilityAction) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.vulnerabilityPolicy = policy
+		swapper.vulnerabilityAction = action
+	}
+}
+
 // ImageSwapper is a mutator that will download images and change the image name.
 type ImageSwapper struct {
 	registryClient          registry.Client
@@ -81,8 +228,69 @@ type ImageSwapper struct {
 	copier            *pond.WorkerPool
 	imageCopyDeadline time.Duration
 
+	// copyQueue orders copies waiting for a worker of the copier by priority
+	copyQueue *copyQueue
+	// copyPriorities assign priorities to copies, the first matching rule applies
+	copyPriorities []config.CopyPriority
+	// namespaceLister provides the namespace labels for the namespace selectors of copy priorities
+	namespaceLister corelisters.NamespaceLister
+
+	// repositoryRewrites map source repositories to repositories in the target registry, the full source repository
+	// is used if no rewrite matches
+	repositoryRewrites []repositoryRewrite
+
+	// targets are additional target registries selected per image, registryClient is used if none matches
+	targets []*targetRegistry
+
+	// region of the target registry and its replicas receiving the images copied to it
+	region   string
+	replicas []*targetRegistry
+	// clusterRegion selects the registry pods are swapped to, the target registry or the replica in this region
+	clusterRegion string
+
+	// platforms limits the platforms copied from manifest lists unless a source platforms rule matches
+	platforms       []string
+	sourcePlatforms []config.SourcePlatforms
+
+	// copyArtifacts enables copying signatures, attestations and OCI referrers of the images
+	copyArtifacts bool
+
+	// signatureVerifier refuses images without the required signatures, all images are accepted if not set
+	signatureVerifier SignatureVerifier
+
+	// vulnerabilityPolicy defines the accepted scan findings of target images, vulnerabilityAction whether to skip the
+	// swap or deny the admission if they are exceeded
+	vulnerabilityPolicy config.VulnerabilityPolicy
+	vulnerabilityAction types.VulnerabilityAction
+
+	// sourceLimiters limit the concurrency and rate of copies per source registry
+	sourceLimiters sourceLimiters
+
+	// copyQueueFullPolicy defines whether to block, drop the copy or reject the admission if the copier is full
+	copyQueueFullPolicy types.ImageCopyQueueFullPolicy
+
+	// copyJobStore persists copy jobs to resume pending and failed copies after a restart
+	copyJobStore queue.Store
+	// copyRetryPolicy defines the backoff and number of attempts for failed image copies
+	copyRetryPolicy queue.RetryPolicy
+
+	// inflightCopies deduplicates concurrent copies of the same target image
+	inflightCopies *inflightCopies
+
 	imageSwapPolicy types.ImageSwapPolicy
 	imageCopyPolicy types.ImageCopyPolicy
+
+	// dryRun reports the intended changes without copying or swapping images
+	dryRun bool
+
+	// mutateWorkloads enables the mutation of pod templates in Deployments, StatefulSets, DaemonSets, Jobs and CronJobs
+	mutateWorkloads bool
+
+	// digestPinning replaces the tag of swapped images with the digest in the target registry
+	digestPinning bool
+
+	// recordOriginalImages annotates pods with the images of the swapped containers for the fallback controller
+	recordOriginalImages bool
 }
 
 // NewImageSwapper returns a new ImageSwapper initialized.
@@ -92,6 +300,10 @@ func NewImageSwapper(registryClient registry.Client, imagePullSecretProvider sec
 		imagePullSecretProvider: imagePullSecretProvider,
 		filters:                 filters,
 		copier:                  pond.New(100, 1000),
+		copyJobStore:            queue.NewMemoryStore(),
+		copyRetryPolicy:         queue.DefaultRetryPolicy,
+		inflightCopies:          newInflightCopies(),
+		copyQueue:               newCopyQueue(),
 		imageSwapPolicy:         imageSwapPolicy,
 		imageCopyPolicy:         imageCopyPolicy,
 		imageCopyDeadline:       imageCopyDeadline,
@@ -106,6 +318,9 @@ func NewImageSwapperWithOpts(registryClient registry.Client, opts ...Option) kwh
 		filters:                 []config.JMESPathFilter{},
 		imageSwapPolicy:         types.ImageSwapPolicyExists,
 		imageCopyPolicy:         types.ImageCopyPolicyDelayed,
+		copyRetryPolicy:         queue.DefaultRetryPolicy,
+		inflightCopies:          newInflightCopies(),
+		copyQueue:               newCopyQueue(),
 	}
 
 	for _, opt := range opts {
@@ -117,11 +332,26 @@ func NewImageSwapperWithOpts(registryClient registry.Client, opts ...Option) kwh
 		swapper.copier = pond.New(100, 1000)
 	}
 
+	if swapper.copyJobStore == nil {
+		swapper.copyJobStore = queue.NewMemoryStore()
+	}
+
+	swapper.copyQueue.limiters = swapper.sourceLimiters
+
+	// dry-run never copies images, the stored jobs are kept for a later run
+	if !swapper.dryRun {
+		swapper.resumeCopyJobs()
+	}
+
 	return swapper
 }
 
 func NewImageSwapperWebhookWithOpts(registryClient registry.Client, opts ...Option) (webhook.Webhook, error) {
-	imageSwapper := NewImageSwapperWithOpts(registryClient, opts...)
+	return NewImageSwapperWebhookFor(NewImageSwapperWithOpts(registryClient, opts...))
+}
+
+// NewImageSwapperWebhookFor returns the webhook of an existing ImageSwapper, e.g. shared with the FallbackController
+func NewImageSwapperWebhookFor(imageSwapper kwhmutating.Mutator) (webhook.Webhook, error) {
 	mt := kwhmutating.MutatorFunc(imageSwapper.Mutate)
 	mcfg := kwhmutating.WebhookConfig{
 		ID:      "k8s-image-swapper",
@@ -129,6 +359,11 @@ func NewImageSwapperWebhookWithOpts(registryClient registry.Client, opts ...Opti
 		Mutator: mt,
 	}
 
+	// infer the object type from the request to receive workload controllers as well
+	if swapper, ok := imageSwapper.(*ImageSwapper); ok && swapper.mutateWorkloads {
+		mcfg.Obj = nil
+	}
+
 	return kwhmutating.NewWebhook(mcfg)
 }
 
@@ -166,7 +401,7 @@ func imageNamesWithDigestOrTag(imageName string) (string, error) {
 
 // Mutate replaces the image ref. Satisfies mutating.Mutator interface.
 func (p *ImageSwapper) Mutate(ctx context.Context, ar *kwhmodel.AdmissionReview, obj metav1.Object) (*kwhmutating.MutatorResult, error) {
-	pod, ok := obj.(*corev1.Pod)
+	podSpec, ok := p.podSpec(obj)
 	if !ok {
 		return &kwhmutating.MutatorResult{}, nil
 	}
@@ -175,106 +410,337 @@ func (p *ImageSwapper) Mutate(ctx context.Context, ar *kwhmodel.AdmissionReview,
 		Str("uid", string(ar.ID)).
 		Str("kind", ar.RequestGVK.String()).
 		Str("namespace", ar.Namespace).
-		Str("name", pod.Name).
+		Str("name", obj.GetName()).
 		Logger()
 
 	lctx := logger.WithContext(context.Background())
 
-	containerSets := []*[]corev1.Container{&pod.Spec.Containers, &pod.Spec.InitContainers}
-	for _, containerSet := range containerSets {
-		containers := *containerSet
-		for i, container := range containers {
-			normalizedName, err := imageNamesWithDigestOrTag(container.Image)
-			if err != nil {
-				log.Ctx(lctx).Warn().Msgf("unable to normalize source name %s: %v", container.Image, err)
-				continue
-			}
+	// image pull secrets are looked up based on a pod, workload controllers provide it via their pod template
+	pod, isPod := obj.(*corev1.Pod)
+	if !isPod {
+		pod = &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: obj.GetName(), Namespace: obj.GetNamespace()},
+			Spec:       *podSpec,
+		}
+		if pod.Namespace == "" {
+			pod.Namespace = ar.Namespace
+		}
+	}
 
-			srcRef, err := alltransports.ParseImageName("docker://" + normalizedName)
-			if err != nil {
-				log.Ctx(lctx).Warn().Msgf("invalid source name %s: %v", normalizedName, err)
-				continue
-			}
+	var dryRunActions []dryRunAction
+	var warnings []string
 
-			// skip if the source originates from the target registry
-			if p.registryClient.IsOrigin(srcRef) {
-				log.Ctx(lctx).Debug().Str("registry", srcRef.DockerReference().String()).Msg("skip due to source and target being the same registry")
-				continue
-			}
+	// the original images are recorded for the fallback controller, containers restored by it are not swapped again
+	swappedImages := map[string]string{}
+	restored := fallbackContainers(obj)
 
-			filterCtx := NewFilterContext(*ar, pod, container)
-			if filterMatch(filterCtx, p.filters) {
-				log.Ctx(lctx).Debug().Msg("skip due to filter condition")
-				continue
-			}
+	for _, containerImage := range p.containerImages(ar, podSpec) {
+		container := containerImage.container
 
-			targetRef := p.targetRef(srcRef)
-			targetImage := targetRef.DockerReference().String()
-
-			imageCopierLogger := logger.With().
-				Str("source-image", srcRef.DockerReference().String()).
-				Str("target-image", targetImage).
-				Logger()
-
-			imageCopierContext := imageCopierLogger.WithContext(lctx)
-			// create an object responsible for the image copy
-			imageCopier := ImageCopier{
-				sourcePod:       pod,
-				sourceImageRef:  srcRef,
-				targetImageRef:  targetRef,
-				imagePullPolicy: container.ImagePullPolicy,
-				imageSwapper:    p,
-				context:         imageCopierContext,
-			}
+		if restored[container.Name] {
+			log.Ctx(lctx).Debug().Str("container", container.Name).Msg("skip due to fallback to the original image")
+			continue
+		}
+
+		normalizedName, err := imageNamesWithDigestOrTag(container.Image)
+		if err != nil {
+			log.Ctx(lctx).Warn().Msgf("unable to normalize source name %s: %v", container.Image, err)
+			continue
+		}
+
+		srcRef, err := alltransports.ParseImageName("docker://" + normalizedName)
+		if err != nil {
+			log.Ctx(lctx).Warn().Msgf("invalid source name %s: %v", normalizedName, err)
+			continue
+		}
+
+		// skip if the source originates from one of the target registries
+		if p.isOrigin(srcRef) {
+			log.Ctx(lctx).Debug().Str("registry", srcRef.DockerReference().String()).Msg("skip due to source and target being the same registry")
+			continue
+		}
+
+		filterCtx := NewFilterContext(*ar, obj, container)
+		if filterMatch(filterCtx, p.filters) {
+			log.Ctx(lctx).Debug().Msg("skip due to filter condition")
+			continue
+		}
+
+		target := p.selectTarget(filterCtx)
+		targetRef := target.targetRef(srcRef)
+		targetImage := targetRef.DockerReference().String()
+
+		// images are copied to the target registry and replicated, pods are swapped to the nearest registry
+		swapTarget, swapRef := target.nearest(p.clusterRegion, targetRef)
+		swapImage := swapRef.DockerReference().String()
+
+		if p.dryRun {
+			dryRunActions = append(dryRunActions, p.dryRunAction(lctx, swapTarget, container, srcRef, swapRef))
+			continue
+		}
+
+		imageCopierLogger := logger.With().
+			Str("source-image", srcRef.DockerReference().String()).
+			Str("target-image", targetImage).
+			Logger()
+
+		imageCopierContext := imageCopierLogger.WithContext(lctx)
+		// create an object responsible for the image copy
+		imageCopier := ImageCopier{
+			sourcePod:       pod,
+			sourceImageRef:  srcRef,
+			targetImageRef:  targetRef,
+			imagePullPolicy: container.ImagePullPolicy,
+			imageSwapper:    p,
+			target:          target,
+			context:         imageCopierContext,
+			job:             newCopyJob(pod, container, srcRef, targetRef),
+		}
+		imageCopier.job.Priority = p.copyPriority(filterCtx)
+		imageCopier.job.Platforms = p.copyPlatforms(filterCtx, target)
+
+		if err := p.verifySignature(&imageCopier); err != nil {
+			log.Ctx(imageCopierContext).Warn().Err(err).Msg("image neither copied nor swapped")
+			warnings = append(warnings, fmt.Sprintf("image %s not swapped: %s", container.Image, err.Error()))
+			continue
+		}
 
-			// imageCopyPolicy
-			switch p.imageCopyPolicy {
-			case types.ImageCopyPolicyDelayed:
-				p.copier.Submit(imageCopier.start)
-			case types.ImageCopyPolicyImmediate:
-				p.copier.SubmitAndWait(imageCopier.withDeadline().start)
-			case types.ImageCopyPolicyForce:
-				imageCopier.withDeadline().start()
-			case types.ImageCopyPolicyNone:
-				// do not copy image
-			default:
-				panic("unknown imageCopyPolicy")
+		if err := p.copyImage(lctx, &imageCopier); err != nil {
+			return nil, err
+		}
+
+		// imageSwapPolicy
+		switch p.imageSwapPolicy {
+		case types.ImageSwapPolicyAlways:
+			swapImage = p.pinnedImage(lctx, swapTarget, swapRef)
+			log.Ctx(lctx).Debug().Str("image", swapImage).Msg("set new container image")
+			*containerImage.image = swapImage
+			swappedImages[container.Name] = container.Image
+		case types.ImageSwapPolicyExists:
+			if !swapTarget.client.ImageExists(lctx, swapRef) {
+				log.Ctx(lctx).Debug().Str("image", swapImage).Msg("container image not found in target registry, not swapping")
+				break
 			}
 
-			// imageSwapPolicy
-			switch p.imageSwapPolicy {
-			case types.ImageSwapPolicyAlways:
-				log.Ctx(lctx).Debug().Str("image", targetImage).Msg("set new container image")
-				containers[i].Image = targetImage
-			case types.ImageSwapPolicyExists:
-				if p.registryClient.ImageExists(lctx, targetRef) {
-					log.Ctx(lctx).Debug().Str("image", targetImage).Msg("set new container image")
-					containers[i].Image = targetImage
-				} else {
-					log.Ctx(lctx).Debug().Str("image", targetImage).Msg("container image not found in target registry, not swapping")
+			if err := p.checkVulnerabilities(imageCopierContext, swapTarget, swapRef); err != nil {
+				vulnerableImages.WithLabelValues(p.vulnerabilityAction.String()).Inc()
+				if p.vulnerabilityAction == types.VulnerabilityActionDeny {
+					log.Ctx(imageCopierContext).Warn().Err(err).Msg("rejecting admission")
+					return nil, fmt.Errorf("image %s: %w", swapImage, err)
 				}
-			default:
-				panic("unknown imageSwapPolicy")
+				log.Ctx(imageCopierContext).Warn().Err(err).Msg("not swapping")
+				warnings = append(warnings, fmt.Sprintf("image %s not swapped: %s", container.Image, err.Error()))
+				break
 			}
+
+			swapImage = p.pinnedImage(lctx, swapTarget, swapRef)
+			log.Ctx(lctx).Debug().Str("image", swapImage).Msg("set new container image")
+			*containerImage.image = swapImage
+			swappedImages[container.Name] = container.Image
+		default:
+			panic("unknown imageSwapPolicy")
+		}
+	}
+
+	// ephemeral containers cannot be restored and the metadata is not updated via the sub-resource
+	if p.recordOriginalImages && len(swappedImages) > 0 && subResource(ar) != ephemeralContainersSubResource {
+		if err := annotateOriginalImages(obj, swappedImages); err != nil {
+			log.Ctx(lctx).Err(err).Msg("could not annotate pod with original images")
 		}
 	}
 
-	return &kwhmutating.MutatorResult{MutatedObject: pod}, nil
+	if p.dryRun && len(dryRunActions) > 0 {
+		if err := annotateDryRun(obj, dryRunActions); err != nil {
+			log.Ctx(lctx).Err(err).Msg("could not annotate pod with dry-run actions")
+		}
+	}
+
+	return &kwhmutating.MutatorResult{MutatedObject: obj, Warnings: warnings}, nil
 }
 
-// filterMatch returns true if one of the filters matches the context
-func filterMatch(ctx FilterContext, filters []config.JMESPathFilter) bool {
-	// Simplify FilterContext to be easier searchable by marshaling it to JSON and back to an interface
-	var filterContext interface{}
-	jsonBlob, err := json.Marshal(ctx)
+// verifySignature checks the signatures of the source image within the image copy deadline.
+// Images present in the target registry are not verified again as they were verified when copied,
+// copies pulling them again verify them before copying.
+func (p *ImageSwapper) verifySignature(imageCopier *ImageCopier) error {
+	if p.signatureVerifier == nil || !p.signatureVerifier.Required(imageCopier.sourceImageRef) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(imageCopier.context, p.imageCopyDeadline)
+	defer cancel()
+
+	if imageCopier.imagePullPolicy != corev1.PullAlways && imageCopier.target.client.ImageExists(ctx, imageCopier.targetImageRef) {
+		log.Ctx(ctx).Debug().Msg("image present in target registry, skipping signature verification")
+		return nil
+	}
+
+	err := imageCopier.verifySignature(ctx)
 	if err != nil {
-		log.Err(err).Msg("could not marshal filter context")
+		signatureVerificationFailures.Inc()
+	}
+	return err
+}
+
+// copyImage copies the image according to the image copy policy. Concurrent requests for the same target image share
+// a single copy, the "immediate" and "force" policies wait for the result of the running copy.
+// An error is only returned if the copy queue is full and the admission should be rejected.
+func (p *ImageSwapper) copyImage(ctx context.Context, imageCopier *ImageCopier) error {
+	if p.imageCopyPolicy == types.ImageCopyPolicyNone {
+		// do not copy image
+		return nil
+	}
+
+	running, owner := p.inflightCopies.start(imageCopier.job.TargetImage)
+	if !owner {
+		log.Ctx(imageCopier.context).Debug().Msg("image copy already in progress, joining")
+		deduplicatedImageCopies.Inc()
+
+		if p.imageCopyPolicy == types.ImageCopyPolicyDelayed {
+			return nil
+		}
+
+		waitCtx, cancel := context.WithTimeout(ctx, p.imageCopyDeadline)
+		defer cancel()
+		if err := running.wait(waitCtx); err != nil {
+			log.Ctx(imageCopier.context).Debug().Err(err).Msg("joined image copy did not succeed")
+		}
+		return nil
+	}
+
+	imageCopier.inflight = running
+
+	// immediate and forced copies are only persisted once they failed and are retried
+	imageCopier.persist = p.imageCopyPolicy == types.ImageCopyPolicyDelayed
+
+	switch p.imageCopyPolicy {
+	case types.ImageCopyPolicyDelayed:
+		if !p.submitCopy(&copyTask{class: copyClassDelayed, priority: imageCopier.job.Priority, run: imageCopier.start, source: imageCopier.sourceDomain(), job: &imageCopier.job}) {
+			return p.copyQueueFull(imageCopier)
+		}
+	case types.ImageCopyPolicyImmediate:
+		done := make(chan struct{})
+		imageCopier.withDeadline()
+		if !p.submitCopy(&copyTask{class: copyClassImmediate, priority: imageCopier.job.Priority, source: imageCopier.sourceDomain(), run: func() {
+			defer close(done)
+			imageCopier.start()
+		}}) {
+			imageCopier.cancelContext()
+			return p.copyQueueFull(imageCopier)
+		}
+		<-done
+	case types.ImageCopyPolicyForce:
+		imageCopier.withDeadline().start()
+	default:
+		panic("unknown imageCopyPolicy")
+	}
+
+	return nil
+}
+
+// submitCopy queues the task by priority and submits it to the copier according to the copy queue full policy,
+// false is returned if the task was not accepted
+func (p *ImageSwapper) submitCopy(task *copyTask) bool {
+	if p.copyQueueFullPolicy != types.ImageCopyQueueFullPolicyBlock {
+		return p.trySubmitCopy(task)
+	}
+
+	// the copier runs the queued task with the highest priority once a worker is available
+	if !p.submitBlocking(p.copyQueue.runNext) {
 		return false
 	}
+	p.copyQueue.push(task)
 
-	err = json.Unmarshal(jsonBlob, &filterContext)
+	return true
+}
+
+// submitBlocking submits the task to the copier and waits for capacity,
+// false is returned if the copier is stopped, e.g. by admissions or retries running during the shutdown
+func (p *ImageSwapper) submitBlocking(task func()) (submitted bool) {
+	defer func() {
+		// the copier may be stopped after the check below
+		if r := recover(); r != nil {
+			if r != pond.ErrSubmitOnStoppedPool {
+				panic(r)
+			}
+			submitted = false
+		}
+	}()
+
+	if p.copier.Stopped() {
+		return false
+	}
+	p.copier.Submit(task)
+
+	return true
+}
+
+// trySubmitCopy queues the task by priority unless the copier is full or stopped
+func (p *ImageSwapper) trySubmitCopy(task *copyTask) bool {
+	if !p.copier.TrySubmit(p.copyQueue.runNext) {
+		return false
+	}
+
+	p.copyQueue.push(task)
+
+	return true
+}
+
+// copyQueueFull discards an image copy which was not accepted by the copier, unless the copier is stopped.
+// an error is returned if the admission should be rejected
+func (p *ImageSwapper) copyQueueFull(imageCopier *ImageCopier) error {
+	droppedImageCopies.Inc()
+	p.inflightCopies.finish(imageCopier.job.TargetImage, imageCopier.inflight, ErrCopyQueueFull)
+
+	// delayed copies are persisted and resumed after the restart
+	if p.copier.Stopped() {
+		if imageCopier.persist && p.saveCopyJob(imageCopier.context, imageCopier.job) {
+			log.Ctx(imageCopier.context).Warn().Msg("image copier is stopped, copy resumes after the restart")
+		} else {
+			log.Ctx(imageCopier.context).Warn().Msg("image copier is stopped, dropping image copy")
+		}
+		return nil
+	}
+
+	if p.copyQueueFullPolicy == types.ImageCopyQueueFullPolicyReject {
+		log.Ctx(imageCopier.context).Warn().Msg("image copy queue is full, rejecting admission")
+		return fmt.Errorf("copying image %s: %w", imageCopier.job.TargetImage, ErrCopyQueueFull)
+	}
+
+	log.Ctx(imageCopier.context).Warn().Msg("image copy queue is full, dropping image copy")
+	return nil
+}
+
+// podSpec returns the pod spec of pods and, if enabled, the pod template spec of workload controllers
+func (p *ImageSwapper) podSpec(obj metav1.Object) (*corev1.PodSpec, bool) {
+	if pod, ok := obj.(*corev1.Pod); ok {
+		return &pod.Spec, true
+	}
+
+	if !p.mutateWorkloads {
+		return nil, false
+	}
+
+	switch workload := obj.(type) {
+	case *appsv1.Deployment:
+		return &workload.Spec.Template.Spec, true
+	case *appsv1.StatefulSet:
+		return &workload.Spec.Template.Spec, true
+	case *appsv1.DaemonSet:
+		return &workload.Spec.Template.Spec, true
+	case *batchv1.Job:
+		return &workload.Spec.Template.Spec, true
+	case *batchv1.CronJob:
+		return &workload.Spec.JobTemplate.Spec.Template.Spec, true
+	default:
+		return nil, false
+	}
+}
+
+// filterMatch returns true if one of the filters matches the context
+func filterMatch(ctx FilterContext, filters []config.JMESPathFilter) bool {
+	filterContext, err := ctx.searchable()
 	if err != nil {
-		log.Err(err).Msg("could not unmarshal json blob")
+		log.Err(err).Msg("could not generate filter context")
 		return false
 	}
 
@@ -302,9 +768,22 @@ func filterMatch(ctx FilterContext, filters []config.JMESPathFilter) bool {
 	return false
 }
 
-// targetName returns the reference in the target repository
-func (p *ImageSwapper) targetRef(srcRef ctypes.ImageReference) ctypes.ImageReference {
-	targetImage := fmt.Sprintf("%s/%s", p.registryClient.Endpoint(), srcRef.DockerReference().String())
+// targetRef returns the reference in the target repository, the tag or digest of the source is kept
+func (t *targetRegistry) targetRef(srcRef ctypes.ImageReference) ctypes.ImageReference {
+	srcImage := srcRef.DockerReference().String()
+	repository := reference.TrimNamed(srcRef.DockerReference()).String()
+
+	if targetRepository := t.targetRepository(repository); targetRepository != repository {
+		targetImage := fmt.Sprintf("%s/%s%s", t.client.Endpoint(), targetRepository, strings.TrimPrefix(srcImage, repository))
+
+		ref, err := alltransports.ParseImageName("docker://" + targetImage)
+		if err == nil {
+			return ref
+		}
+		log.Warn().Msgf("invalid rewritten target name %s, keeping source repository: %v", targetImage, err)
+	}
+
+	targetImage := fmt.Sprintf("%s/%s", t.client.Endpoint(), srcImage)
 
 	ref, err := alltransports.ParseImageName("docker://" + targetImage)
 	if err != nil {
@@ -314,15 +793,54 @@ func (p *ImageSwapper) targetRef(srcRef ctypes.ImageReference) ctypes.ImageRefer
 	return ref
 }
 
+// pinnedImage returns the target image pinned to its digest in the target registry if digest pinning is enabled.
+// The tag is kept if the digest cannot be determined, e.g. the image has not been copied yet.
+func (p *ImageSwapper) pinnedImage(ctx context.Context, target *targetRegistry, targetRef ctypes.ImageReference) string {
+	targetImage := targetRef.DockerReference().String()
+	if !p.digestPinning {
+		return targetImage
+	}
+
+	if _, isDigested := targetRef.DockerReference().(reference.Canonical); isDigested {
+		return targetImage
+	}
+
+	imageDigest, err := target.client.ImageDigest(ctx, targetRef)
+	if err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("image", targetImage).Msg("unable to determine digest, not pinning image")
+		return targetImage
+	}
+
+	pinnedRef, err := reference.WithDigest(reference.TrimNamed(targetRef.DockerReference()), imageDigest)
+	if err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("image", targetImage).Msg("invalid digest, not pinning image")
+		return targetImage
+	}
+
+	return pinnedRef.String()
+}
+
 // FilterContext is being used by JMESPath to search and match
 type FilterContext struct {
-	// Obj contains the object submitted to the webhook (currently only pods)
+	// Obj contains the object submitted to the webhook, a pod or a workload controller
 	Obj metav1.Object `json:"obj,omitempty"`
 
 	// Container contains the currently processed container
 	Container corev1.Container `json:"container,omitempty"`
 }
 
+// searchable simplifies the FilterContext to be easier searchable by marshaling it to JSON and back to an interface
+func (ctx FilterContext) searchable() (interface{}, error) {
+	var filterContext interface{}
+	jsonBlob, err := json.Marshal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(jsonBlob, &filterContext)
+	return filterContext, err
+}
+
 func NewFilterContext(request kwhmodel.AdmissionReview, obj metav1.Object, container corev1.Container) FilterContext {
 	if obj.GetNamespace() == "" {
 		obj.SetNamespace(request.Namespace)
@@ -3,22 +3,35 @@ package webhook
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/alitto/pond"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/containers/image/v5/docker/reference"
+	ctypes "github.com/containers/image/v5/types"
 	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/queue"
 	"github.com/estahn/k8s-image-swapper/pkg/registry"
 	"github.com/estahn/k8s-image-swapper/pkg/secrets"
 	"github.com/estahn/k8s-image-swapper/pkg/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/slok/kubewebhook/v2/pkg/model"
+	"github.com/slok/kubewebhook/v2/pkg/webhook"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
@@ -423,3 +436,1095 @@ func TestImageSwapper_GAR_Mutate(t *testing.T) {
 	assert.Nil(t, resp.(*model.MutatingAdmissionResponse).Warnings)
 	assert.NoError(t, err, "Webhook executed without errors")
 }
+
+// reviewFile sends the admission review read from the file to the webhook, the pod is replaced by the given one if set
+func reviewFile(t *testing.T, wh webhook.Webhook, file string, pod string) (*model.MutatingAdmissionResponse, error) {
+	t.Helper()
+
+	admissionReview, err := readAdmissionReviewFromFile(file)
+	require.NoError(t, err)
+	if pod != "" {
+		admissionReview.Request.Object.Raw = []byte(pod)
+	}
+
+	resp, err := wh.Review(context.Background(), model.NewAdmissionReviewV1(admissionReview))
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*model.MutatingAdmissionResponse), nil
+}
+
+// reviewPod sends the simple admission review to the webhook, the pod is replaced by the given one if set
+func reviewPod(t *testing.T, wh webhook.Webhook, pod string) (*model.MutatingAdmissionResponse, error) {
+	return reviewFile(t, wh, "admissionreview-simple.json", pod)
+}
+
+func TestImageSwapper_InMemory_Mutate(t *testing.T) {
+	tests := []struct {
+		name             string
+		file             string
+		images           []string
+		opts             []Option
+		expected         string
+		wantRepositories []string
+		wantSources      map[string]string
+	}{
+		{
+			name: "immediate copy",
+			expected: `[
+				{"op":"replace","path":"/spec/initContainers/0/image","value":"registry.example.com/docker.io/library/init-container:latest"},
+				{"op":"replace","path":"/spec/containers/0/image","value":"registry.example.com/docker.io/library/nginx:latest"},
+				{"op":"replace","path":"/spec/containers/1/image","value":"registry.example.com/k8s.gcr.io/ingress-nginx/controller@sha256:9bba603b99bf25f6d117cf1235b6598c16033ad027b143c90fa5b3cc583c5713"},
+				{"op":"replace","path":"/spec/containers/2/image","value":"registry.example.com/123456789.dkr.ecr.ap-southeast-2.amazonaws.com/k8s.gcr.io/ingress-nginx/controller@sha256:9bba603b99bf25f6d117cf1235b6598c16033ad027b143c90fa5b3cc583c5713"},
+				{"op":"replace","path":"/spec/containers/3/image","value":"registry.example.com/us-central1-docker.pkg.dev/gcp-project-123/main/k8s.gcr.io/ingress-nginx/controller@sha256:9bba603b99bf25f6d117cf1235b6598c16033ad027b143c90fa5b3cc583c5713"}
+			]`,
+			wantRepositories: []string{
+				"123456789.dkr.ecr.ap-southeast-2.amazonaws.com/k8s.gcr.io/ingress-nginx/controller",
+				"docker.io/library/init-container",
+				"docker.io/library/nginx",
+				"k8s.gcr.io/ingress-nginx/controller",
+				"us-central1-docker.pkg.dev/gcp-project-123/main/k8s.gcr.io/ingress-nginx/controller",
+			},
+			wantSources: map[string]string{
+				"registry.example.com/docker.io/library/nginx:latest": "docker.io/library/nginx:latest",
+			},
+		},
+		{
+			// only the image present in the target registry is swapped
+			name:   "exists policy",
+			images: []string{"registry.example.com/docker.io/library/nginx:latest"},
+			opts:   []Option{ImageCopyPolicy(types.ImageCopyPolicyNone)},
+			expected: `[
+				{"op":"replace","path":"/spec/containers/0/image","value":"registry.example.com/docker.io/library/nginx:latest"}
+			]`,
+		},
+		{
+			// tagged images are pinned to the copied digest, digested images are kept as they are
+			name: "digest pinning",
+			opts: []Option{DigestPinning(true)},
+			expected: `[
+				{"op":"replace","path":"/spec/initContainers/0/image","value":"registry.example.com/docker.io/library/init-container@` + digest.FromString("docker.io/library/init-container:latest").String() + `"},
+				{"op":"replace","path":"/spec/containers/0/image","value":"registry.example.com/docker.io/library/nginx@` + digest.FromString("docker.io/library/nginx:latest").String() + `"},
+				{"op":"replace","path":"/spec/containers/1/image","value":"registry.example.com/k8s.gcr.io/ingress-nginx/controller@sha256:9bba603b99bf25f6d117cf1235b6598c16033ad027b143c90fa5b3cc583c5713"},
+				{"op":"replace","path":"/spec/containers/2/image","value":"registry.example.com/123456789.dkr.ecr.ap-southeast-2.amazonaws.com/k8s.gcr.io/ingress-nginx/controller@sha256:9bba603b99bf25f6d117cf1235b6598c16033ad027b143c90fa5b3cc583c5713"},
+				{"op":"replace","path":"/spec/containers/3/image","value":"registry.example.com/us-central1-docker.pkg.dev/gcp-project-123/main/k8s.gcr.io/ingress-nginx/controller@sha256:9bba603b99bf25f6d117cf1235b6598c16033ad027b143c90fa5b3cc583c5713"}
+			]`,
+			wantRepositories: []string{
+				"123456789.dkr.ecr.ap-southeast-2.amazonaws.com/k8s.gcr.io/ingress-nginx/controller",
+				"docker.io/library/init-container",
+				"docker.io/library/nginx",
+				"k8s.gcr.io/ingress-nginx/controller",
+				"us-central1-docker.pkg.dev/gcp-project-123/main/k8s.gcr.io/ingress-nginx/controller",
+			},
+		},
+		{
+			name: "deployment",
+			file: "admissionreview-deployment.json",
+			opts: []Option{MutateWorkloads(true)},
+			expected: `[
+				{"op":"replace","path":"/spec/template/spec/initContainers/0/image","value":"registry.example.com/docker.io/library/init-container:latest"},
+				{"op":"replace","path":"/spec/template/spec/containers/0/image","value":"registry.example.com/docker.io/library/nginx:latest"}
+			]`,
+			wantRepositories: []string{"docker.io/library/init-container", "docker.io/library/nginx"},
+		},
+		{
+			name: "cronjob",
+			file: "admissionreview-cronjob.json",
+			opts: []Option{MutateWorkloads(true)},
+			expected: `[
+				{"op":"replace","path":"/spec/jobTemplate/spec/template/spec/containers/0/image","value":"registry.example.com/docker.io/library/busybox:1.36"}
+			]`,
+			wantRepositories: []string{"docker.io/library/busybox"},
+		},
+		{
+			// only the ephemeral container being added is swapped
+			name: "ephemeral containers",
+			file: "admissionreview-ephemeralcontainers.json",
+			expected: `[
+				{"op":"replace","path":"/spec/ephemeralContainers/1/image","value":"registry.example.com/docker.io/library/busybox:1.36"}
+			]`,
+			wantRepositories: []string{"docker.io/library/busybox"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registryClient := registry.NewInMemoryClient("registry.example.com")
+			for _, image := range test.images {
+				registryClient.AddImage(image, registry.InMemoryImage{})
+			}
+
+			opts := append([]Option{
+				ImageSwapPolicy(types.ImageSwapPolicyExists),
+				ImageCopyPolicy(types.ImageCopyPolicyImmediate),
+				ImageCopyDeadline(8 * time.Second),
+			}, test.opts...)
+			wh, err := NewImageSwapperWebhookWithOpts(registryClient, opts...)
+			require.NoError(t, err)
+
+			file := test.file
+			if file == "" {
+				file = "admissionreview-simple.json"
+			}
+			resp, err := reviewFile(t, wh, file, "")
+			require.NoError(t, err)
+
+			assert.JSONEq(t, test.expected, string(resp.JSONPatchPatch))
+			if test.wantRepositories == nil {
+				assert.Empty(t, registryClient.Repositories())
+			} else {
+				assert.Equal(t, test.wantRepositories, registryClient.Repositories())
+			}
+			for target, source := range test.wantSources {
+				image, found := registryClient.Image(target)
+				assert.True(t, found)
+				assert.Equal(t, source, image.Source)
+			}
+		})
+	}
+}
+
+func TestImageSwapper_InMemory_MutateDryRun(t *testing.T) {
+	registryClient := registry.NewInMemoryClient("registry.example.com")
+	registryClient.AddImage("registry.example.com/docker.io/library/nginx:latest", registry.InMemoryImage{})
+
+	wh, err := NewImageSwapperWebhookWithOpts(
+		registryClient,
+		ImageSwapPolicy(types.ImageSwapPolicyExists),
+		ImageCopyPolicy(types.ImageCopyPolicyImmediate),
+		DryRun(true),
+	)
+
+	assert.NoError(t, err, "NewImageSwapperWebhookWithOpts executed without errors")
+
+	swaps := testutil.ToFloat64(dryRunImageSwaps)
+	copies := testutil.ToFloat64(dryRunImageCopies)
+
+	resp, err := reviewPod(t, wh, "")
+	assert.NoError(t, err, "Webhook executed without errors")
+
+	// the pod is only annotated, images are not swapped
+	var patch []struct {
+		Op    string            `json:"op"`
+		Path  string            `json:"path"`
+		Value map[string]string `json:"value"`
+	}
+	require.NoError(t, json.Unmarshal(resp.JSONPatchPatch, &patch))
+	require.Len(t, patch, 1)
+	assert.Equal(t, "/metadata/annotations", patch[0].Path)
+
+	var actions []dryRunAction
+	require.NoError(t, json.Unmarshal([]byte(patch[0].Value[dryRunAnnotation]), &actions))
+	require.Len(t, actions, 5)
+	assert.Equal(t, dryRunAction{
+		Container:   "nginx28",
+		Image:       "nginx",
+		TargetImage: "registry.example.com/docker.io/library/nginx:latest",
+		Swap:        true,
+		Copy:        false,
+	}, actions[0])
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(dryRunImageSwaps)-swaps)
+	assert.Equal(t, float64(4), testutil.ToFloat64(dryRunImageCopies)-copies)
+
+	// nothing is copied
+	assert.Empty(t, registryClient.Repositories())
+	assert.Len(t, registryClient.Images(), 1)
+}
+
+func TestImageSwapper_MutateWorkloadsDisabled(t *testing.T) {
+	registryClient := registry.NewInMemoryClient("registry.example.com")
+	swapper := NewImageSwapperWithOpts(registryClient, ImageSwapPolicy(types.ImageSwapPolicyAlways))
+
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: "nginx"}}},
+			},
+		},
+	}
+
+	result, err := swapper.Mutate(context.Background(), &model.AdmissionReview{}, deployment)
+
+	assert.NoError(t, err)
+	assert.Nil(t, result.MutatedObject)
+	assert.Equal(t, "nginx", deployment.Spec.Template.Spec.Containers[0].Image)
+}
+
+func TestImageSwapper_InMemory_MutateCopyJobs(t *testing.T) {
+	registryClient := registry.NewInMemoryClient("registry.example.com")
+	store := queue.NewMemoryStore()
+
+	wh, err := NewImageSwapperWebhookWithOpts(
+		registryClient,
+		ImageSwapPolicy(types.ImageSwapPolicyExists),
+		ImageCopyPolicy(types.ImageCopyPolicyImmediate),
+		ImageCopyDeadline(8*time.Second),
+		CopyJobStore(store),
+	)
+	require.NoError(t, err)
+
+	_, err = reviewPod(t, wh, "")
+	require.NoError(t, err)
+
+	// immediate copies are not persisted unless they failed
+	jobs, err := store.List(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, jobs)
+}
+
+// countingStore counts the writes to the store
+type countingStore struct {
+	queue.Store
+	writes atomic.Int32
+}
+
+func (c *countingStore) Save(ctx context.Context, job queue.Job) error {
+	c.writes.Add(1)
+	return c.Store.Save(ctx, job)
+}
+
+func (c *countingStore) Delete(ctx context.Context, id string) error {
+	c.writes.Add(1)
+	return c.Store.Delete(ctx, id)
+}
+
+func TestImageSwapper_InMemory_MutateCopyJobsPresent(t *testing.T) {
+	registryClient := registry.NewInMemoryClient("registry.example.com")
+	registryClient.AddImage("registry.example.com/docker.io/library/nginx:latest", registry.InMemoryImage{})
+	store := &countingStore{Store: queue.NewMemoryStore()}
+	copier := pond.New(1, 10)
+
+	wh, err := NewImageSwapperWebhookWithOpts(
+		registryClient,
+		ImageSwapPolicy(types.ImageSwapPolicyExists),
+		ImageCopyPolicy(types.ImageCopyPolicyDelayed),
+		Copier(copier),
+		CopyJobStore(store),
+	)
+	require.NoError(t, err)
+
+	_, err = reviewPod(t, wh, `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"nginx"},"spec":{"containers":[{"name":"nginx","image":"nginx"}]}}`)
+	require.NoError(t, err)
+	copier.StopAndWait()
+
+	assert.Zero(t, store.writes.Load(), "copies of present images are not persisted")
+}
+
+func TestImageSwapper_InMemory_PersistQueuedCopies(t *testing.T) {
+	registryClient := &blockingRegistryClient{
+		InMemoryClient: registry.NewInMemoryClient("registry.example.com"),
+		release:        make(chan struct{}),
+	}
+	store := queue.NewMemoryStore()
+	copier := pond.New(1, 10)
+
+	imageSwapper := NewImageSwapperWithOpts(
+		registryClient,
+		ImageSwapPolicy(types.ImageSwapPolicyExists),
+		ImageCopyPolicy(types.ImageCopyPolicyDelayed),
+		Copier(copier),
+		CopyJobStore(store),
+	).(*ImageSwapper)
+	wh, err := NewImageSwapperWebhookFor(imageSwapper)
+	require.NoError(t, err)
+
+	_, err = reviewPod(t, wh, "")
+	require.NoError(t, err)
+
+	// one copy is running, the others are queued
+	assert.Eventually(t, func() bool {
+		jobs, _ := store.List(context.Background())
+		return len(jobs) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	imageSwapper.PersistQueuedCopies(context.Background())
+
+	jobs, err := store.List(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, jobs, 5, "queued copies are resumed after the restart")
+
+	close(registryClient.release)
+	copier.StopAndWait()
+}
+
+func TestImageSwapper_InMemory_MutateCopyJobsFailed(t *testing.T) {
+	registryClient := registry.NewInMemoryClient("registry.example.com")
+	registryClient.SetCopyError(errors.New("registry unavailable"))
+	store := queue.NewMemoryStore()
+
+	wh, err := NewImageSwapperWebhookWithOpts(
+		registryClient,
+		ImageSwapPolicy(types.ImageSwapPolicyExists),
+		ImageCopyPolicy(types.ImageCopyPolicyImmediate),
+		ImageCopyDeadline(8*time.Second),
+		CopyJobStore(store),
+	)
+	require.NoError(t, err)
+
+	_, err = reviewPod(t, wh, "")
+	require.NoError(t, err)
+
+	jobs, err := store.List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, jobs, 5)
+
+	for _, job := range jobs {
+		assert.Equal(t, queue.JobID(job.TargetImage), job.ID)
+		assert.Equal(t, "default", job.Namespace)
+		assert.Equal(t, 1, job.Attempts)
+		assert.Contains(t, job.LastError, "registry unavailable")
+	}
+}
+
+func TestImageSwapper_ResumeCopyJobs(t *testing.T) {
+	registryClient := registry.NewInMemoryClient("registry.example.com")
+	store := queue.NewMemoryStore()
+
+	job := queue.Job{
+		ID:          queue.JobID("registry.example.com/docker.io/library/nginx:latest"),
+		SourceImage: "docker.io/library/nginx:latest",
+		TargetImage: "registry.example.com/docker.io/library/nginx:latest",
+		Namespace:   "test-ns",
+		Attempts:    1,
+		CreatedAt:   time.Now(),
+	}
+	require.NoError(t, store.Save(context.Background(), job))
+
+	copier := pond.New(1, 1)
+	NewImageSwapperWithOpts(registryClient, Copier(copier), CopyJobStore(store))
+	copier.StopAndWait()
+
+	image, found := registryClient.Image("registry.example.com/docker.io/library/nginx:latest")
+	assert.True(t, found)
+	assert.Equal(t, "docker.io/library/nginx:latest", image.Source)
+
+	jobs, err := store.List(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, jobs)
+}
+
+func TestImageSwapper_ResumeCopyJobsDryRun(t *testing.T) {
+	registryClient := registry.NewInMemoryClient("registry.example.com")
+	store := queue.NewMemoryStore()
+
+	job := queue.Job{
+		ID:          queue.JobID("registry.example.com/docker.io/library/nginx:latest"),
+		SourceImage: "docker.io/library/nginx:latest",
+		TargetImage: "registry.example.com/docker.io/library/nginx:latest",
+		Namespace:   "test-ns",
+		Attempts:    1,
+		CreatedAt:   time.Now(),
+	}
+	require.NoError(t, store.Save(context.Background(), job))
+
+	copier := pond.New(1, 1)
+	NewImageSwapperWithOpts(registryClient, Copier(copier), CopyJobStore(store), DryRun(true))
+	copier.StopAndWait()
+
+	_, found := registryClient.Image("registry.example.com/docker.io/library/nginx:latest")
+	assert.False(t, found, "images are not copied in dry-run")
+
+	jobs, err := store.List(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, jobs, 1, "the job is kept for a later run")
+}
+
+func TestImageSwapper_ScheduleCopyJobInflight(t *testing.T) {
+	tests := []struct {
+		name       string
+		result     error
+		wantCopied bool
+	}{
+		{name: "copied by the running copy", result: nil},
+		{name: "running copy dropped", result: ErrCopyQueueFull, wantCopied: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registryClient := registry.NewInMemoryClient("registry.example.com")
+			store := queue.NewMemoryStore()
+			copier := pond.New(1, 1)
+
+			imageSwapper := NewImageSwapperWithOpts(registryClient, Copier(copier), CopyJobStore(store),
+				CopyRetryPolicy(queue.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}),
+			).(*ImageSwapper)
+
+			job := queue.Job{
+				ID:          queue.JobID("registry.example.com/docker.io/library/nginx:latest"),
+				SourceImage: "docker.io/library/nginx:latest",
+				TargetImage: "registry.example.com/docker.io/library/nginx:latest",
+				CreatedAt:   time.Now(),
+			}
+			require.NoError(t, store.Save(context.Background(), job))
+
+			// another copy of the image is running while the job is scheduled
+			running, owner := imageSwapper.inflightCopies.start(job.TargetImage)
+			require.True(t, owner)
+			imageSwapper.scheduleCopyJob(job, 0)
+			imageSwapper.inflightCopies.finish(job.TargetImage, running, test.result)
+
+			assert.Eventually(t, func() bool {
+				jobs, _ := store.List(context.Background())
+				return len(jobs) == 0
+			}, 5*time.Second, 10*time.Millisecond, "the job is settled")
+
+			copier.StopAndWait()
+			_, found := registryClient.Image(job.TargetImage)
+			assert.Equal(t, test.wantCopied, found)
+		})
+	}
+}
+
+// blockingRegistryClient records image copies and blocks them until released
+type blockingRegistryClient struct {
+	*registry.InMemoryClient
+	copies  atomic.Int32
+	release chan struct{}
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func (b *blockingRegistryClient) CopyImage(ctx context.Context, srcRef ctypes.ImageReference, srcCreds string, destRef ctypes.ImageReference, destCreds string, opts ...registry.CopyOption) error {
+	b.copies.Add(1)
+	b.mu.Lock()
+	b.targets = append(b.targets, destRef.DockerReference().String())
+	b.mu.Unlock()
+
+	<-b.release
+	return b.InMemoryClient.CopyImage(ctx, srcRef, srcCreds, destRef, destCreds, opts...)
+}
+
+func TestImageSwapper_InMemory_MutateDeduplicatesCopies(t *testing.T) {
+	registryClient := &blockingRegistryClient{
+		InMemoryClient: registry.NewInMemoryClient("registry.example.com"),
+		release:        make(chan struct{}),
+	}
+
+	// a single worker keeps the copies of the first request queued or running
+	copier := pond.New(1, 10)
+
+	wh, err := NewImageSwapperWebhookWithOpts(
+		registryClient,
+		ImageSwapPolicy(types.ImageSwapPolicyAlways),
+		ImageCopyPolicy(types.ImageCopyPolicyDelayed),
+		Copier(copier),
+	)
+	require.NoError(t, err)
+
+	deduplicated := testutil.ToFloat64(deduplicatedImageCopies)
+
+	for i := 0; i < 2; i++ {
+		_, err := reviewPod(t, wh, "")
+		require.NoError(t, err)
+	}
+
+	// the second request joins the copies of the first request
+	assert.Equal(t, float64(5), testutil.ToFloat64(deduplicatedImageCopies)-deduplicated)
+
+	close(registryClient.release)
+	copier.StopAndWait()
+
+	assert.Equal(t, int32(5), registryClient.copies.Load(), "every image is copied once")
+}
+
+func TestImageSwapper_InMemory_RetryCopyJobs(t *testing.T) {
+	registryClient := registry.NewInMemoryClient("registry.example.com")
+	registryClient.SetCopyError(errors.New("toomanyrequests"))
+	store := queue.NewMemoryStore()
+
+	wh, err := NewImageSwapperWebhookWithOpts(
+		registryClient,
+		ImageSwapPolicy(types.ImageSwapPolicyExists),
+		ImageCopyPolicy(types.ImageCopyPolicyDelayed),
+		CopyJobStore(store),
+		CopyRetryPolicy(queue.RetryPolicy{MaxAttempts: 10, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}),
+	)
+	require.NoError(t, err)
+
+	_, err = reviewPod(t, wh, "")
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		jobs, _ := store.List(context.Background())
+		return len(jobs) == 5 && jobs[0].Attempts > 1
+	}, 5*time.Second, 10*time.Millisecond, "failed copies are retried")
+
+	// the registry recovers, the next attempt succeeds
+	registryClient.SetCopyError(nil)
+
+	assert.Eventually(t, func() bool {
+		jobs, _ := store.List(context.Background())
+		return len(jobs) == 0
+	}, 5*time.Second, 10*time.Millisecond, "jobs are removed once copied")
+
+	_, found := registryClient.Image("registry.example.com/docker.io/library/nginx:latest")
+	assert.True(t, found)
+}
+
+func TestImageSwapper_InMemory_DeadLetterCopyJobs(t *testing.T) {
+	registryClient := registry.NewInMemoryClient("registry.example.com")
+	registryClient.SetCopyError(errors.New("manifest unknown"))
+	store := queue.NewMemoryStore()
+
+	wh, err := NewImageSwapperWebhookWithOpts(
+		registryClient,
+		ImageSwapPolicy(types.ImageSwapPolicyExists),
+		ImageCopyPolicy(types.ImageCopyPolicyDelayed),
+		CopyJobStore(store),
+		CopyRetryPolicy(queue.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}),
+	)
+	require.NoError(t, err)
+
+	deadLettered := testutil.ToFloat64(deadLetteredImageCopies)
+
+	_, err = reviewPod(t, wh, "")
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(deadLetteredImageCopies)-deadLettered == 5
+	}, 5*time.Second, 10*time.Millisecond, "jobs are dead-lettered after exhausting all attempts")
+
+	jobs, err := store.List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, jobs, 5)
+	for _, job := range jobs {
+		assert.True(t, job.DeadLetter)
+		assert.Equal(t, 3, job.Attempts)
+		assert.Equal(t, "manifest unknown", job.LastError)
+	}
+}
+
+func TestImageSwapper_InMemory_MutateCopyQueueFull(t *testing.T) {
+	tests := []struct {
+		name       string
+		fullPolicy types.ImageCopyQueueFullPolicy
+		wantErr    bool
+	}{
+		{
+			name:       "drop",
+			fullPolicy: types.ImageCopyQueueFullPolicyDrop,
+		},
+		{
+			name:       "reject",
+			fullPolicy: types.ImageCopyQueueFullPolicyReject,
+			wantErr:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registryClient := &blockingRegistryClient{
+				InMemoryClient: registry.NewInMemoryClient("registry.example.com"),
+				release:        make(chan struct{}),
+			}
+			store := queue.NewMemoryStore()
+
+			// one copy is running, one copy is waiting, further copies don't fit
+			copier := pond.New(1, 1)
+
+			wh, err := NewImageSwapperWebhookWithOpts(
+				registryClient,
+				ImageSwapPolicy(types.ImageSwapPolicyExists),
+				ImageCopyPolicy(types.ImageCopyPolicyDelayed),
+				Copier(copier),
+				CopyQueueFullPolicy(test.fullPolicy),
+				CopyJobStore(store),
+			)
+			require.NoError(t, err)
+
+			dropped := testutil.ToFloat64(droppedImageCopies)
+
+			_, err = reviewPod(t, wh, "")
+			if test.wantErr {
+				assert.ErrorIs(t, err, ErrCopyQueueFull)
+				assert.Equal(t, float64(1), testutil.ToFloat64(droppedImageCopies)-dropped)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, float64(3), testutil.ToFloat64(droppedImageCopies)-dropped)
+			}
+
+			// the running copy is persisted, the queued copy once it runs and dropped copies are not persisted
+			assert.Eventually(t, func() bool {
+				jobs, _ := store.List(context.Background())
+				return len(jobs) == 1
+			}, 5*time.Second, 10*time.Millisecond)
+
+			close(registryClient.release)
+			copier.StopAndWait()
+
+			assert.Equal(t, int32(2), registryClient.copies.Load())
+
+			jobs, err := store.List(context.Background())
+			require.NoError(t, err)
+			assert.Empty(t, jobs, "jobs are removed once copied")
+		})
+	}
+}
+
+func TestImageSwapper_InMemory_MutateCopierStopped(t *testing.T) {
+	registryClient := registry.NewInMemoryClient("registry.example.com")
+	store := queue.NewMemoryStore()
+	copier := pond.New(1, 1)
+
+	wh, err := NewImageSwapperWebhookWithOpts(
+		registryClient,
+		ImageSwapPolicy(types.ImageSwapPolicyExists),
+		ImageCopyPolicy(types.ImageCopyPolicyDelayed),
+		Copier(copier),
+		CopyQueueFullPolicy(types.ImageCopyQueueFullPolicyBlock),
+		CopyJobStore(store),
+	)
+	require.NoError(t, err)
+
+	// admissions still running during the shutdown
+	copier.StopAndWait()
+
+	assert.NotPanics(t, func() {
+		_, err = reviewPod(t, wh, "")
+	})
+	assert.NoError(t, err)
+
+	// the jobs are resumed after the restart
+	jobs, err := store.List(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, jobs, 5)
+	assert.Empty(t, registryClient.Images())
+}
+
+func TestImageSwapper_InMemory_MutateCopyPriorities(t *testing.T) {
+	registryClient := &blockingRegistryClient{
+		InMemoryClient: registry.NewInMemoryClient("registry.example.com"),
+		release:        make(chan struct{}),
+	}
+	close(registryClient.release)
+
+	copier := pond.New(1, 10)
+
+	wh, err := NewImageSwapperWebhookWithOpts(
+		registryClient,
+		ImageSwapPolicy(types.ImageSwapPolicyExists),
+		ImageCopyPolicy(types.ImageCopyPolicyDelayed),
+		Copier(copier),
+		CopyPriorities([]config.CopyPriority{
+			{Priority: 10, JMESPath: "contains(container.image, '-docker.pkg.dev/')"},
+			{Priority: 5, JMESPath: "container.name == 'init-container28'"},
+		}),
+	)
+	require.NoError(t, err)
+
+	// keep the only worker busy until all copies are queued
+	busy := make(chan struct{})
+	copier.Submit(func() { <-busy })
+
+	_, err = reviewPod(t, wh, "")
+	require.NoError(t, err)
+
+	close(busy)
+	copier.StopAndWait()
+
+	assert.Equal(t, []string{
+		"registry.example.com/us-central1-docker.pkg.dev/gcp-project-123/main/k8s.gcr.io/ingress-nginx/controller@sha256:9bba603b99bf25f6d117cf1235b6598c16033ad027b143c90fa5b3cc583c5713",
+		"registry.example.com/docker.io/library/init-container:latest",
+		"registry.example.com/docker.io/library/nginx:latest",
+		"registry.example.com/k8s.gcr.io/ingress-nginx/controller@sha256:9bba603b99bf25f6d117cf1235b6598c16033ad027b143c90fa5b3cc583c5713",
+		"registry.example.com/123456789.dkr.ecr.ap-southeast-2.amazonaws.com/k8s.gcr.io/ingress-nginx/controller@sha256:9bba603b99bf25f6d117cf1235b6598c16033ad027b143c90fa5b3cc583c5713",
+	}, registryClient.targets)
+}
+
+func TestImageSwapper_InMemory_MutateCopyPlatforms(t *testing.T) {
+	registryClient := registry.NewInMemoryClient("registry.example.com", "linux/amd64", "linux/arm64", "linux/s390x")
+	copier := pond.New(1, 10)
+
+	wh, err := NewImageSwapperWebhookWithOpts(
+		registryClient,
+		ImageSwapPolicy(types.ImageSwapPolicyExists),
+		ImageCopyPolicy(types.ImageCopyPolicyDelayed),
+		Copier(copier),
+		Platforms([]string{"linux/amd64", "linux/arm64"}),
+		SourcePlatforms([]config.SourcePlatforms{
+			{JMESPath: "container.name == 'nginx28'", Platforms: []string{"linux/s390x"}},
+		}),
+	)
+	require.NoError(t, err)
+
+	_, err = reviewPod(t, wh, "")
+	require.NoError(t, err)
+
+	copier.StopAndWait()
+
+	image, found := registryClient.Image("registry.example.com/docker.io/library/nginx:latest")
+	require.True(t, found)
+	assert.Equal(t, []string{"linux/s390x"}, image.Platforms, "source platforms override the target platforms")
+
+	image, found = registryClient.Image("registry.example.com/docker.io/library/init-container:latest")
+	require.True(t, found)
+	assert.Equal(t, []string{"linux/amd64", "linux/arm64"}, image.Platforms)
+}
+
+// fakeSignatureVerifier rejects the images listed as unsigned and counts the verifications if set
+type fakeSignatureVerifier struct {
+	unsigned      []string
+	verifications *atomic.Int32
+}
+
+func (f fakeSignatureVerifier) Required(ref ctypes.ImageReference) bool {
+	return reference.Domain(ref.DockerReference()) == "docker.io"
+}
+
+func (f fakeSignatureVerifier) Verify(ctx context.Context, ref ctypes.ImageReference, authFile string) (digest.Digest, error) {
+	if f.verifications != nil {
+		f.verifications.Add(1)
+	}
+	if slices.Contains(f.unsigned, ref.DockerReference().String()) {
+		return "", &registry.SignatureVerificationError{Image: ref.DockerReference().String(), Reason: "no signature found"}
+	}
+	return digest.FromString("verified " + ref.DockerReference().String()), nil
+}
+
+func TestImageSwapper_InMemory_MutateSignatureVerification(t *testing.T) {
+	registryClient := registry.NewInMemoryClient("registry.example.com")
+
+	wh, err := NewImageSwapperWebhookWithOpts(
+		registryClient,
+		ImageSwapPolicy(types.ImageSwapPolicyAlways),
+		ImageCopyPolicy(types.ImageCopyPolicyImmediate),
+		ImageCopyDeadline(8*time.Second),
+		VerifySignatures(fakeSignatureVerifier{unsigned: []string{"docker.io/library/nginx:latest"}}),
+	)
+	require.NoError(t, err)
+
+	resp, err := reviewPod(t, wh, "")
+	require.NoError(t, err)
+
+	assert.NotContains(t, string(resp.JSONPatchPatch), "/spec/containers/0/image", "unsigned images are not swapped")
+	assert.Contains(t, string(resp.JSONPatchPatch), "registry.example.com/docker.io/library/init-container:latest")
+	assert.Equal(t, []string{
+		"image nginx not swapped: signature verification of docker.io/library/nginx:latest failed: no signature found",
+	}, resp.Warnings)
+
+	_, found := registryClient.Image("registry.example.com/docker.io/library/nginx:latest")
+	assert.False(t, found, "unsigned images are not copied")
+}
+
+func TestImageSwapper_InMemory_MutateSignatureVerificationDigest(t *testing.T) {
+	registryClient := registry.NewInMemoryClient("registry.example.com")
+	verifications := &atomic.Int32{}
+
+	wh, err := NewImageSwapperWebhookWithOpts(
+		registryClient,
+		ImageSwapPolicy(types.ImageSwapPolicyAlways),
+		ImageCopyPolicy(types.ImageCopyPolicyImmediate),
+		ImageCopyDeadline(8*time.Second),
+		VerifySignatures(fakeSignatureVerifier{verifications: verifications}),
+	)
+	require.NoError(t, err)
+
+	_, err = reviewPod(t, wh, "")
+	require.NoError(t, err)
+
+	image, found := registryClient.Image("registry.example.com/docker.io/library/nginx:latest")
+	require.True(t, found)
+	assert.Equal(t, digest.FromString("verified docker.io/library/nginx:latest"), image.Digest, "the verified digest is copied")
+	assert.Equal(t, int32(2), verifications.Load(), "the docker.io images are verified once")
+}
+
+func TestImageSwapper_InMemory_MutateSignatureVerificationPresent(t *testing.T) {
+	registryClient := registry.NewInMemoryClient("registry.example.com")
+	registryClient.AddImage("registry.example.com/docker.io/library/nginx:latest", registry.InMemoryImage{})
+	verifications := &atomic.Int32{}
+
+	wh, err := NewImageSwapperWebhookWithOpts(
+		registryClient,
+		ImageSwapPolicy(types.ImageSwapPolicyAlways),
+		ImageCopyPolicy(types.ImageCopyPolicyImmediate),
+		ImageCopyDeadline(8*time.Second),
+		VerifySignatures(fakeSignatureVerifier{verifications: verifications}),
+	)
+	require.NoError(t, err)
+
+	_, err = reviewPod(t, wh, `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"nginx"},"spec":{"containers":[{"name":"nginx","image":"nginx"},{"name":"busybox","image":"busybox"}]}}`)
+	require.NoError(t, err)
+
+	assert.Equal(t, int32(1), verifications.Load(), "images present in the target registry are not verified again")
+}
+
+// scanningRegistryClient reports the given findings for target images and no scan results for all others,
+// lookups without deadline fail
+type scanningRegistryClient struct {
+	*registry.InMemoryClient
+
+	findings map[string][]registry.Vulnerability
+}
+
+func (c *scanningRegistryClient) ImageVulnerabilities(ctx context.Context, ref ctypes.ImageReference) ([]registry.Vulnerability, error) {
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		return nil, errors.New("scan findings looked up without deadline")
+	}
+	vulnerabilities, found := c.findings[ref.DockerReference().String()]
+	if !found {
+		return nil, registry.ErrScanNotAvailable
+	}
+	return vulnerabilities, nil
+}
+
+func TestImageSwapper_InMemory_MutateVulnerabilityPolicy(t *testing.T) {
+	policy := config.VulnerabilityPolicy{
+		Enabled:    true,
+		Thresholds: map[string]int{"critical": 0, "high": 1},
+		AllowList:  []string{"CVE-2023-38545"},
+	}
+
+	tests := []struct {
+		name         string
+		action       types.VulnerabilityAction
+		requireScan  bool
+		wantErr      bool
+		wantSwapped  []string
+		wantWarnings []string
+	}{
+		{
+			name:        "skip",
+			action:      types.VulnerabilityActionSkip,
+			wantSwapped: []string{"registry.example.com/docker.io/library/init-container:latest"},
+			wantWarnings: []string{
+				"image nginx not swapped: vulnerability threshold exceeded: 1 CRITICAL findings (threshold 0)",
+			},
+		},
+		{
+			name:        "skip unscanned",
+			action:      types.VulnerabilityActionSkip,
+			requireScan: true,
+			wantWarnings: []string{
+				"image nginx not swapped: vulnerability threshold exceeded: 1 CRITICAL findings (threshold 0)",
+				"image init-container not swapped: vulnerability threshold exceeded: no scan results: image scan results not available",
+			},
+		},
+		{
+			name:    "deny",
+			action:  types.VulnerabilityActionDeny,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registryClient := &scanningRegistryClient{
+				InMemoryClient: registry.NewInMemoryClient("registry.example.com"),
+				findings: map[string][]registry.Vulnerability{
+					"registry.example.com/docker.io/library/nginx:latest": {
+						{ID: "CVE-2023-4863", Severity: "CRITICAL"},
+						{ID: "CVE-2023-38545", Severity: "CRITICAL"},
+						{ID: "CVE-2023-44487", Severity: "HIGH"},
+					},
+				},
+			}
+
+			testPolicy := policy
+			testPolicy.RequireScan = test.requireScan
+
+			wh, err := NewImageSwapperWebhookWithOpts(
+				registryClient,
+				ImageSwapPolicy(types.ImageSwapPolicyExists),
+				ImageCopyPolicy(types.ImageCopyPolicyImmediate),
+				ImageCopyDeadline(8*time.Second),
+				VulnerabilityPolicy(testPolicy, test.action),
+			)
+			require.NoError(t, err)
+
+			resp, err := reviewPod(t, wh, "")
+			if test.wantErr {
+				assert.ErrorIs(t, err, ErrVulnerabilityThresholdExceeded)
+				return
+			}
+			require.NoError(t, err)
+
+			assert.NotContains(t, string(resp.JSONPatchPatch), "registry.example.com/docker.io/library/nginx:latest")
+			for _, image := range test.wantSwapped {
+				assert.Contains(t, string(resp.JSONPatchPatch), image)
+			}
+			assert.Subset(t, resp.Warnings, test.wantWarnings)
+		})
+	}
+}
+
+func TestImageSwapper_InMemory_MutateRepositoryRewrites(t *testing.T) {
+	registryClient := registry.NewInMemoryClient("registry.example.com")
+
+	wh, err := NewImageSwapperWebhookWithOpts(
+		registryClient,
+		ImageSwapPolicy(types.ImageSwapPolicyExists),
+		ImageCopyPolicy(types.ImageCopyPolicyImmediate),
+		ImageCopyDeadline(8*time.Second),
+		RepositoryRewrites([]config.RepositoryRewrite{
+			{Match: `^docker\.io/library/(.+)$`, Replace: "mirror/dockerhub/$1"},
+			{Match: `^k8s\.gcr\.io/(.+)$`, Replace: "mirror/k8s/$1"},
+		}),
+	)
+	require.NoError(t, err)
+
+	resp, err := reviewPod(t, wh, "")
+	require.NoError(t, err)
+
+	patch := string(resp.JSONPatchPatch)
+	assert.Contains(t, patch, `"registry.example.com/mirror/dockerhub/nginx:latest"`)
+	assert.Contains(t, patch, `"registry.example.com/mirror/dockerhub/init-container:latest"`)
+	assert.Contains(t, patch, `"registry.example.com/mirror/k8s/ingress-nginx/controller@sha256:9bba603b99bf25f6d117cf1235b6598c16033ad027b143c90fa5b3cc583c5713"`)
+
+	assert.Subset(t, registryClient.Repositories(), []string{
+		"mirror/dockerhub/init-container",
+		"mirror/dockerhub/nginx",
+		"mirror/k8s/ingress-nginx/controller",
+	})
+
+	image, found := registryClient.Image("registry.example.com/mirror/dockerhub/nginx:latest")
+	assert.True(t, found)
+	assert.Equal(t, "docker.io/library/nginx:latest", image.Source)
+
+	// swapped images are recognized as originating from the target registry
+	resp, err = reviewPod(t, wh, `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"nginx"},"spec":{"containers":[{"name":"nginx","image":"registry.example.com/mirror/dockerhub/nginx:latest"}]}}`)
+	require.NoError(t, err)
+	assert.NotContains(t, string(resp.JSONPatchPatch), "/spec/containers/0/image")
+}
+
+func TestImageSwapper_InMemory_MutateTargets(t *testing.T) {
+	registryClient := registry.NewInMemoryClient("registry.example.com")
+	tenantRegistryClient := registry.NewInMemoryClient("tenant.example.com")
+
+	wh, err := NewImageSwapperWebhookWithOpts(
+		registryClient,
+		ImageSwapPolicy(types.ImageSwapPolicyExists),
+		ImageCopyPolicy(types.ImageCopyPolicyImmediate),
+		ImageCopyDeadline(8*time.Second),
+		Targets([]Target{
+			{JMESPath: "obj.metadata.namespace == 'team-b'", Client: registry.NewInMemoryClient("team-b.example.com")},
+			{
+				JMESPath: "container.name == 'nginx28'",
+				Client:   tenantRegistryClient,
+				Rewrites: []config.RepositoryRewrite{{Match: `^docker\.io/library/(.+)$`, Replace: "tenant/$1"}},
+			},
+		}),
+	)
+	require.NoError(t, err)
+
+	resp, err := reviewPod(t, wh, "")
+	require.NoError(t, err)
+
+	patch := string(resp.JSONPatchPatch)
+	assert.Contains(t, patch, `{"op":"replace","path":"/spec/containers/0/image","value":"tenant.example.com/tenant/nginx:latest"}`)
+	assert.Contains(t, patch, `{"op":"replace","path":"/spec/initContainers/0/image","value":"registry.example.com/docker.io/library/init-container:latest"}`)
+
+	_, found := tenantRegistryClient.Image("tenant.example.com/tenant/nginx:latest")
+	assert.True(t, found, "selected images are copied to the tenant registry")
+	_, found = registryClient.Image("registry.example.com/docker.io/library/nginx:latest")
+	assert.False(t, found, "selected images are not copied to the default registry")
+	assert.Equal(t, []string{"tenant/nginx"}, tenantRegistryClient.Repositories())
+
+	// images of all target registries are not swapped again
+	resp, err = reviewPod(t, wh, `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"nginx"},"spec":{"containers":[{"name":"nginx","image":"tenant.example.com/tenant/nginx:latest"}]}}`)
+	require.NoError(t, err)
+	assert.NotContains(t, string(resp.JSONPatchPatch), "/spec/containers/0/image")
+}
+
+func TestImageSwapper_InMemory_MutateReplicas(t *testing.T) {
+	tests := []struct {
+		name          string
+		clusterRegion string
+		wantImage     string
+	}{
+		{
+			name:          "replica region",
+			clusterRegion: "us-east-1",
+			wantImage:     "123456789.dkr.ecr.us-east-1.amazonaws.com/docker.io/library/nginx:latest",
+		},
+		{
+			name:          "target region",
+			clusterRegion: "ap-southeast-2",
+			wantImage:     "123456789.dkr.ecr.ap-southeast-2.amazonaws.com/docker.io/library/nginx:latest",
+		},
+		{
+			name:      "unknown region",
+			wantImage: "123456789.dkr.ecr.ap-southeast-2.amazonaws.com/docker.io/library/nginx:latest",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registryClient := registry.NewInMemoryClient("123456789.dkr.ecr.ap-southeast-2.amazonaws.com")
+			replicaClient := registry.NewInMemoryClient("123456789.dkr.ecr.us-east-1.amazonaws.com")
+
+			// the image was copied to the target registry before the replica was added
+			registryClient.AddImage("123456789.dkr.ecr.ap-southeast-2.amazonaws.com/docker.io/library/init-container:latest", registry.InMemoryImage{Source: "docker.io/library/init-container:latest"})
+
+			wh, err := NewImageSwapperWebhookWithOpts(
+				registryClient,
+				ImageSwapPolicy(types.ImageSwapPolicyExists),
+				ImageCopyPolicy(types.ImageCopyPolicyImmediate),
+				ImageCopyDeadline(8*time.Second),
+				Replicas("ap-southeast-2", []Replica{{Region: "us-east-1", Client: replicaClient}}),
+				ClusterRegion(test.clusterRegion),
+			)
+			require.NoError(t, err)
+
+			resp, err := reviewPod(t, wh, "")
+			require.NoError(t, err)
+
+			patch := string(resp.JSONPatchPatch)
+			assert.Contains(t, patch, `{"op":"replace","path":"/spec/containers/0/image","value":"`+test.wantImage+`"}`)
+
+			image, found := registryClient.Image("123456789.dkr.ecr.ap-southeast-2.amazonaws.com/docker.io/library/nginx:latest")
+			assert.True(t, found, "images are copied to the target registry")
+			assert.Equal(t, "docker.io/library/nginx:latest", image.Source)
+
+			image, found = replicaClient.Image("123456789.dkr.ecr.us-east-1.amazonaws.com/docker.io/library/nginx:latest")
+			assert.True(t, found, "images are replicated")
+			assert.Equal(t, "123456789.dkr.ecr.ap-southeast-2.amazonaws.com/docker.io/library/nginx:latest", image.Source, "images are replicated from the target registry")
+
+			image, found = replicaClient.Image("123456789.dkr.ecr.us-east-1.amazonaws.com/docker.io/library/init-container:latest")
+			assert.True(t, found, "images missing in the replica only are replicated")
+			assert.Equal(t, "123456789.dkr.ecr.ap-southeast-2.amazonaws.com/docker.io/library/init-container:latest", image.Source)
+			assert.Contains(t, replicaClient.Repositories(), "docker.io/library/init-container")
+
+			// swapped images of replicas are not swapped again
+			resp, err = reviewPod(t, wh, `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"nginx"},"spec":{"containers":[{"name":"nginx","image":"123456789.dkr.ecr.us-east-1.amazonaws.com/docker.io/library/nginx:latest"}]}}`)
+			require.NoError(t, err)
+			assert.NotContains(t, string(resp.JSONPatchPatch), "/spec/containers/0/image")
+		})
+	}
+}
+
+func TestImageSwapper_InMemory_MutateRecordOriginalImages(t *testing.T) {
+	registryClient := registry.NewInMemoryClient("registry.example.com")
+
+	wh, err := NewImageSwapperWebhookWithOpts(
+		registryClient,
+		ImageSwapPolicy(types.ImageSwapPolicyAlways),
+		ImageCopyPolicy(types.ImageCopyPolicyNone),
+		ImageCopyDeadline(8*time.Second),
+		RecordOriginalImages(true),
+	)
+	require.NoError(t, err)
+
+	resp, err := reviewPod(t, wh, "")
+	require.NoError(t, err)
+
+	var patch []map[string]interface{}
+	require.NoError(t, json.Unmarshal(resp.JSONPatchPatch, &patch))
+
+	var images map[string]string
+	for _, op := range patch {
+		if op["path"] == "/metadata/annotations" {
+			annotations := op["value"].(map[string]interface{})
+			require.NoError(t, json.Unmarshal([]byte(annotations[originalImagesAnnotation].(string)), &images))
+		}
+	}
+	assert.Equal(t, "nginx", images["nginx28"])
+	assert.Equal(t, "init-container", images["init-container28"])
+
+	// containers restored by the fallback controller are not swapped again
+	resp, err = reviewPod(t, wh, `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"nginx","annotations":{"k8s-image-swapper.github.io/fallback":"nginx"}},"spec":{"containers":[{"name":"nginx","image":"nginx"}]}}`)
+	require.NoError(t, err)
+	assert.NotContains(t, string(resp.JSONPatchPatch), "/spec/containers/0/image")
+}
@@ -0,0 +1,61 @@
+package webhook
+
+import (
+	"context"
+	"sync"
+)
+
+// inflightCopy is a copy operation shared by all requests for the same target image
+type inflightCopy struct {
+	done chan struct{}
+	err  error
+}
+
+// wait blocks until the copy finished or the context is done and returns the copy result
+func (c *inflightCopy) wait(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// inflightCopies tracks running copy operations by target image
+type inflightCopies struct {
+	mu     sync.Mutex
+	copies map[string]*inflightCopy
+}
+
+func newInflightCopies() *inflightCopies {
+	return &inflightCopies{copies: map[string]*inflightCopy{}}
+}
+
+// start returns the running copy of the target image, or registers a new one in which case the caller owns the copy
+// and has to call finish
+func (c *inflightCopies) start(targetImage string) (*inflightCopy, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if running, found := c.copies[targetImage]; found {
+		return running, false
+	}
+
+	running := &inflightCopy{done: make(chan struct{})}
+	c.copies[targetImage] = running
+
+	return running, true
+}
+
+// finish records the result of a copy and releases all requests waiting on it
+func (c *inflightCopies) finish(targetImage string, running *inflightCopy, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.copies[targetImage] == running {
+		delete(c.copies, targetImage)
+	}
+
+	running.err = err
+	close(running.done)
+}
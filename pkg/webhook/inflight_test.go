@@ -0,0 +1,35 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInflightCopies(t *testing.T) {
+	copies := newInflightCopies()
+
+	running, owner := copies.start("registry.example.com/docker.io/library/nginx:latest")
+	assert.True(t, owner)
+
+	joined, owner := copies.start("registry.example.com/docker.io/library/nginx:latest")
+	assert.False(t, owner)
+	assert.Same(t, running, joined)
+
+	_, owner = copies.start("registry.example.com/docker.io/library/busybox:latest")
+	assert.True(t, owner, "other images are copied independently")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, joined.wait(ctx), context.DeadlineExceeded)
+
+	copyErr := errors.New("copy failed")
+	copies.finish("registry.example.com/docker.io/library/nginx:latest", running, copyErr)
+	assert.ErrorIs(t, joined.wait(context.Background()), copyErr)
+
+	_, owner = copies.start("registry.example.com/docker.io/library/nginx:latest")
+	assert.True(t, owner, "finished copies are not reused")
+}
@@ -0,0 +1,132 @@
+package webhook
+
+import (
+	"github.com/alitto/pond"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "k8s_image_swapper"
+
+var (
+	dryRunImageSwaps = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "dry_run",
+		Name:      "image_swaps_total",
+		Help:      "Number of container images which would have been swapped if dry-run was disabled.",
+	})
+
+	dryRunImageCopies = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "dry_run",
+		Name:      "image_copies_total",
+		Help:      "Number of container images which would have been copied if dry-run was disabled.",
+	})
+
+	deduplicatedImageCopies = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "image_copies_deduplicated_total",
+		Help:      "Number of image copies skipped because a copy of the same image was already in progress.",
+	})
+
+	droppedImageCopies = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "image_copies_dropped_total",
+		Help:      "Number of image copies not accepted because the copy queue was full.",
+	})
+
+	sourceRateLimitWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "source_rate_limit_wait_seconds",
+		Help:      "Time image copies waited for the rate limit of the source registry.",
+		Buckets:   []float64{0.1, 1, 5, 15, 30, 60, 300, 900},
+	}, []string{"domain"})
+
+	imageCopyRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "image_copy_retries_total",
+		Help:      "Number of failed image copies scheduled for another attempt.",
+	})
+
+	deadLetteredImageCopies = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "image_copies_dead_lettered_total",
+		Help:      "Number of image copies moved to the dead-letter list after exhausting all attempts.",
+	})
+
+	signatureVerificationFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "signature_verification_failures_total",
+		Help:      "Number of images neither copied nor swapped because their signatures could not be verified.",
+	})
+
+	imageReplications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "image_replications_total",
+		Help:      "Number of images replicated from the target registry to its replicas.",
+	}, []string{"replica"})
+
+	fallbackCopyRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "fallback",
+		Name:      "copy_retries_total",
+		Help:      "Number of image copies retriggered because the swapped image could not be pulled.",
+	})
+
+	imageFallbacks = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "fallback",
+		Name:      "image_fallbacks_total",
+		Help:      "Number of containers restored to their original image after failing to pull the swapped image.",
+	})
+
+	vulnerableImages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "vulnerability_threshold_exceeded_total",
+		Help:      "Number of images not swapped or denied because their scan findings exceeded the vulnerability thresholds.",
+	}, []string{"action"})
+)
+
+// RegisterCopierMetrics exposes the queue depth and worker utilisation of the copier
+func RegisterCopierMetrics(registerer prometheus.Registerer, copier *pond.WorkerPool) error {
+	collectors := []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "copier",
+			Name:      "waiting_tasks",
+			Help:      "Number of image copies waiting for a worker.",
+		}, func() float64 { return float64(copier.WaitingTasks()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "copier",
+			Name:      "running_workers",
+			Help:      "Number of running copy workers, including idle workers.",
+		}, func() float64 { return float64(copier.RunningWorkers()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "copier",
+			Name:      "idle_workers",
+			Help:      "Number of copy workers waiting for a task.",
+		}, func() float64 { return float64(copier.IdleWorkers()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "copier",
+			Name:      "capacity",
+			Help:      "Maximum number of image copies waiting for a worker.",
+		}, func() float64 { return float64(copier.MaxCapacity()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "copier",
+			Name:      "completed_tasks_total",
+			Help:      "Number of image copies completed by the copier.",
+		}, func() float64 { return float64(copier.CompletedTasks()) }),
+	}
+
+	for _, collector := range collectors {
+		if err := registerer.Register(collector); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,25 @@
+package webhook
+
+import (
+	"testing"
+
+	"github.com/alitto/pond"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterCopierMetrics(t *testing.T) {
+	registry := prometheus.NewPedanticRegistry()
+	copier := pond.New(2, 10)
+	defer copier.StopAndWait()
+
+	require.NoError(t, RegisterCopierMetrics(registry, copier))
+
+	count, err := testutil.GatherAndCount(registry, "k8s_image_swapper_copier_capacity", "k8s_image_swapper_copier_waiting_tasks")
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	assert.Error(t, RegisterCopierMetrics(registry, copier), "metrics can only be registered once")
+}
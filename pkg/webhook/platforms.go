@@ -0,0 +1,17 @@
+package webhook
+
+import (
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+)
+
+// copyPlatforms returns the platforms of the first source rule matching the filter context,
+// the platforms of the target registry are used if no rule matches
+func (p *ImageSwapper) copyPlatforms(ctx FilterContext, target *targetRegistry) []string {
+	for _, rule := range p.sourcePlatforms {
+		if filterMatch(ctx, []config.JMESPathFilter{{JMESPath: rule.JMESPath}}) {
+			return rule.Platforms
+		}
+	}
+
+	return target.platforms
+}
@@ -0,0 +1,44 @@
+package webhook
+
+import (
+	"testing"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCopyPlatforms(t *testing.T) {
+	swapper := &ImageSwapper{
+		platforms: []string{"linux/amd64", "linux/arm64"},
+		sourcePlatforms: []config.SourcePlatforms{
+			{JMESPath: "obj.metadata.namespace == 'windows'", Platforms: []string{"windows/amd64"}},
+			{JMESPath: "starts_with(container.image, 'quay.io/')", Platforms: []string{"system"}},
+			{JMESPath: "starts_with(container.image, 'quay.io/')", Platforms: []string{"linux/s390x"}},
+		},
+	}
+
+	pod := func(namespace string, image string) FilterContext {
+		return FilterContext{
+			Obj:       &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace}},
+			Container: corev1.Container{Image: image},
+		}
+	}
+
+	tests := []struct {
+		name string
+		ctx  FilterContext
+		want []string
+	}{
+		{"source rule", pod("windows", "nginx"), []string{"windows/amd64"}},
+		{"first match", pod("default", "quay.io/prometheus/prometheus"), []string{"system"}},
+		{"target platforms", pod("default", "nginx"), []string{"linux/amd64", "linux/arm64"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, swapper.copyPlatforms(test.ctx, swapper.defaultTarget()))
+		})
+	}
+}
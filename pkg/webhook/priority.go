@@ -0,0 +1,84 @@
+package webhook
+
+import (
+	"slices"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/jmespath/go-jmespath"
+	"github.com/rs/zerolog/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// copyPriority returns the priority of the first rule matching the filter context, 0 if no rule matches
+func (p *ImageSwapper) copyPriority(ctx FilterContext) int {
+	for _, rule := range p.copyPriorities {
+		if p.priorityMatch(ctx, rule) {
+			return rule.Priority
+		}
+	}
+
+	return 0
+}
+
+// priorityMatch returns true if all conditions of the rule are met
+func (p *ImageSwapper) priorityMatch(ctx FilterContext, rule config.CopyPriority) bool {
+	if len(rule.Namespaces) > 0 && !slices.Contains(rule.Namespaces, ctx.Obj.GetNamespace()) {
+		return false
+	}
+
+	if rule.NamespaceSelector != nil && !p.namespaceMatch(ctx.Obj.GetNamespace(), rule.NamespaceSelector) {
+		return false
+	}
+
+	labels := ctx.Obj.GetLabels()
+	for key, value := range rule.Labels {
+		if labels[key] != value {
+			return false
+		}
+	}
+
+	if rule.JMESPath == "" {
+		return true
+	}
+
+	filterContext, err := ctx.searchable()
+	if err != nil {
+		log.Err(err).Msg("could not generate filter context")
+		return false
+	}
+
+	result, err := jmespath.Search(rule.JMESPath, filterContext)
+	if err != nil {
+		log.Err(err).Str("jmespath", rule.JMESPath).Msg("priority could not be evaluated")
+		return false
+	}
+
+	matched, ok := result.(bool)
+	if !ok {
+		log.Warn().Str("jmespath", rule.JMESPath).Msg("priority does not return a bool value")
+	}
+
+	return matched
+}
+
+// namespaceMatch returns true if the labels of the namespace match the selector
+func (p *ImageSwapper) namespaceMatch(name string, namespaceSelector *metav1.LabelSelector) bool {
+	if p.namespaceLister == nil {
+		return false
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(namespaceSelector)
+	if err != nil {
+		log.Err(err).Msg("invalid namespace selector")
+		return false
+	}
+
+	namespace, err := p.namespaceLister.Get(name)
+	if err != nil {
+		log.Debug().Err(err).Str("namespace", name).Msg("namespace labels not available")
+		return false
+	}
+
+	return selector.Matches(labels.Set(namespace.Labels))
+}
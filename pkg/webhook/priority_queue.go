@@ -0,0 +1,196 @@
+package webhook
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/estahn/k8s-image-swapper/pkg/queue"
+)
+
+// copyClass orders copies by their origin, copies of a higher class always run first
+type copyClass int
+
+const (
+	// copyClassBackground are resumed and retried copies
+	copyClassBackground copyClass = iota
+	// copyClassDelayed are copies triggered by admissions with the "delayed" copy policy
+	copyClassDelayed
+	// copyClassImmediate are copies an admission waits for
+	copyClassImmediate
+)
+
+// copyTask is a pending copy, ordered by class, priority and submission
+type copyTask struct {
+	class    copyClass
+	priority int
+	seq      uint64
+	run      func()
+	// source is the domain of the source registry, copies wait in the queue until its rate limit allows a copy
+	source string
+	// deferredAt is the time the copy was first held back by the rate limit of its source
+	deferredAt time.Time
+	// job is persisted if the copy is still queued when the copier stopped, nil if the copy is not resumed
+	job *queue.Job
+}
+
+// copyTasks implements heap.Interface, the task to run next is at index 0
+type copyTasks []*copyTask
+
+func (t copyTasks) Len() int { return len(t) }
+
+func (t copyTasks) Less(i, j int) bool {
+	if t[i].class != t[j].class {
+		return t[i].class > t[j].class
+	}
+	if t[i].priority != t[j].priority {
+		return t[i].priority > t[j].priority
+	}
+	return t[i].seq < t[j].seq
+}
+
+func (t copyTasks) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+
+func (t *copyTasks) Push(x any) { *t = append(*t, x.(*copyTask)) }
+
+func (t *copyTasks) Pop() any {
+	old := *t
+	n := len(old)
+	task := old[n-1]
+	old[n-1] = nil
+	*t = old[:n-1]
+	return task
+}
+
+// copyQueue orders the copies waiting for a worker of the copier. The copier runs one generic task per pending copy,
+// which picks the copy with the highest priority at the time a worker becomes available.
+// Copies from source registries which are rate limited stay in the queue, they don't occupy a worker while waiting.
+type copyQueue struct {
+	mu    sync.Mutex
+	ready *sync.Cond
+	tasks copyTasks
+	seq   uint64
+
+	// limiters of the source registries, copies are picked once their source allows another copy
+	limiters sourceLimiters
+	// wakeup checks the rate limits again once the next rate token is available
+	wakeup   *time.Timer
+	wakeupAt time.Time
+}
+
+func newCopyQueue() *copyQueue {
+	q := &copyQueue{}
+	q.ready = sync.NewCond(&q.mu)
+	return q
+}
+
+// push adds a pending copy
+func (q *copyQueue) push(task *copyTask) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.seq++
+	task.seq = q.seq
+	heap.Push(&q.tasks, task)
+	q.ready.Signal()
+}
+
+// pop removes the copy with the highest priority allowed by the rate limit of its source registry,
+// waiting for a copy to be pushed or a source registry to allow another copy
+func (q *copyQueue) pop() func() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		next, wait := q.next()
+		if next >= 0 {
+			task := heap.Remove(&q.tasks, next).(*copyTask)
+			if !task.deferredAt.IsZero() {
+				sourceRateLimitWait.WithLabelValues(task.source).Observe(time.Since(task.deferredAt).Seconds())
+			}
+			return task.run
+		}
+
+		if wait > 0 {
+			q.wakeAfter(wait)
+		}
+		q.ready.Wait()
+	}
+}
+
+// next returns the index of the copy to run next, -1 if no copy is allowed by the rate limits.
+// The shortest time until a rate limited copy is allowed is returned otherwise.
+func (q *copyQueue) next() (int, time.Duration) {
+	next := -1
+	var wait time.Duration
+
+	for i, task := range q.tasks {
+		if next >= 0 && !q.tasks.Less(i, next) {
+			continue
+		}
+
+		if available, retryAfter := q.limiters.available(task.source); !available {
+			if task.deferredAt.IsZero() {
+				task.deferredAt = time.Now()
+			}
+			if retryAfter > 0 && (wait == 0 || retryAfter < wait) {
+				wait = retryAfter
+			}
+			continue
+		}
+		next = i
+	}
+
+	return next, wait
+}
+
+// wakeAfter checks the queue again after the duration, unless an earlier check is pending
+func (q *copyQueue) wakeAfter(wait time.Duration) {
+	at := time.Now().Add(wait)
+	if q.wakeup != nil {
+		if !q.wakeupAt.After(at) {
+			return
+		}
+		q.wakeup.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(wait, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		if q.wakeup == timer {
+			q.wakeup = nil
+		}
+		q.ready.Broadcast()
+	})
+	q.wakeup = timer
+	q.wakeupAt = at
+}
+
+// wake checks the queue again, e.g. once a copy freed a slot of its source registry
+func (q *copyQueue) wake() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.ready.Broadcast()
+}
+
+// runNext runs the copy with the highest priority, it is submitted to the copier once per pushed copy
+func (q *copyQueue) runNext() {
+	q.pop()()
+}
+
+// pendingJobs returns the jobs of the queued copies to be resumed
+func (q *copyQueue) pendingJobs() []queue.Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var jobs []queue.Job
+	for _, task := range q.tasks {
+		if task.job != nil {
+			jobs = append(jobs, *task.job)
+		}
+	}
+	return jobs
+}
@@ -0,0 +1,87 @@
+package webhook
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyQueueOrder(t *testing.T) {
+	queue := newCopyQueue()
+
+	var order []string
+	add := func(name string, class copyClass, priority int) {
+		queue.push(&copyTask{class: class, priority: priority, run: func() { order = append(order, name) }})
+	}
+
+	add("resync", copyClassBackground, 100)
+	add("delayed-1", copyClassDelayed, 0)
+	add("critical", copyClassDelayed, 10)
+	add("delayed-2", copyClassDelayed, 0)
+	add("immediate", copyClassImmediate, 0)
+
+	for i := 0; i < 5; i++ {
+		queue.runNext()
+	}
+
+	assert.Equal(t, []string{"immediate", "critical", "delayed-1", "delayed-2", "resync"}, order)
+}
+
+func TestCopyQueuePopWaits(t *testing.T) {
+	queue := newCopyQueue()
+
+	done := make(chan struct{})
+	go queue.runNext()
+
+	queue.push(&copyTask{class: copyClassDelayed, run: func() { close(done) }})
+	<-done
+}
+
+func TestCopyQueueRateLimitedSource(t *testing.T) {
+	queue := newCopyQueue()
+	queue.limiters = newSourceLimiters([]config.SourceRateLimit{
+		{Domain: "docker.io", CopiesPerMinute: 1, Burst: 1},
+	})
+
+	// the only rate token of docker.io is used
+	release, err := queue.limiters.acquire(context.Background(), "docker.io")
+	require.NoError(t, err)
+	release()
+
+	var order []string
+	queue.push(&copyTask{class: copyClassDelayed, priority: 10, source: "docker.io", run: func() { order = append(order, "docker.io") }})
+	queue.push(&copyTask{class: copyClassDelayed, source: "quay.io", run: func() { order = append(order, "quay.io") }})
+
+	queue.runNext()
+	assert.Equal(t, []string{"quay.io"}, order, "copies of other registries are not blocked")
+	assert.Equal(t, 1, queue.tasks.Len(), "the rate limited copy waits in the queue")
+}
+
+func TestCopyQueueConcurrencyLimitedSource(t *testing.T) {
+	queue := newCopyQueue()
+	queue.limiters = newSourceLimiters([]config.SourceRateLimit{
+		{Domain: "docker.io", Concurrency: 1},
+	})
+
+	release, err := queue.limiters.acquire(context.Background(), "docker.io")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	queue.push(&copyTask{class: copyClassDelayed, source: "docker.io", run: func() { close(done) }})
+	go queue.runNext()
+
+	select {
+	case <-done:
+		t.Fatal("the copy started while all copy slots of the registry are taken")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// the running copy finished
+	release()
+	queue.wake()
+	<-done
+}
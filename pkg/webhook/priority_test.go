@@ -0,0 +1,73 @@
+package webhook
+
+import (
+	"testing"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestCopyPriority(t *testing.T) {
+	swapper := &ImageSwapper{
+		copyPriorities: []config.CopyPriority{
+			{Priority: 100, Namespaces: []string{"kube-system"}},
+			{Priority: 50, Labels: map[string]string{"tier": "critical"}},
+			{Priority: 10, JMESPath: "starts_with(container.image, 'quay.io/')"},
+			{Priority: -10, Namespaces: []string{"playground"}, Labels: map[string]string{"prewarm": "true"}},
+		},
+	}
+
+	pod := func(namespace string, labels map[string]string, image string) FilterContext {
+		return FilterContext{
+			Obj:       &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Labels: labels}},
+			Container: corev1.Container{Image: image},
+		}
+	}
+
+	tests := []struct {
+		name string
+		ctx  FilterContext
+		want int
+	}{
+		{"namespace", pod("kube-system", nil, "nginx"), 100},
+		{"labels", pod("default", map[string]string{"tier": "critical"}, "nginx"), 50},
+		{"jmespath", pod("default", nil, "quay.io/prometheus/prometheus"), 10},
+		{"all conditions", pod("playground", map[string]string{"prewarm": "true"}, "nginx"), -10},
+		{"partial conditions", pod("playground", nil, "nginx"), 0},
+		{"first match", pod("kube-system", map[string]string{"tier": "critical"}, "nginx"), 100},
+		{"no match", pod("default", nil, "nginx"), 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, swapper.copyPriority(test.ctx))
+		})
+	}
+}
+
+func TestCopyPriorityNamespaceSelector(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	require.NoError(t, indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "payments", Labels: map[string]string{"tier": "critical"}}}))
+	require.NoError(t, indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "playground"}}))
+
+	rules := []config.CopyPriority{
+		{Priority: 100, NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "critical"}}},
+	}
+	swapper := &ImageSwapper{copyPriorities: rules, namespaceLister: corelisters.NewNamespaceLister(indexer)}
+
+	pod := func(namespace string) FilterContext {
+		return FilterContext{Obj: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace}}}
+	}
+
+	assert.Equal(t, 100, swapper.copyPriority(pod("payments")), "namespace labels match")
+	assert.Equal(t, 0, swapper.copyPriority(pod("playground")), "namespace labels do not match")
+	assert.Equal(t, 0, swapper.copyPriority(pod("unknown")), "unknown namespaces do not match")
+
+	withoutLister := &ImageSwapper{copyPriorities: rules}
+	assert.Equal(t, 0, withoutLister.copyPriority(pod("payments")), "namespace selectors require the lister")
+}
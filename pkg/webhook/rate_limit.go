@@ -0,0 +1,120 @@
+package webhook
+
+import (
+	"context"
+	"time"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"golang.org/x/time/rate"
+)
+
+// anySourceDomain configures the rate limit of all source registries without a dedicated limit
+const anySourceDomain = "*"
+
+// sourceLimiter limits the concurrency and rate of copies from a source registry
+type sourceLimiter struct {
+	// slots is a semaphore, nil for unlimited concurrency
+	slots chan struct{}
+	// limiter is nil for an unlimited rate
+	limiter *rate.Limiter
+}
+
+func newSourceLimiter(limit config.SourceRateLimit) *sourceLimiter {
+	l := &sourceLimiter{}
+
+	if limit.Concurrency > 0 {
+		l.slots = make(chan struct{}, limit.Concurrency)
+	}
+
+	if limit.CopiesPerMinute > 0 {
+		burst := limit.Burst
+		if burst < 1 {
+			burst = 1
+		}
+		l.limiter = rate.NewLimiter(rate.Limit(limit.CopiesPerMinute/60), burst)
+	}
+
+	return l
+}
+
+// acquire waits for a copy slot and a rate token, the returned function releases the slot
+func (l *sourceLimiter) acquire(ctx context.Context) (func(), error) {
+	if l.limiter != nil {
+		if err := l.limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if l.slots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// available returns true if a copy would be allowed without waiting, otherwise the time until the next rate token.
+// No time is returned while all copy slots are taken, a finished copy frees a slot.
+func (l *sourceLimiter) available() (bool, time.Duration) {
+	if l.slots != nil && len(l.slots) == cap(l.slots) {
+		return false, 0
+	}
+
+	if l.limiter != nil {
+		if tokens := l.limiter.Tokens(); tokens < 1 {
+			wait := time.Duration((1 - tokens) / float64(l.limiter.Limit()) * float64(time.Second))
+			return false, max(wait, time.Millisecond)
+		}
+	}
+
+	return true, 0
+}
+
+// sourceLimiters holds the limiters by source registry domain
+type sourceLimiters map[string]*sourceLimiter
+
+func newSourceLimiters(limits []config.SourceRateLimit) sourceLimiters {
+	limiters := sourceLimiters{}
+	for _, limit := range limits {
+		limiters[limit.Domain] = newSourceLimiter(limit)
+	}
+	return limiters
+}
+
+// acquire waits until a copy from the source registry is allowed, the returned function has to be called once the
+// copy finished
+func (s sourceLimiters) acquire(ctx context.Context, domain string) (func(), error) {
+	limiter, found := s.limiter(domain)
+	if !found {
+		return func() {}, nil
+	}
+
+	start := time.Now()
+	release, err := limiter.acquire(ctx)
+	sourceRateLimitWait.WithLabelValues(domain).Observe(time.Since(start).Seconds())
+
+	return release, err
+}
+
+// available returns true if a copy from the source registry would be allowed without waiting,
+// see sourceLimiter.available
+func (s sourceLimiters) available(domain string) (bool, time.Duration) {
+	limiter, found := s.limiter(domain)
+	if !found {
+		return true, 0
+	}
+	return limiter.available()
+}
+
+// limiter returns the limiter of the source registry or the default limiter
+func (s sourceLimiters) limiter(domain string) (*sourceLimiter, bool) {
+	limiter, found := s[domain]
+	if !found {
+		limiter, found = s[anySourceDomain]
+	}
+	return limiter, found
+}
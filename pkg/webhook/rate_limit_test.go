@@ -0,0 +1,53 @@
+package webhook
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceLimitersConcurrency(t *testing.T) {
+	limiters := newSourceLimiters([]config.SourceRateLimit{
+		{Domain: "docker.io", Concurrency: 1},
+	})
+
+	release, err := limiters.acquire(context.Background(), "docker.io")
+	require.NoError(t, err)
+
+	// the second copy waits for the first one to finish
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = limiters.acquire(ctx, "docker.io")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// other registries are not limited
+	releaseOther, err := limiters.acquire(context.Background(), "quay.io")
+	require.NoError(t, err)
+	releaseOther()
+
+	release()
+	release, err = limiters.acquire(context.Background(), "docker.io")
+	require.NoError(t, err)
+	release()
+}
+
+func TestSourceLimitersRate(t *testing.T) {
+	limiters := newSourceLimiters([]config.SourceRateLimit{
+		{Domain: "*", CopiesPerMinute: 1, Burst: 2},
+	})
+
+	for i := 0; i < 2; i++ {
+		release, err := limiters.acquire(context.Background(), "docker.io")
+		require.NoError(t, err, "copies within the burst are allowed immediately")
+		release()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := limiters.acquire(ctx, "quay.io")
+	assert.Error(t, err, "the default limit applies to all registries")
+}
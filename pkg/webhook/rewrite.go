@@ -0,0 +1,43 @@
+package webhook
+
+import (
+	"regexp"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+// repositoryRewrite is a compiled config.RepositoryRewrite
+type repositoryRewrite struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+// newRepositoryRewrites compiles the rewrite rules, invalid rules are skipped as the target registry configuration
+// is validated on startup
+func newRepositoryRewrites(rules []config.RepositoryRewrite) []repositoryRewrite {
+	rewrites := make([]repositoryRewrite, 0, len(rules))
+	for _, rule := range rules {
+		match, err := regexp.Compile(rule.Match)
+		if err != nil {
+			log.Err(err).Str("match", rule.Match).Msg("invalid repository rewrite, skipping")
+			continue
+		}
+		rewrites = append(rewrites, repositoryRewrite{match: match, replace: rule.Replace})
+	}
+	return rewrites
+}
+
+// targetRepository returns the repository relative to the target registry for a source repository,
+// e.g. "docker.io/library/nginx". The first matching rewrite applies, the source repository is kept otherwise.
+func (t *targetRegistry) targetRepository(repository string) string {
+	for _, rewrite := range t.repositoryRewrites {
+		match := rewrite.match.FindStringSubmatchIndex(repository)
+		if match == nil {
+			continue
+		}
+		return string(rewrite.match.ExpandString(nil, rewrite.replace, repository, match))
+	}
+
+	return repository
+}
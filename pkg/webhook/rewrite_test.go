@@ -0,0 +1,47 @@
+package webhook
+
+import (
+	"testing"
+
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTargetRef(t *testing.T) {
+	registryClient := registry.NewInMemoryClient("registry.example.com")
+	target := &targetRegistry{
+		client: registryClient,
+		repositoryRewrites: newRepositoryRewrites([]config.RepositoryRewrite{
+			{Match: `^quay\.io/`, Replace: "mirror/quay.io/..invalid"},
+			{Match: `^docker\.io/library/(.+)$`, Replace: "mirror/dockerhub/$1"},
+			{Match: `^docker\.io/(?P<org>[^/]+)/(?P<name>.+)$`, Replace: "mirror/dockerhub/${org}-${name}"},
+			{Match: `^(?P<domain>[^/]+)/(?P<path>.+)$`, Replace: "mirror/${domain}/${path}"},
+		}),
+	}
+
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"library", "nginx:1.25", "registry.example.com/mirror/dockerhub/nginx:1.25"},
+		{"named groups", "bitnami/redis:7", "registry.example.com/mirror/dockerhub/bitnami-redis:7"},
+		{"digest", "k8s.gcr.io/ingress-nginx/controller@sha256:9bba603b99bf25f6d117cf1235b6598c16033ad027b143c90fa5b3cc583c5713", "registry.example.com/mirror/k8s.gcr.io/ingress-nginx/controller@sha256:9bba603b99bf25f6d117cf1235b6598c16033ad027b143c90fa5b3cc583c5713"},
+		{"invalid rewrite", "quay.io/prometheus/prometheus:v2.48.0", "registry.example.com/quay.io/prometheus/prometheus:v2.48.0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srcRef, err := alltransports.ParseImageName("docker://" + test.source)
+			require.NoError(t, err)
+
+			targetRef := target.targetRef(srcRef)
+
+			assert.Equal(t, test.want, targetRef.DockerReference().String())
+			assert.True(t, registryClient.IsOrigin(targetRef), "rewritten images originate from the target registry")
+		})
+	}
+}
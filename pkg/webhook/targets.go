@@ -0,0 +1,165 @@
+package webhook
+
+import (
+	"strings"
+
+	"github.com/containers/image/v5/transports/alltransports"
+	ctypes "github.com/containers/image/v5/types"
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/rs/zerolog/log"
+)
+
+// Target is an additional registry receiving the images selected by the JMESPath expression, e.g. per tenant
+type Target struct {
+	// JMESPath is evaluated over the FilterContext, the first target returning true is used
+	JMESPath string
+	Client   registry.Client
+
+	// Platforms, CopyArtifacts, Rewrites, Region and Replicas correspond to the options of the default target registry
+	Platforms     []string
+	CopyArtifacts bool
+	Rewrites      []config.RepositoryRewrite
+	Region        string
+	Replicas      []Replica
+}
+
+// Replica is a registry images are replicated to from the target registry, e.g. in another region
+type Replica struct {
+	// Region of the registry, pods in clusters of this region are swapped to the replica
+	Region        string
+	Client        registry.Client
+	CopyArtifacts bool
+}
+
+// Targets allows to copy images to additional registries, images not selected by any target are copied to the
+// default target registry
+func Targets(targets []Target) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.targets = make([]*targetRegistry, 0, len(targets))
+		for _, target := range targets {
+			swapper.targets = append(swapper.targets, &targetRegistry{
+				jmesPath:           target.JMESPath,
+				client:             target.Client,
+				platforms:          target.Platforms,
+				copyArtifacts:      target.CopyArtifacts,
+				repositoryRewrites: newRepositoryRewrites(target.Rewrites),
+				region:             target.Region,
+				replicas:           newReplicas(target.Replicas),
+			})
+		}
+	}
+}
+
+// targetRegistry is a registry images are copied to along with its registry specific settings
+type targetRegistry struct {
+	// jmesPath selects the images copied to the registry, empty for the default target registry
+	jmesPath string
+	client   registry.Client
+
+	// platforms limits the platforms copied from manifest lists unless a source platforms rule matches
+	platforms []string
+	// copyArtifacts enables copying signatures, attestations and OCI referrers of the images
+	copyArtifacts bool
+	// repositoryRewrites map source repositories to repositories in the target registry
+	repositoryRewrites []repositoryRewrite
+
+	// region of the registry, empty if unknown
+	region string
+	// replicas receive a copy of the images from this registry, keeping the repository
+	replicas []*targetRegistry
+}
+
+// newReplicas returns the replicas of a target registry
+func newReplicas(replicas []Replica) []*targetRegistry {
+	targets := make([]*targetRegistry, 0, len(replicas))
+	for _, replica := range replicas {
+		targets = append(targets, &targetRegistry{
+			client:        replica.Client,
+			copyArtifacts: replica.CopyArtifacts,
+			region:        replica.Region,
+		})
+	}
+	return targets
+}
+
+// defaultTarget returns the target registry used for images not selected by any other target
+func (p *ImageSwapper) defaultTarget() *targetRegistry {
+	return &targetRegistry{
+		client:             p.registryClient,
+		platforms:          p.platforms,
+		copyArtifacts:      p.copyArtifacts,
+		repositoryRewrites: p.repositoryRewrites,
+		region:             p.region,
+		replicas:           p.replicas,
+	}
+}
+
+// selectTarget returns the first target whose expression matches the filter context, or the default target
+func (p *ImageSwapper) selectTarget(ctx FilterContext) *targetRegistry {
+	for _, target := range p.targets {
+		if filterMatch(ctx, []config.JMESPathFilter{{JMESPath: target.jmesPath}}) {
+			return target
+		}
+	}
+
+	return p.defaultTarget()
+}
+
+// originTarget returns the target registry the reference originates from, the default target is returned for
+// unknown references
+func (p *ImageSwapper) originTarget(ref ctypes.ImageReference) *targetRegistry {
+	for _, target := range p.targets {
+		if target.client.IsOrigin(ref) {
+			return target
+		}
+	}
+
+	return p.defaultTarget()
+}
+
+// isOrigin returns true if the reference originates from any of the target registries or their replicas
+func (p *ImageSwapper) isOrigin(ref ctypes.ImageReference) bool {
+	for _, target := range append([]*targetRegistry{p.defaultTarget()}, p.targets...) {
+		if target.client.IsOrigin(ref) {
+			return true
+		}
+		for _, replica := range target.replicas {
+			if replica.client.IsOrigin(ref) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// replicaRef returns the reference of an image of the target registry in the replica, the repository relative to
+// the registry is kept
+func (t *targetRegistry) replicaRef(replica *targetRegistry, targetRef ctypes.ImageReference) (ctypes.ImageReference, error) {
+	image := strings.TrimPrefix(targetRef.DockerReference().String(), t.client.Endpoint()+"/")
+	return alltransports.ParseImageName("docker://" + replica.client.Endpoint() + "/" + image)
+}
+
+// nearest returns the registry in the region, either the target registry or one of its replicas, along with the
+// reference of the image in it. The target registry is returned if no region is given or no registry matches.
+func (t *targetRegistry) nearest(region string, targetRef ctypes.ImageReference) (*targetRegistry, ctypes.ImageReference) {
+	if region == "" || t.region == region {
+		return t, targetRef
+	}
+
+	for _, replica := range t.replicas {
+		if replica.region != region {
+			continue
+		}
+
+		replicaRef, err := t.replicaRef(replica, targetRef)
+		if err != nil {
+			log.Warn().Err(err).Str("registry", replica.client.Endpoint()).Msg("invalid replica reference, using target registry")
+			break
+		}
+		return replica, replicaRef
+	}
+
+	return t, targetRef
+}
@@ -0,0 +1,41 @@
+package webhook
+
+import (
+	"testing"
+
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOriginTarget(t *testing.T) {
+	registryClient := registry.NewInMemoryClient("registry.example.com")
+	tenantRegistryClient := registry.NewInMemoryClient("tenant.example.com")
+
+	swapper := NewImageSwapperWithOpts(
+		registryClient,
+		Targets([]Target{{JMESPath: "obj.metadata.namespace == 'tenant'", Client: tenantRegistryClient}}),
+	).(*ImageSwapper)
+
+	tests := []struct {
+		name   string
+		image  string
+		origin bool
+		want   registry.Client
+	}{
+		{"default target", "registry.example.com/docker.io/library/nginx:latest", true, registryClient},
+		{"additional target", "tenant.example.com/docker.io/library/nginx:latest", true, tenantRegistryClient},
+		{"source", "docker.io/library/nginx:latest", false, registryClient},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ref, err := alltransports.ParseImageName("docker://" + test.image)
+			require.NoError(t, err)
+
+			assert.Equal(t, test.origin, swapper.isOrigin(ref))
+			assert.Same(t, test.want, swapper.originTarget(ref).client)
+		})
+	}
+}
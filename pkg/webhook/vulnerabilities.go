@@ -0,0 +1,74 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	ctypes "github.com/containers/image/v5/types"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/rs/zerolog/log"
+)
+
+// scanFindingsTimeout bounds the lookup of the scan findings within the admission
+const scanFindingsTimeout = 5 * time.Second
+
+// ErrVulnerabilityThresholdExceeded is returned if the scan findings of an image exceed the vulnerability thresholds
+var ErrVulnerabilityThresholdExceeded = errors.New("vulnerability threshold exceeded")
+
+// checkVulnerabilities consults the scan findings of the target image, an error wrapping
+// ErrVulnerabilityThresholdExceeded is returned if the image must not be used.
+// Scan findings which cannot be retrieved in time are treated like missing scan results: the image is only refused
+// if a scan is required.
+func (p *ImageSwapper) checkVulnerabilities(ctx context.Context, target *targetRegistry, targetRef ctypes.ImageReference) error {
+	if !p.vulnerabilityPolicy.Enabled {
+		return nil
+	}
+
+	scanner, ok := target.client.(registry.VulnerabilityScanner)
+	if !ok {
+		return nil
+	}
+
+	scanCtx, cancel := context.WithTimeout(ctx, scanFindingsTimeout)
+	defer cancel()
+
+	vulnerabilities, err := scanner.ImageVulnerabilities(scanCtx, targetRef)
+	if err != nil {
+		if !errors.Is(err, registry.ErrScanNotAvailable) {
+			log.Ctx(ctx).Warn().Err(err).Msg("unable to retrieve image scan findings")
+		}
+		if p.vulnerabilityPolicy.RequireScan {
+			return fmt.Errorf("%w: no scan results: %s", ErrVulnerabilityThresholdExceeded, err.Error())
+		}
+		return nil
+	}
+
+	counts := map[string]int{}
+	for _, vulnerability := range vulnerabilities {
+		if slices.Contains(p.vulnerabilityPolicy.AllowList, vulnerability.ID) {
+			continue
+		}
+		counts[strings.ToUpper(vulnerability.Severity)]++
+	}
+
+	var exceeded []string
+	for severity, threshold := range p.vulnerabilityPolicy.Thresholds {
+		// viper lowercases map keys, severities are reported in upper case
+		if count := counts[strings.ToUpper(severity)]; count > threshold {
+			exceeded = append(exceeded, fmt.Sprintf("%d %s findings (threshold %d)", count, strings.ToUpper(severity), threshold))
+		}
+	}
+
+	if len(exceeded) == 0 {
+		return nil
+	}
+
+	sort.Strings(exceeded)
+
+	return fmt.Errorf("%w: %s", ErrVulnerabilityThresholdExceeded, strings.Join(exceeded, ", "))
+}